@@ -5,10 +5,15 @@ go 1.16
 require (
 	github.com/0x434D53/openinbrowser v0.0.0-20160118155317-0d855441189c // indirect
 	github.com/TwinProduction/go-color v1.0.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.3.5 // indirect
 	github.com/google/go-cmp v0.5.4 // indirect
+	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/julienschmidt/httprouter v1.3.0 // indirect
+	github.com/prometheus/client_golang v1.12.2 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
 	github.com/tebeka/selenium v0.9.9 // indirect
 	gitlab.com/aycd-inc/autosolve-clients/autosolve-client-go v0.0.0-20200821180405-cb59ed064f31 // indirect
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
 	golang.org/x/tools/gopls v0.6.8 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
 )
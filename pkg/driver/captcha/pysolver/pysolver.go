@@ -1,34 +1,55 @@
 package pysolver
 
 import (
+	"context"
+	"dolos-dev/pkg/httpclient"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"sync"
+)
+
+var (
+	//solverClient is shared by all solves. The solver is the bot's own service, so it isn't rate limited like the webshops
+	solverClient      *httpclient.Client
+	solverClientMutex sync.Mutex
 )
 
 type response struct {
-	output string `json:"output"`
+	Output string `json:"output"`
 }
 
 //SolveCaptcha takes a captcha image URL and a endpoint where captcha images are solved. Returns solved captcha and error if any
-func SolveCaptcha(captchaURL, solverEndpoint string) (string, error) {
-	req, err := http.NewRequest("POST", solverEndpoint, nil)
-	req.Header.Set("captchaURL", captchaURL)
+func SolveCaptcha(ctx context.Context, captchaURL, solverEndpoint string) (string, error) {
+	client, err := getClient()
+	if err != nil {
+		return "", err
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := client.Do(ctx, "POST", solverEndpoint, nil, http.Header{"captchaURL": {captchaURL}})
 	if err != nil {
 		return "", fmt.Errorf("Failed to connect to solver endpoint (%v)", err)
 	}
-	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
 	response := response{}
-	err = json.Unmarshal(body, &response)
+	err = json.Unmarshal(resp.Body, &response)
 	if err != nil {
 		return "", fmt.Errorf("Failed to unmarshal captcha solver response (%v)", err)
 	}
 
-	return response.output, nil
+	return response.Output, nil
+}
+
+func getClient() (*httpclient.Client, error) {
+	solverClientMutex.Lock()
+	defer solverClientMutex.Unlock()
+
+	if solverClient == nil {
+		client, err := httpclient.New(httpclient.Options{Unlimited: true})
+		if err != nil {
+			return nil, err
+		}
+		solverClient = client
+	}
+	return solverClient, nil
 }
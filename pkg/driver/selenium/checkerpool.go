@@ -0,0 +1,252 @@
+package selenium
+
+import (
+	"context"
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//CheckerPool is a bounded, resizable pool of proxified browsers for stock checks, so the number of browsers no longer
+//depends on the number of products. A task only checks with a browser started with its own proxies, idle browsers of
+//other proxies are recycled for it when the pool is full. Browsers are also replaced once they are older than the pool's max age
+type CheckerPool struct {
+	mutex    sync.Mutex
+	size     int
+	maxAge   time.Duration
+	browsers []*pooledBrowser
+	//changed is closed and replaced whenever a browser is released or the pool resized, to wake up waiting Acquire calls
+	changed chan struct{}
+}
+
+type pooledBrowser struct {
+	//session is nil while the browser is being started
+	session  *SingleSession
+	proxyKey string
+	started  time.Time
+	busy     bool
+}
+
+//CheckerPoolStats is a snapshot of the browsers in the pool
+type CheckerPoolStats struct {
+	Size     int `json:"size"`
+	Browsers int `json:"browsers"`
+	Busy     int `json:"busy"`
+}
+
+//NewCheckerPool creates a pool that runs at most size browsers at once. Browsers are replaced once they are older than
+//maxAge so their proxies change, 0 keeps them until they break
+func (handler *SeleniumHandler) NewCheckerPool(size int, maxAge time.Duration) *CheckerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &CheckerPool{
+		size:    size,
+		maxAge:  maxAge,
+		changed: make(chan struct{}),
+	}
+}
+
+//Acquire returns an idle browser using the given proxies. If there is none it starts one if the pool has room, or
+//quits an idle browser of other proxies and starts one in its place. It waits for a browser to be released otherwise
+func (pool *CheckerPool) Acquire(ctx context.Context, proxies []structs.Proxy) (*SingleSession, error) {
+	key := proxyKey(proxies)
+
+	for {
+		pool.mutex.Lock()
+
+		var idle, other *pooledBrowser
+		for _, browser := range pool.browsers {
+			if browser.busy || browser.session == nil {
+				continue
+			}
+			if browser.proxyKey == key {
+				idle = browser
+				break
+			}
+			if other == nil {
+				other = browser
+			}
+		}
+		if idle != nil {
+			idle.busy = true
+			pool.mutex.Unlock()
+			return idle.session, nil
+		}
+
+		if len(pool.browsers) < pool.size {
+			browser := &pooledBrowser{
+				proxyKey: key,
+				busy:     true,
+			}
+			pool.browsers = append(pool.browsers, browser)
+			pool.mutex.Unlock()
+			return pool.start(browser, proxies)
+		}
+
+		if other != nil {
+			//the browser's proxies are not the task's, it is replaced by one with the task's proxies
+			recycled := other.session
+			other.session = nil
+			other.proxyKey = key
+			other.busy = true
+			pool.mutex.Unlock()
+			go recycled.Webdriver.Quit()
+			return pool.start(other, proxies)
+		}
+
+		changed := pool.changed
+		pool.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+//start starts the browser of a reserved slot, freeing the slot again if that fails
+func (pool *CheckerPool) start(browser *pooledBrowser, proxies []structs.Proxy) (*SingleSession, error) {
+	wd, err := createSingleSession(proxies)
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if err != nil {
+		pool.drop(browser)
+		return nil, fmt.Errorf("Failed to start browser (%v)", err)
+	}
+	browser.session = &SingleSession{
+		Webdriver: wd,
+	}
+	browser.started = time.Now()
+	return browser.session, nil
+}
+
+//Release returns a browser to the pool. If the check failed the browser is pinged and quit if it doesn't answer,
+//and browsers above the pool's size or past their max age are quit as well. Browsers released after CloseAll are quit
+func (pool *CheckerPool) Release(session *SingleSession, checkErr error) {
+	broken := false
+	if checkErr != nil {
+		_, pingErr := session.Webdriver.CurrentURL()
+		broken = pingErr != nil
+	}
+
+	pool.mutex.Lock()
+	for _, browser := range pool.browsers {
+		if browser.session != session {
+			continue
+		}
+		expired := pool.maxAge > 0 && time.Since(browser.started) > pool.maxAge
+		if broken || expired || len(pool.browsers) > pool.size {
+			pool.drop(browser)
+			pool.mutex.Unlock()
+			go session.Webdriver.Quit()
+			return
+		}
+		browser.busy = false
+		pool.notify()
+		pool.mutex.Unlock()
+		return
+	}
+	pool.mutex.Unlock()
+
+	//CloseAll dropped the browser while it was checking
+	err := session.Webdriver.Quit()
+	if err != nil {
+		fmt.Println("failed to quit selenium session ", err)
+	}
+}
+
+//Resize changes how many browsers the pool runs at once. Idle browsers above the new size are quit right away, busy ones when released
+func (pool *CheckerPool) Resize(size int) {
+	if size < 1 {
+		size = 1
+	}
+
+	pool.mutex.Lock()
+	pool.size = size
+	quit := make([]*SingleSession, 0)
+	for i := len(pool.browsers) - 1; i >= 0 && len(pool.browsers) > pool.size; i-- {
+		browser := pool.browsers[i]
+		if !browser.busy && browser.session != nil {
+			quit = append(quit, browser.session)
+			pool.drop(browser)
+		}
+	}
+	pool.notify()
+	pool.mutex.Unlock()
+
+	for _, session := range quit {
+		session.Webdriver.Quit()
+	}
+}
+
+//Stats returns a snapshot of the browsers in the pool
+func (pool *CheckerPool) Stats() CheckerPoolStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	stats := CheckerPoolStats{
+		Size:     pool.size,
+		Browsers: len(pool.browsers),
+	}
+	for _, browser := range pool.browsers {
+		if browser.busy {
+			stats.Busy++
+		}
+	}
+	return stats
+}
+
+//CloseAll quits all idle browsers. Browsers that are still checking are quit when they are released
+func (pool *CheckerPool) CloseAll() {
+	pool.mutex.Lock()
+	quit := make([]*SingleSession, 0)
+	for _, browser := range pool.browsers {
+		if browser.session != nil && !browser.busy {
+			quit = append(quit, browser.session)
+		}
+	}
+	pool.browsers = nil
+	pool.notify()
+	pool.mutex.Unlock()
+
+	for _, session := range quit {
+		err := session.Webdriver.Quit()
+		if err != nil {
+			fmt.Println("failed to quit selenium session ", err)
+		}
+	}
+}
+
+//drop removes a browser from the pool. The caller holds the mutex
+func (pool *CheckerPool) drop(dropped *pooledBrowser) {
+	for i, browser := range pool.browsers {
+		if browser == dropped {
+			pool.browsers = append(pool.browsers[:i], pool.browsers[i+1:]...)
+			break
+		}
+	}
+	pool.notify()
+}
+
+//notify wakes up all waiting Acquire calls. The caller holds the mutex
+func (pool *CheckerPool) notify() {
+	close(pool.changed)
+	pool.changed = make(chan struct{})
+}
+
+//proxyKey identifies a set of proxies regardless of their order
+func proxyKey(proxies []structs.Proxy) string {
+	keys := make([]string, 0, len(proxies))
+	for _, proxy := range proxies {
+		keys = append(keys, fmt.Sprint(proxy.User, "@", proxy.IP, ":", proxy.Port))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
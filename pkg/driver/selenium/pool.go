@@ -0,0 +1,478 @@
+package selenium
+
+import (
+	"context"
+	"dolos-dev/pkg/driver/webshop"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/metrics"
+	"dolos-dev/pkg/structs"
+	"dolos-dev/pkg/switcher"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+//SessionState is the lifecycle state of a checkout session in the pool
+type SessionState int
+
+const (
+	SESSION_STATE_STARTING   SessionState = 0
+	SESSION_STATE_READY      SessionState = 1
+	SESSION_STATE_CHECKING   SessionState = 2
+	SESSION_STATE_SIGNING_IN SessionState = 3
+	SESSION_STATE_RECREATING SessionState = 4
+	SESSION_STATE_DEAD       SessionState = 5
+	SESSION_STATE_REJECTED   SessionState = 6
+	SESSION_STATE_CLOSED     SessionState = 7
+	SESSION_STATE_WARMING    SessionState = 8
+)
+
+func (state SessionState) String() string {
+	switch state {
+	case SESSION_STATE_STARTING:
+		return "starting"
+	case SESSION_STATE_READY:
+		return "ready"
+	case SESSION_STATE_CHECKING:
+		return "checking"
+	case SESSION_STATE_SIGNING_IN:
+		return "signing in"
+	case SESSION_STATE_RECREATING:
+		return "recreating"
+	case SESSION_STATE_DEAD:
+		return "dead"
+	case SESSION_STATE_REJECTED:
+		return "credentials rejected"
+	case SESSION_STATE_CLOSED:
+		return "closed"
+	case SESSION_STATE_WARMING:
+		return "warming"
+	}
+	return "unknown"
+}
+
+const (
+	//defaultHealthCheckInterval is used when checkout_session_healthcheck_interval is not configured
+	defaultHealthCheckInterval = 30 * time.Second
+	//busyRetryInterval is how long the supervisor waits before health checking a session that is checking out
+	busyRetryInterval = 5 * time.Second
+	//recreateBackoffMin and recreateBackoffMax bound the wait between failed attempts to recreate a browser
+	recreateBackoffMin = 10 * time.Second
+	recreateBackoffMax = 5 * time.Minute
+	//maxKeepAliveFailures is how many keep alive errors in a row we accept before replacing the browser
+	maxKeepAliveFailures = 3
+)
+
+//sessionHealth holds the supervisor's bookkeeping for a single session
+type sessionHealth struct {
+	lastCheck         time.Time
+	lastKeepAlive     time.Time
+	lastSignIn        time.Time
+	lastWarm          time.Time
+	lastAccountCheck  time.Time
+	lastError         string
+	failures          int
+	relogins          int
+	recreations       int
+	recreateBackoff   time.Duration
+	nextRecreateAfter time.Time
+}
+
+//SessionInfo is a snapshot of a checkout session's state in the pool
+type SessionInfo struct {
+	ID              int             `json:"id"`
+	Webshop         structs.Webshop `json:"webshop"`
+	State           string          `json:"state"`
+	Busy            bool            `json:"busy"`
+	LastHealthCheck time.Time       `json:"last_health_check"`
+	LastSignIn      time.Time       `json:"last_sign_in"`
+	LastError       string          `json:"last_error,omitempty"`
+	Failures        int             `json:"failures"`
+	Relogins        int             `json:"relogins"`
+	Recreations     int             `json:"recreations"`
+	WarmFor         string          `json:"warm_for,omitempty"`
+	Warm            bool            `json:"warm"`
+	LastWarm        time.Time       `json:"last_warm"`
+}
+
+//SessionStates returns a snapshot of every checkout session in the pool
+func (handler *SeleniumHandler) SessionStates() []SessionInfo {
+	handler.RLock()
+	defer handler.RUnlock()
+
+	infos := make([]SessionInfo, 0)
+	for _, webshopSessions := range handler.sessions {
+		for _, session := range webshopSessions {
+			session.mutex.Lock()
+			warmFor := ""
+			if session.warmFor != nil {
+				warmFor = session.warmFor.Name
+			}
+			infos = append(infos, SessionInfo{
+				ID:              session.id,
+				Webshop:         session.kind,
+				State:           session.state.String(),
+				Busy:            session.busy,
+				LastHealthCheck: session.health.lastCheck,
+				LastSignIn:      session.health.lastSignIn,
+				LastError:       session.health.lastError,
+				Failures:        session.health.failures,
+				Relogins:        session.health.relogins,
+				Recreations:     session.health.recreations,
+				WarmFor:         warmFor,
+				Warm:            session.warm,
+				LastWarm:        session.health.lastWarm,
+			})
+			session.mutex.Unlock()
+		}
+	}
+	return infos
+}
+
+func (session *Session) setState(state SessionState, err error) {
+	session.mutex.Lock()
+	session.state = state
+	if err != nil {
+		session.health.lastError = err.Error()
+	}
+	session.mutex.Unlock()
+
+	if state == SESSION_STATE_DEAD || state == SESSION_STATE_REJECTED {
+		session.publishUnhealthy(state, err)
+	}
+}
+
+//publishUnhealthy publishes that the session was taken out of circulation
+func (session *Session) publishUnhealthy(state SessionState, err error) {
+	metrics.Errors.Inc(metrics.ERROR_SESSION_UNHEALTHY)
+	data := map[string]interface{}{
+		"session_id": session.id,
+		"webshop":    session.kind,
+		"state":      state.String(),
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	events.Publish(events.Event{
+		Type: events.EVENT_SESSION_UNHEALTHY,
+		Data: data,
+	})
+}
+
+//claim takes the session out of circulation for maintenance. Returns false if it is checking out or already closed
+func (session *Session) claim(state SessionState) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.busy || session.state == SESSION_STATE_CLOSED {
+		return false
+	}
+	session.state = state
+	return true
+}
+
+//wakeUp makes the session's supervisor look at it right away
+func (session *Session) wakeUp() {
+	select {
+	case session.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (handler *SeleniumHandler) failedState(webshopKind structs.Webshop) SessionState {
+	handler.RLock()
+	defer handler.RUnlock()
+	if handler.loginErrors[webshopKind] != nil {
+		return SESSION_STATE_REJECTED
+	}
+	return SESSION_STATE_DEAD
+}
+
+//superviseSession health checks a single session on its own schedule until ctx is cancelled.
+//It signs the session back in when the webshop signed it out and replaces the browser when it crashed
+func (handler *SeleniumHandler) superviseSession(ctx context.Context, session *Session, globalConfig structs.GlobalConfig) {
+	healthCheckInterval := time.Duration(globalConfig.CheckoutSessionHealthCheckInterval) * time.Second
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+	keepAliveInterval := time.Duration(globalConfig.CheckoutSessionKeepAliveInterval) * time.Second
+
+	//spread the sessions' checks so they don't all hit the webshop at once
+	wait := time.Duration(rand.Int63n(int64(healthCheckInterval)))
+	for {
+		select {
+		case <-ctx.Done():
+			helperfuncs.Log("[session %v] supervisor exiting", session.id)
+			return
+		case <-time.After(wait):
+		case <-session.wake:
+		}
+
+		session.mutex.Lock()
+		state := session.state
+		health := session.health
+		hasWarmProduct := session.warmFor != nil
+		needsWarming := hasWarmProduct && !session.warm
+		session.mutex.Unlock()
+
+		switch state {
+		case SESSION_STATE_CLOSED:
+			return
+		case SESSION_STATE_REJECTED:
+			//nothing will fix this until the credentials are changed
+			wait = recreateBackoffMax
+			continue
+		case SESSION_STATE_DEAD:
+			if time.Now().Before(health.nextRecreateAfter) {
+				wait = time.Until(health.nextRecreateAfter)
+				continue
+			}
+			handler.recreateSession(session, globalConfig)
+			wait = healthCheckInterval
+			continue
+		}
+
+		if !session.claim(SESSION_STATE_CHECKING) {
+			wait = busyRetryInterval
+			continue
+		}
+
+		keepAlive := keepAliveInterval > 0 && time.Since(health.lastKeepAlive) >= keepAliveInterval
+		err := handler.checkSessionHealth(session, keepAlive, globalConfig)
+		if err != nil {
+			helperfuncs.Log("[session %v] health check failed (%v)", session.id, err)
+		}
+		wait = healthCheckInterval
+
+		//the keep alive navigates away from the parked page
+		if err == nil && (needsWarming || (keepAlive && hasWarmProduct)) {
+			//the account is confirmed along with the keep alive, never if keep alives are off
+			confirmAccount := keepAliveInterval > 0 && time.Since(health.lastAccountCheck) >= keepAliveInterval
+			err = handler.warmSession(session, confirmAccount)
+			if err != nil {
+				helperfuncs.Log("[session %v] failed to pre-warm, it will check out cold (%v)", session.id, err)
+			}
+		}
+	}
+}
+
+//assignWarmProducts spreads the watched products over the checkout sessions of their webshop.
+//Each session then keeps itself parked on its product's offers with an empty cart
+func (handler *SeleniumHandler) assignWarmProducts(productURLs []*structs.ProductURL) {
+	productsPerKind := make(map[structs.Webshop][]structs.ProductURL)
+	for _, productURL := range productURLs {
+		if productURL.OnlyCheckStock {
+			continue
+		}
+		kind := helperfuncs.GetWebshopFromString(productURL.URL)
+		productsPerKind[kind] = append(productsPerKind[kind], *productURL)
+	}
+
+	handler.RLock()
+	defer handler.RUnlock()
+	for kind, sessions := range handler.sessions {
+		products := productsPerKind[kind]
+		if len(products) == 0 {
+			continue
+		}
+		for i, session := range sessions {
+			product := products[i%len(products)]
+			session.mutex.Lock()
+			session.warmFor = &product
+			session.mutex.Unlock()
+			helperfuncs.Log("[session %v] will be kept warm for %s", session.id, product.Name)
+		}
+	}
+}
+
+//warmSession parks the session on its product's offers with an empty cart.
+//confirmAccount also checks the account's address and payment method, which takes a few extra page loads
+func (handler *SeleniumHandler) warmSession(session *Session, confirmAccount bool) error {
+	if !session.claim(SESSION_STATE_WARMING) {
+		return nil
+	}
+
+	session.mutex.Lock()
+	webdriver := session.webdriver
+	product := *session.warmFor
+	session.mutex.Unlock()
+
+	shop, _, err := switcher.GetWebshop(product.URL)
+	if err == nil {
+		err = shop.PrepareCheckout(product, webdriver, confirmAccount)
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.state == SESSION_STATE_CLOSED {
+		return nil
+	}
+	session.state = SESSION_STATE_READY
+	session.warm = err == nil
+	if err != nil {
+		session.health.lastError = err.Error()
+		return err
+	}
+	session.health.lastWarm = time.Now()
+	if confirmAccount {
+		session.health.lastAccountCheck = time.Now()
+	}
+	return nil
+}
+
+//checkSessionHealth verifies the browser still responds and, if keepAlive is set, that the user is still signed in.
+//The session must be claimed by the caller; it is put back in circulation (or marked dead) before returning
+func (handler *SeleniumHandler) checkSessionHealth(session *Session, keepAlive bool, globalConfig structs.GlobalConfig) error {
+	session.mutex.Lock()
+	webdriver := session.webdriver
+	session.health.lastCheck = time.Now()
+	session.mutex.Unlock()
+
+	//a crashed browser or chromedriver fails even the simplest command
+	if webdriver == nil {
+		return handler.markDead(session, fmt.Errorf("Session has no browser"))
+	}
+	if _, err := webdriver.CurrentURL(); err != nil {
+		return handler.markDead(session, fmt.Errorf("Browser is not responding (%v)", err))
+	}
+
+	if !keepAlive {
+		session.setState(SESSION_STATE_READY, nil)
+		return nil
+	}
+
+	session.mutex.Lock()
+	session.warm = false
+	session.mutex.Unlock()
+	err := getUserSessionKeepAliveFunc(session.kind)(webdriver, globalConfig, session.kind)
+	session.mutex.Lock()
+	session.health.lastKeepAlive = time.Now()
+	session.mutex.Unlock()
+	if err == nil {
+		session.mutex.Lock()
+		session.health.failures = 0
+		session.state = SESSION_STATE_READY
+		session.mutex.Unlock()
+		return nil
+	}
+
+	if _, ok := webshop.AsLoginError(err); ok {
+		return handler.recoverSignIn(session, webdriver, err, globalConfig)
+	}
+
+	session.mutex.Lock()
+	session.health.failures++
+	session.health.lastError = err.Error()
+	failures := session.health.failures
+	session.state = SESSION_STATE_READY
+	session.mutex.Unlock()
+	if failures >= maxKeepAliveFailures {
+		return handler.markDead(session, fmt.Errorf("Keep alive failed %v times in a row (%v)", failures, err))
+	}
+
+	return fmt.Errorf("[user session keep alive] Failed to keep user session alive (%v)", err)
+}
+
+//recoverSignIn acts on a sign in error from the keep alive by waiting for the account owner or signing back in.
+//The session must be claimed by the caller
+func (handler *SeleniumHandler) recoverSignIn(session *Session, webdriver selenium.WebDriver, err error, globalConfig structs.GlobalConfig) error {
+	loginErr, _ := webshop.AsLoginError(err)
+	if !loginErr.Retryable() {
+		handler.rejectLogin(session.kind, loginErr)
+		session.setState(SESSION_STATE_REJECTED, loginErr)
+		return fmt.Errorf("Webshop rejected the credentials, session disabled (%v)", loginErr)
+	}
+
+	session.setState(SESSION_STATE_SIGNING_IN, loginErr)
+	if loginErr.NeedsUser() {
+		helperfuncs.Log("[session %v] Sign in needs your attention in the browser window: %s. Waiting up to %v", session.id, loginErr.Outcome, loginApprovalTimeout)
+		err = getAwaitLoginFunc(session.kind)(webdriver, loginApprovalTimeout)
+	} else {
+		username, password := credentialsForKind(session.kind, globalConfig)
+		err = logIn(webdriver, session.kind, username, password)
+	}
+
+	if err != nil {
+		if loginErr, ok := webshop.AsLoginError(err); ok && !loginErr.Retryable() {
+			handler.rejectLogin(session.kind, loginErr)
+			session.setState(SESSION_STATE_REJECTED, loginErr)
+			return fmt.Errorf("Webshop rejected the credentials, session disabled (%v)", loginErr)
+		}
+		//a fresh browser gets a fresh sign in on the next round
+		return handler.markDead(session, fmt.Errorf("Failed to sign back in (%v)", err))
+	}
+
+	session.mutex.Lock()
+	session.health.relogins++
+	session.health.failures = 0
+	session.health.lastSignIn = time.Now()
+	session.state = SESSION_STATE_READY
+	session.mutex.Unlock()
+	helperfuncs.Log("[session %v] Signed back in", session.id)
+	return nil
+}
+
+//markDead takes the session out of circulation until the supervisor replaces its browser
+func (handler *SeleniumHandler) markDead(session *Session, err error) error {
+	session.setState(SESSION_STATE_DEAD, err)
+	return err
+}
+
+//recreateSession replaces the session's browser with a fresh, signed in one. Failed attempts back off exponentially
+func (handler *SeleniumHandler) recreateSession(session *Session, globalConfig structs.GlobalConfig) {
+	if !session.claim(SESSION_STATE_RECREATING) {
+		return
+	}
+
+	session.mutex.Lock()
+	oldWebdriver := session.webdriver
+	session.webdriver = nil
+	session.mutex.Unlock()
+	if oldWebdriver != nil {
+		//the browser is most likely gone already, so we don't care if this fails
+		oldWebdriver.Quit()
+	}
+
+	helperfuncs.Log("[session %v] Recreating browser", session.id)
+	username, password := credentialsForKind(session.kind, globalConfig)
+	webdriver, err := handler.initAndLoginSession(session.id, session.kind, username, password)
+	failedState := handler.failedState(session.kind)
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.state == SESSION_STATE_CLOSED {
+		//we were shut down while signing in
+		if webdriver != nil {
+			webdriver.Quit()
+		}
+		return
+	}
+	if err != nil {
+		session.health.lastError = err.Error()
+		session.health.recreateBackoff *= 2
+		if session.health.recreateBackoff < recreateBackoffMin {
+			session.health.recreateBackoff = recreateBackoffMin
+		}
+		if session.health.recreateBackoff > recreateBackoffMax {
+			session.health.recreateBackoff = recreateBackoffMax
+		}
+		session.health.nextRecreateAfter = time.Now().Add(session.health.recreateBackoff)
+		session.state = failedState
+		helperfuncs.Log("[session %v] Failed to recreate browser, retrying in %v (%v)", session.id, session.health.recreateBackoff, err)
+		session.publishUnhealthy(failedState, err)
+		return
+	}
+
+	session.webdriver = webdriver
+	session.warm = false
+	session.health.lastAccountCheck = time.Time{}
+	session.health.recreations++
+	session.health.recreateBackoff = 0
+	session.health.failures = 0
+	session.health.lastSignIn = time.Now()
+	session.health.lastKeepAlive = time.Now()
+	session.state = SESSION_STATE_READY
+	helperfuncs.Log("[session %v] Browser recreated", session.id)
+}
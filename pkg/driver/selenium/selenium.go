@@ -5,9 +5,16 @@ import (
 	"dolos-dev/pkg/driver/webshop"
 	amazonws "dolos-dev/pkg/driver/webshop/amazon"
 	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/metrics"
 	"dolos-dev/pkg/structs"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -15,21 +22,51 @@ import (
 	"github.com/tebeka/selenium/chrome"
 )
 
+const (
+	//loginAttempts is how many times a checkout session tries to sign in before giving up, unless the credentials are rejected
+	loginAttempts = 2
+	//loginApprovalTimeout is how long we wait for the account owner to approve a sign in or enter a one time password
+	loginApprovalTimeout = 5 * time.Minute
+)
+
+//COOKIE_DIR is where the cookies of the checkout sessions are saved on shutdown and restored from when they sign in
+const COOKIE_DIR = "stockalert-config/cookies"
+
 //SeleniumHandler is an instance of this driver that allows for interaction with the selenium interface
 type SeleniumHandler struct {
 	seleniumService *selenium.Service
 	sessions        map[structs.Webshop][]*Session
+	//loginErrors holds the sign in errors per webshop that retrying cannot fix (e.g. wrong password)
+	loginErrors map[structs.Webshop]*webshop.LoginError
 	//lastPort        int
 	sync.RWMutex
+
+	//httpCheckout makes checkouts replay the flow over plain HTTP with a session's cookies, falling back to the browser
+	httpCheckout bool
+
+	//checkoutTraces holds the timings of the most recent checkouts, oldest first
+	checkoutTraces []*webshop.CheckoutTrace
+	traceMutex     sync.Mutex
 }
 
-//Session represents a single selenium webdriver and has a flag 'busy' to indicate whether or not it is being used by another task
+//Session represents a single selenium webdriver and has a flag 'busy' to indicate whether or not it is being used by another task.
+//All fields except id and kind are guarded by the session's own mutex so a slow session never blocks the others
 type Session struct {
 	id        int
 	webdriver selenium.WebDriver
 	kind      structs.Webshop
 	//seleniumService *selenium.Service
-	busy bool
+	busy   bool
+	state  SessionState
+	health sessionHealth
+	mutex  sync.Mutex
+
+	//warmFor is the product this session keeps itself parked on, if checkout sessions are pre-warmed
+	warmFor *structs.ProductURL
+	//warm is set while the session is parked on warmFor's offers with an empty cart
+	warm bool
+	//wake makes the supervisor look at the session right away instead of at its next health check
+	wake chan struct{}
 }
 
 type SingleSession struct {
@@ -41,6 +78,8 @@ type SingleSession struct {
 func (handler *SeleniumHandler) CreateCheckoutSessions(sessionCount int, ctx context.Context, globalConfig structs.GlobalConfig, productURLs []*structs.ProductURL) error {
 	//seleniumHandler := &SeleniumHandler{
 	handler.sessions = make(map[structs.Webshop][]*Session)
+	handler.loginErrors = make(map[structs.Webshop]*webshop.LoginError)
+	handler.httpCheckout = globalConfig.CheckoutOverHTTP
 	//	lastPort: 8099,
 	//}
 	var wg sync.WaitGroup
@@ -56,12 +95,22 @@ func (handler *SeleniumHandler) CreateCheckoutSessions(sessionCount int, ctx con
 	}
 	wg.Wait()
 
+	if globalConfig.CheckoutPrewarm {
+		handler.assignWarmProducts(productURLs)
+	}
+
 	//check if session count is < sessionCount and return error if that is the case
 	/*if len(handler.sessions) != sessionCount {
 		return fmt.Errorf("Failed to start one or more selenium sessions")
 	}*/
 
-	go handler.sessionKeepAlive(ctx, globalConfig)
+	handler.RLock()
+	for _, webshopSessions := range handler.sessions {
+		for _, session := range webshopSessions {
+			go handler.superviseSession(ctx, session, globalConfig)
+		}
+	}
+	handler.RUnlock()
 
 	return nil
 }
@@ -109,8 +158,10 @@ func (handler *SeleniumHandler) NewSession(proxies *[]structs.Proxy) (*SingleSes
 func (handler *SeleniumHandler) createSession(wg *sync.WaitGroup, id int, webshopKind structs.Webshop, username, password string) {
 	//we add the session to the handler immediately, so any parent functions will already know it's being worked on
 	newSession := &Session{
-		id:   id,
-		kind: webshopKind,
+		id:    id,
+		kind:  webshopKind,
+		state: SESSION_STATE_STARTING,
+		wake:  make(chan struct{}, 1),
 	}
 	handler.addSessionSafe(webshopKind, newSession)
 
@@ -119,14 +170,16 @@ func (handler *SeleniumHandler) createSession(wg *sync.WaitGroup, id int, websho
 	webdriver, err := handler.initAndLoginSession(id, webshopKind, username, password)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("Failed to create selenium session (%v)", err))
-		//delete
-		handler.deleteBadSession(id, webshopKind)
+		//the session supervisor will try to recreate it
+		newSession.setState(handler.failedState(webshopKind), err)
 		return
 	}
 
-	handler.Lock()
+	newSession.mutex.Lock()
 	newSession.webdriver = webdriver
-	handler.Unlock()
+	newSession.health.lastSignIn = time.Now()
+	newSession.mutex.Unlock()
+	newSession.setState(SESSION_STATE_READY, nil)
 }
 
 func createSingleSession( /*port int,*/ proxies []structs.Proxy) (selenium.WebDriver, error) {
@@ -191,6 +244,15 @@ func (session *SingleSession) SolveCaptcha(captchaToken string, webshop webshop.
 	return err
 }
 
+//Screenshot takes a screenshot of the session's browser as png
+func (session *SingleSession) Screenshot() ([]byte, error) {
+	screenshot, err := session.Webdriver.Screenshot()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to take screenshot (%v)", err)
+	}
+	return screenshot, nil
+}
+
 func getRandomUserAgent() string {
 
 	userAgents := [10]string{
@@ -227,56 +289,156 @@ func (session *SingleSession) CheckStockStatus(productURL structs.ProductURL, we
 	return inStock, inStockCartButton, captcha, captchaStruct, err
 }
 
-func (handler *SeleniumHandler) Checkout(useAddToCartButton bool, webshop webshop.Webshop, product structs.ProductURL) error {
-	//will mark checkout session as not busy
+//Checkout checks the product out on a free checkout session, preferring one that is pre-warmed for it.
+//detected is when the product was seen in stock and is used as the start of the checkout's timings
+func (handler *SeleniumHandler) Checkout(useAddToCartButton bool, shop webshop.Webshop, product structs.ProductURL, detected time.Time) error {
+	//will mark checkout session as not busy; it has left its parked page so the supervisor re-warms it
 	unbusyFunc := func(session *Session) {
-		handler.Lock()
+		session.mutex.Lock()
 		session.busy = false
-		handler.Unlock()
+		session.warm = false
+		session.mutex.Unlock()
+		session.wakeUp()
 	}
 
 	//refresh page
 	//handler.sessions[0].webdriver.Refresh()
-	session := handler.getInactiveSession(webshop.GetKind())
+	session, warm := handler.getInactiveSession(shop.GetKind(), product.ASIN)
 	if session == nil {
+		metrics.CheckoutResults.Inc(product.Name, shop.GetKind().Name(), "none", metrics.CHECKOUT_RESULT_NO_SESSION, "none")
 		return fmt.Errorf("No free sessions available to checkout product %s", product.Name)
 	}
 
 	defer unbusyFunc(session)
 
-	err := webshop.CheckoutSidebar(useAddToCartButton, product, session.webdriver)
+	strategy := webshop.STRATEGY_COLD
+	if handler.httpCheckout {
+		strategy = webshop.STRATEGY_HTTP
+	} else if warm {
+		strategy = webshop.STRATEGY_WARM
+	}
+	metrics.CheckoutAttempts.Inc(product.Name, shop.GetKind().Name(), strategy)
+	trace := webshop.NewCheckoutTrace(product, shop.GetKind(), strategy, detected)
+	trace.SessionID = session.id
+	trace.Step(webshop.STEP_SESSION_ACQUIRED)
+
+	var err error
+	if handler.httpCheckout {
+		err = checkoutHTTP(session.webdriver, shop, product, trace)
+		if ok, cartChanged := webshop.CanFallBack(err); ok {
+			helperfuncs.Log("HTTP checkout of %s got an unexpected response, falling back to the browser (%v)", product.Name, err)
+			trace.Strategy = webshop.STRATEGY_HTTP_FALLBACK
+			trace.Step(webshop.STEP_FALLBACK)
+			err = nil
+			if cartChanged {
+				//we don't know what made it into the cart, start over with an empty one
+				err = shop.PrepareCheckout(product, session.webdriver, false)
+			}
+			if err == nil {
+				err = shop.CheckoutSidebar(useAddToCartButton, product, session.webdriver, trace)
+			}
+		}
+	} else {
+		err = shop.CheckoutSidebar(useAddToCartButton, product, session.webdriver, trace)
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to checkout product %s (%v)", product.Name, err)
+		err = fmt.Errorf("Failed to checkout product %s (%v)", product.Name, err)
 	}
+	handler.recordTrace(trace, err)
 
-	return nil
+	return err
 }
 
-func (handler *SeleniumHandler) initAndLoginSession(id int, webshopKind structs.Webshop, username, password string) (selenium.WebDriver, error) {
-	wd, err := createSingleSession( /*8099+id, */ nil)
+//checkoutHTTP checks the product out without the browser, using the browser's cookies and user agent
+func checkoutHTTP(webdriver selenium.WebDriver, shop webshop.Webshop, product structs.ProductURL, trace *webshop.CheckoutTrace) error {
+	seleniumCookies, err := webdriver.GetCookies()
 	if err != nil {
-		return nil, err
+		return &webshop.UnexpectedResponseError{Step: webshop.STEP_SESSION_ACQUIRED, Err: fmt.Errorf("Failed to get cookies from browser (%v)", err)}
+	}
+	cookies := make([]*http.Cookie, 0, len(seleniumCookies))
+	for _, cookie := range seleniumCookies {
+		cookies = append(cookies, &http.Cookie{
+			Name:   cookie.Name,
+			Value:  cookie.Value,
+			Path:   cookie.Path,
+			Domain: cookie.Domain,
+			Secure: cookie.Secure,
+		})
 	}
 
+	userAgent, err := webdriver.ExecuteScript("return navigator.userAgent;", nil)
+	userAgentString, ok := userAgent.(string)
+	if err != nil || !ok {
+		userAgentString = getRandomUserAgent()
+	}
+
+	return shop.CheckoutHTTP(product, cookies, userAgentString, trace)
+}
+
+func (handler *SeleniumHandler) initAndLoginSession(id int, webshopKind structs.Webshop, username, password string) (selenium.WebDriver, error) {
+	handler.RLock()
+	rejectedErr := handler.loginErrors[webshopKind]
+	handler.RUnlock()
+	if rejectedErr != nil {
+		return nil, fmt.Errorf("Not signing in, the webshop rejected these credentials before (%v)", rejectedErr)
+	}
+
+	var err error
+	for attempt := 1; attempt <= loginAttempts; attempt++ {
+		var wd selenium.WebDriver
+		wd, err = createSingleSession( /*8099+id, */ nil)
+		if err != nil {
+			return nil, err
+		}
+
+		err = restoreCookies(wd, webshopKind, id)
+		if err != nil {
+			helperfuncs.Log("[session %v] %v, signing in without them", id, err)
+		}
+
+		err = logIn(wd, webshopKind, username, password)
+		if err == nil {
+			return wd, nil
+		}
+
+		wd.Quit()
+		if loginErr, ok := webshop.AsLoginError(err); ok && !loginErr.Retryable() {
+			handler.rejectLogin(webshopKind, loginErr)
+			return nil, fmt.Errorf("Failed to log in for this session (%v)", err)
+		}
+		helperfuncs.Log("[session %v] Sign in attempt %v/%v failed (%v)", id, attempt, loginAttempts, err)
+	}
+
+	return nil, fmt.Errorf("Failed to log in for this session after %v attempts (%v)", loginAttempts, err)
+}
+
+//logIn signs the webdriver in and gives the account owner time to approve the sign in or enter a one time password if the webshop asks for it
+func logIn(wd selenium.WebDriver, webshopKind structs.Webshop, username, password string) error {
 	signInURL, signInFunc := getSignInURLAndFunc(webshopKind)
-	err = signInFunc(username, password, wd, signInURL)
-	if err != nil {
-		err = fmt.Errorf("Failed to log in for this session (%v)", err)
-		return nil, err
+	if signInFunc == nil {
+		return fmt.Errorf("No sign in function for this webshop")
 	}
 
-	return wd, nil
+	err := signInFunc(username, password, wd, signInURL)
+	if loginErr, ok := webshop.AsLoginError(err); ok && loginErr.NeedsUser() {
+		helperfuncs.Log("Sign in needs your attention in the browser window: %s. Waiting up to %v", loginErr.Outcome, loginApprovalTimeout)
+		err = getAwaitLoginFunc(webshopKind)(wd, loginApprovalTimeout)
+	}
+
+	return err
+}
+
+//rejectLogin remembers that the webshop rejected our credentials so no further sessions try (and risk locking the account)
+func (handler *SeleniumHandler) rejectLogin(webshopKind structs.Webshop, loginErr *webshop.LoginError) {
+	handler.Lock()
+	handler.loginErrors[webshopKind] = loginErr
+	handler.Unlock()
+	helperfuncs.Log("Webshop %v rejected the configured credentials: %s. No more sessions will sign in until restart", webshopKind, loginErr.Outcome)
 }
 
 func (handler *SeleniumHandler) maxSessionsCreated(maxSessionCount int, url string, globalConfig structs.GlobalConfig) (bool, structs.Webshop, string, string) {
 	webshopKind := helperfuncs.GetWebshopFromString(url)
-
-	var username, password string
-	switch webshopKind {
-	case structs.WEBSHOP_AMAZON, structs.WEBSHOP_AMAZONNL, structs.WEBSHOP_AMAZONFR, structs.WEBSHOP_AMAZONIT, structs.WEBSHOP_AMAZONDE:
-		username = globalConfig.AmazonUsername
-		password = globalConfig.AmazonPassword
-	}
+	username, password := credentialsForKind(webshopKind, globalConfig)
 
 	handler.RLock()
 	count := len(handler.sessions[webshopKind])
@@ -288,17 +450,43 @@ func (handler *SeleniumHandler) maxSessionsCreated(maxSessionCount int, url stri
 	return true, 0, "", ""
 }
 
+//credentialsForKind returns the username and password configured for the given webshop
+func credentialsForKind(webshopKind structs.Webshop, globalConfig structs.GlobalConfig) (string, string) {
+	switch webshopKind {
+	case structs.WEBSHOP_AMAZON, structs.WEBSHOP_AMAZONNL, structs.WEBSHOP_AMAZONFR, structs.WEBSHOP_AMAZONIT, structs.WEBSHOP_AMAZONDE:
+		return globalConfig.AmazonUsername, globalConfig.AmazonPassword
+	}
+
+	return "", ""
+}
+
 //CloseAll closes all webdriver sessions and services related to selenium to prepare for graceful exit of the application
 func (handler *SeleniumHandler) CloseAll() {
+	handler.QuitSessions()
+	handler.StopService()
+}
+
+//QuitSessions quits the browsers of all checkout sessions
+func (handler *SeleniumHandler) QuitSessions() {
 	handler.Lock()
+	defer handler.Unlock()
+
 	for _, sessionList := range handler.sessions {
 		for _, session := range sessionList {
+			session.mutex.Lock()
+			webdriver := session.webdriver
+			session.webdriver = nil
+			session.state = SESSION_STATE_CLOSED
+			session.mutex.Unlock()
+			if webdriver == nil {
+				continue
+			}
 			fmt.Println(fmt.Sprintf("Closing selenium instance %v", session.id))
 			/*err := session.webdriver.Close()
 			if err != nil {
 				fmt.Println(err)
 			}*/
-			err := session.webdriver.Quit()
+			err := webdriver.Quit()
 			if err != nil {
 				fmt.Println(err)
 			}
@@ -308,29 +496,107 @@ func (handler *SeleniumHandler) CloseAll() {
 			}*/
 		}
 	}
+}
+
+//StopService stops the selenium service. Quit all browsers before
+func (handler *SeleniumHandler) StopService() {
 	fmt.Println("Closing selenium service")
 	err := handler.seleniumService.Stop()
 	if err != nil {
 		fmt.Println(err)
 	}
-	handler.Unlock()
 }
 
-//delete session that failed to init or whatever
-func (handler *SeleniumHandler) deleteBadSession(id int, webshopKind structs.Webshop) {
-	handler.Lock()
-	for i, session := range handler.sessions[webshopKind] {
-		if session.id == id {
-			handler.sessions[webshopKind] = remove(handler.sessions[webshopKind], i)
+//cookieFile returns the file the cookies of a checkout session are saved to
+func cookieFile(webshopKind structs.Webshop, id int) string {
+	return filepath.Join(COOKIE_DIR, fmt.Sprintf("webshop-%v-session-%v.json", webshopKind, id))
+}
+
+//SaveCookies writes the cookies of every checkout session's browser to COOKIE_DIR, one json file per session
+func (handler *SeleniumHandler) SaveCookies() error {
+	err := os.MkdirAll(COOKIE_DIR, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed to create cookie directory %s (%v)", COOKIE_DIR, err)
+	}
+
+	handler.RLock()
+	sessions := make([]*Session, 0)
+	for _, webshopSessions := range handler.sessions {
+		sessions = append(sessions, webshopSessions...)
+	}
+	handler.RUnlock()
+
+	failed := 0
+	var lastErr error
+	for _, session := range sessions {
+		session.mutex.Lock()
+		webdriver := session.webdriver
+		session.mutex.Unlock()
+		if webdriver == nil {
+			continue
+		}
+
+		cookies, err := webdriver.GetCookies()
+		if err == nil {
+			var cookieJSON []byte
+			cookieJSON, err = json.MarshalIndent(cookies, "", "\t")
+			if err == nil {
+				err = ioutil.WriteFile(cookieFile(session.kind, session.id), cookieJSON, 0600)
+			}
+		}
+		if err != nil {
+			failed++
+			lastErr = err
 		}
 	}
-	handler.Unlock()
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to save the cookies of %v session(s) (%v)", failed, lastErr)
+	}
+	return nil
 }
 
-//removes a session from a session slice and returns the result
-func remove(s []*Session, i int) []*Session {
-	s[len(s)-1], s[i] = s[i], s[len(s)-1]
-	return s[:len(s)-1]
+//restoreCookies adds the cookies SaveCookies saved for this session to the browser so the session can pick up where it
+//left off instead of signing in from scratch. Having no saved cookies is not an error
+func restoreCookies(wd selenium.WebDriver, webshopKind structs.Webshop, id int) error {
+	cookieJSON, err := ioutil.ReadFile(cookieFile(webshopKind, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read saved cookies (%v)", err)
+	}
+
+	var cookies []selenium.Cookie
+	err = json.Unmarshal(cookieJSON, &cookies)
+	if err != nil {
+		return fmt.Errorf("Failed to parse saved cookies (%v)", err)
+	}
+
+	//the browser only accepts cookies for the site it is on
+	signInURL, _ := getSignInURLAndFunc(webshopKind)
+	shopURL, err := url.Parse(signInURL)
+	if err != nil || shopURL.Host == "" {
+		return fmt.Errorf("No webshop to restore cookies for")
+	}
+	err = wd.Get(shopURL.Scheme + "://" + shopURL.Host + "/")
+	if err != nil {
+		return fmt.Errorf("Failed to open the webshop to restore cookies (%v)", err)
+	}
+
+	restored := 0
+	now := uint(time.Now().Unix())
+	for i := range cookies {
+		//a zero expiry is a session cookie
+		if cookies[i].Expiry != 0 && cookies[i].Expiry < now {
+			continue
+		}
+		if wd.AddCookie(&cookies[i]) == nil {
+			restored++
+		}
+	}
+	helperfuncs.Log("[session %v] Restored %v of %v saved cookies", id, restored, len(cookies))
+	return nil
 }
 
 func getSignInURLAndFunc(webshopKind structs.Webshop) (string, func(string, string, selenium.WebDriver, string) error) {
@@ -355,6 +621,15 @@ func getSignInURLAndFunc(webshopKind structs.Webshop) (string, func(string, stri
 	return "", nil
 }
 
+func getAwaitLoginFunc(webshopKind structs.Webshop) func(selenium.WebDriver, time.Duration) error {
+	switch webshopKind {
+	case structs.WEBSHOP_AMAZON, structs.WEBSHOP_AMAZONNL, structs.WEBSHOP_AMAZONDE, structs.WEBSHOP_AMAZONFR, structs.WEBSHOP_AMAZONIT:
+		return amazonws.AwaitLogin
+	}
+
+	return nil
+}
+
 func getUserSessionKeepAliveFunc(webshopKind structs.Webshop) func(selenium.WebDriver, structs.GlobalConfig, structs.Webshop) error {
 	switch webshopKind {
 	case structs.WEBSHOP_AMAZON:
@@ -378,42 +653,34 @@ func (handler *SeleniumHandler) addSessionSafe(webshopKind structs.Webshop, sess
 	handler.Unlock()
 }
 
-func (handler *SeleniumHandler) getInactiveSession(webshopKind structs.Webshop) (session *Session) {
+//getInactiveSession reserves a free session for the webshop. A session parked on the given ASIN's offers is preferred, in which case warm is true
+func (handler *SeleniumHandler) getInactiveSession(webshopKind structs.Webshop, asin string) (session *Session, warm bool) {
 	handler.RLock()
 	defer handler.RUnlock()
-	for _, session := range handler.sessions[webshopKind] {
-		if !session.busy {
-			session.busy = true
-			return session
-		}
-	}
-	return nil
-}
 
-func (handler *SeleniumHandler) sessionKeepAlive(ctx context.Context, globalConfig structs.GlobalConfig) {
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Println("sessionKeepAlive goroutine exiting")
-			return
-		default:
-			handler.Lock()
-			for _, webshopSessions := range handler.sessions {
-				for _, session := range webshopSessions {
-					session.webdriver.Refresh()
-
-					userSessionKeepAliveFunc := getUserSessionKeepAliveFunc(session.kind)
-					err := userSessionKeepAliveFunc(session.webdriver, globalConfig, session.kind)
-					if err != nil {
-						fmt.Println(fmt.Errorf("[user session keep alive] Failed to keep user session alive (%v)", err))
-					}
+	var fallback *Session
+	for _, session := range handler.sessions[webshopKind] {
+		session.mutex.Lock()
+		if !session.busy && session.state == SESSION_STATE_READY && session.webdriver != nil {
+			if session.warm && session.warmFor != nil && session.warmFor.ASIN == asin {
+				session.busy = true
+				session.mutex.Unlock()
+				if fallback != nil {
+					fallback.mutex.Lock()
+					fallback.busy = false
+					fallback.mutex.Unlock()
 				}
+				return session, true
+			}
+			if fallback == nil {
+				//hold on to it while we look for a warm one
+				session.busy = true
+				fallback = session
 			}
-			handler.Unlock()
-
-			time.Sleep(time.Second * time.Duration(globalConfig.CheckoutSessionKeepAliveInterval))
 		}
+		session.mutex.Unlock()
 	}
+	return fallback, false
 }
 
 /*
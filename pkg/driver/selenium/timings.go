@@ -0,0 +1,88 @@
+package selenium
+
+import (
+	"dolos-dev/pkg/driver/webshop"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/metrics"
+	"time"
+)
+
+//maxCheckoutTraces is how many checkout traces are kept in memory
+const maxCheckoutTraces = 100
+
+//CheckoutLatency summarises the checkouts done with a single strategy
+type CheckoutLatency struct {
+	Strategy  string `json:"strategy"`
+	Attempts  int    `json:"attempts"`
+	Successes int    `json:"successes"`
+	//Average and Fastest are measured from stock detection to order placed, over successful checkouts only
+	Average time.Duration `json:"average"`
+	Fastest time.Duration `json:"fastest"`
+}
+
+func (handler *SeleniumHandler) recordTrace(trace *webshop.CheckoutTrace, err error) {
+	trace.Finish(err)
+	helperfuncs.Log(trace.String())
+
+	result, step := metrics.CHECKOUT_RESULT_SUCCESS, "none"
+	if err != nil {
+		result = metrics.CHECKOUT_RESULT_FAILED
+		metrics.Errors.Inc(metrics.ERROR_CHECKOUT_FAILED)
+	}
+	if len(trace.Steps) > 0 {
+		step = trace.Steps[len(trace.Steps)-1].Name
+	}
+	metrics.CheckoutResults.Inc(trace.Product, trace.Webshop.Name(), trace.Strategy, result, step)
+
+	handler.traceMutex.Lock()
+	handler.checkoutTraces = append(handler.checkoutTraces, trace)
+	if len(handler.checkoutTraces) > maxCheckoutTraces {
+		handler.checkoutTraces = handler.checkoutTraces[len(handler.checkoutTraces)-maxCheckoutTraces:]
+	}
+	handler.traceMutex.Unlock()
+}
+
+//CheckoutTraces returns the timings of the most recent checkouts, oldest first
+func (handler *SeleniumHandler) CheckoutTraces() []webshop.CheckoutTrace {
+	handler.traceMutex.Lock()
+	defer handler.traceMutex.Unlock()
+
+	traces := make([]webshop.CheckoutTrace, 0, len(handler.checkoutTraces))
+	for _, trace := range handler.checkoutTraces {
+		traces = append(traces, *trace)
+	}
+	return traces
+}
+
+//CheckoutLatencies compares the checkout strategies using the traces kept in memory
+func (handler *SeleniumHandler) CheckoutLatencies() []CheckoutLatency {
+	latencies := make([]CheckoutLatency, 0)
+	index := make(map[string]int)
+	totals := make(map[string]time.Duration)
+
+	for _, trace := range handler.CheckoutTraces() {
+		i, ok := index[trace.Strategy]
+		if !ok {
+			i = len(latencies)
+			index[trace.Strategy] = i
+			latencies = append(latencies, CheckoutLatency{Strategy: trace.Strategy})
+		}
+
+		latencies[i].Attempts++
+		if !trace.Success {
+			continue
+		}
+		latencies[i].Successes++
+		totals[trace.Strategy] += trace.Total
+		if latencies[i].Fastest == 0 || trace.Total < latencies[i].Fastest {
+			latencies[i].Fastest = trace.Total
+		}
+	}
+
+	for i := range latencies {
+		if latencies[i].Successes > 0 {
+			latencies[i].Average = totals[latencies[i].Strategy] / time.Duration(latencies[i].Successes)
+		}
+	}
+	return latencies
+}
@@ -1,6 +1,7 @@
 package amazon
 
 import (
+	"dolos-dev/pkg/driver/webshop"
 	"dolos-dev/pkg/helperfuncs"
 	"dolos-dev/pkg/structs"
 	"fmt"
@@ -16,6 +17,10 @@ import (
 //Webshop represents an instance of this webshop driver
 type Webshop struct {
 	Kind structs.Webshop
+	//lowestPrice is the lowest offer price seen by the last stock check, 0 if it saw none
+	lowestPrice float64
+	//seller is the seller of the offer the last stock check found in stock
+	seller string
 }
 
 //New instantiates a new instance of this driver
@@ -29,6 +34,23 @@ func (shop *Webshop) GetKind() structs.Webshop {
 	return shop.Kind
 }
 
+//LowestPrice returns the lowest offer price seen by the last stock check, 0 if it saw none
+func (shop *Webshop) LowestPrice() float64 {
+	return shop.lowestPrice
+}
+
+//Seller returns the seller of the offer the last stock check found in stock, empty if it found none or couldn't tell
+func (shop *Webshop) Seller() string {
+	return shop.seller
+}
+
+//seePrice remembers the price if it is the lowest the current stock check has seen
+func (shop *Webshop) seePrice(price float64) {
+	if price > 0 && (shop.lowestPrice == 0 || price < shop.lowestPrice) {
+		shop.lowestPrice = price
+	}
+}
+
 func (shop *Webshop) Checkout(useAddToCartButton bool, product structs.ProductURL, webdriver selenium.WebDriver) error {
 
 	fmt.Println("Attempting to checkout product ", product.Name)
@@ -112,7 +134,7 @@ func (shop *Webshop) Checkout(useAddToCartButton bool, product structs.ProductUR
 	return nil
 }
 
-func (shop *Webshop) CheckoutSidebar(useAddToCartButton bool, product structs.ProductURL, webdriver selenium.WebDriver) error {
+func (shop *Webshop) CheckoutSidebar(useAddToCartButton bool, product structs.ProductURL, webdriver selenium.WebDriver, trace *webshop.CheckoutTrace) error {
 
 	fmt.Println("Attempting to checkout product ", product.Name)
 
@@ -122,14 +144,15 @@ func (shop *Webshop) CheckoutSidebar(useAddToCartButton bool, product structs.Pr
 		}
 	*/
 	//go webdriver.Get(product.URL + "/ref=olp-opf-redir?aod=1&ie=UTF8&condition=all")
-	err := webdriver.Get(fmt.Sprintf("https://www.amazon%s/gp/aod/ajax/ref=dp_aod_unknown_mbc?asin=%s&m=", getCountryCodeFromKind(shop.Kind), product.ASIN))
+	err := loadOffers(webdriver, shop.Kind, product.ASIN)
 	if err != nil {
 		return fmt.Errorf("Failed to make ajax request to get sidebar product list (%v)", err)
 	}
+	trace.Step(webshop.STEP_OFFERS_LOADED)
 	/*
 		pinnedOffer, err := webdriver.FindElement(selenium.ByID, "aod-pinned-offer")
 		if err == nil {
-			inStockSidebarPinned, cartButton, _ := checkOffer(webdriver, product, pinnedOffer)
+			inStockSidebarPinned, cartButton, _, _ := checkOffer(webdriver, product, pinnedOffer)
 			if inStockSidebarPinned {
 
 				err := checkout(webdriver, product, *cartButton)
@@ -158,7 +181,7 @@ func (shop *Webshop) CheckoutSidebar(useAddToCartButton bool, product structs.Pr
 	var offerError error
 	for _, offer := range offers {
 
-		inStock, addToCartButton, err := checkOffer(webdriver, product, offer)
+		inStock, addToCartButton, _, err := checkOffer(webdriver, product, offer)
 		if err != nil {
 			offerError = err
 			continue
@@ -171,7 +194,8 @@ func (shop *Webshop) CheckoutSidebar(useAddToCartButton bool, product structs.Pr
 					webdriver.ExecuteScript("arguments[0].style.visibility='hidden'", []interface{}{overlappingElement})
 				}
 			*/
-			err = checkout(webdriver, product, *addToCartButton)
+			trace.Step(webshop.STEP_OFFER_FOUND)
+			err = checkout(webdriver, product, *addToCartButton, trace)
 			if err != nil {
 				return err
 			}
@@ -200,7 +224,7 @@ func (shop *Webshop) CheckStockStatusSelenium(webdriver selenium.WebDriver, prod
 		}
 	*/
 	//go webdriver.Get(productURL.URL + "/ref=olp-opf-redir?aod=1&ie=UTF8&condition=all")
-	err := webdriver.Get(fmt.Sprintf("https://www.amazon%s/gp/aod/ajax/ref=dp_aod_unknown_mbc?asin=%s&m=", getCountryCodeFromKind(shop.Kind), productURL.ASIN))
+	err := webdriver.Get(getOffersURL(shop.Kind, productURL.ASIN))
 	if err != nil {
 		return false, false, false, "", fmt.Errorf("Failed to make ajax request to get sidebar product list (%v)", err)
 	}
@@ -260,42 +284,44 @@ func (shop *Webshop) CheckStockStatusSelenium(webdriver selenium.WebDriver, prod
 	return inStockCart, inStockCart, foundCaptcha, "", err
 }
 
-func checkOffer(webdriver selenium.WebDriver, productURL structs.ProductURL, parentElement selenium.WebElement) (bool, *selenium.WebElement, error) {
+//checkOffer reports whether the offer is within the product's price range and can be added to the cart. The offer's price is
+//returned as soon as it could be read, 0 otherwise
+func checkOffer(webdriver selenium.WebDriver, productURL structs.ProductURL, parentElement selenium.WebElement) (bool, *selenium.WebElement, float64, error) {
 	pinnedOfferPrice, err := parentElement.FindElement(selenium.ByCSSSelector, ".a-price-whole")
 	if err != nil {
-		return false, nil, err
+		return false, nil, 0, err
 	}
 
 	//make sure price is within parameters
 	priceString, err := pinnedOfferPrice.Text()
 	if err != nil {
-		return false, nil, err
+		return false, nil, 0, err
 	}
 	/*
 		priceString = strings.ReplaceAll(priceString, "$", "")
 		priceString = strings.ReplaceAll(priceString, "€", "")
 	*/
-	priceString = strings.ReplaceAll(priceString, ",", "")
-
-	price, err := strconv.ParseFloat(priceString, 32)
+	price, err := parseWholePrice(priceString)
 	if err != nil {
 		fmt.Println("Failed to parse price to float: ", priceString)
-		return false, nil, err
+		return false, nil, 0, err
 	}
 
-	if int(price) > productURL.MaxPrice || int(price) < productURL.MinPrice {
-		return false, nil, err
+	if !priceWithinLimits(price, productURL) {
+		return false, nil, price, err
 	}
 
 	addToCartButton, err := parentElement.FindElement(selenium.ByName, "submit.addToCart")
 	if err != nil {
-		return false, nil, err
+		return false, nil, price, err
 	}
 
-	return true, &addToCartButton, nil
+	return true, &addToCartButton, price, nil
 }
 
 func (shop *Webshop) CheckStockSidebar(webdriver selenium.WebDriver, productURL structs.ProductURL, debugScreenshots bool) (bool, bool, error) {
+	shop.lowestPrice = 0
+	shop.seller = ""
 	_, errVerifyPageLoaded := webdriver.FindElement(selenium.ByCSSSelector, "#aod-close")
 	if errVerifyPageLoaded != nil {
 		//couldn't find product title. Maybe captcha?
@@ -387,10 +413,13 @@ func (shop *Webshop) CheckStockSidebar(webdriver selenium.WebDriver, productURL
 		return false, false, fmt.Errorf("timed out looking for aod-pinned-offer element (%v)", err)
 	}
 
+	//returns on the first offer in stock so the checkout isn't held up, CollectOfferPrices reads the rest of the prices
 	pinnedOffer, err := webdriver.FindElement(selenium.ByCSSSelector, "#aod-pinned-offer")
 	if err == nil {
-		inStockSidebarPinned, _, _ := checkOffer(webdriver, productURL, pinnedOffer)
+		inStockSidebarPinned, _, price, _ := checkOffer(webdriver, productURL, pinnedOffer)
+		shop.seePrice(price)
 		if inStockSidebarPinned {
+			shop.seller = offerSeller(pinnedOffer)
 			return true, false, nil
 		}
 	}
@@ -415,8 +444,10 @@ func (shop *Webshop) CheckStockSidebar(webdriver selenium.WebDriver, productURL
 	var offerError error
 	for _, offer := range offers {
 
-		inStock, _, err := checkOffer(webdriver, productURL, offer)
+		inStock, _, price, err := checkOffer(webdriver, productURL, offer)
+		shop.seePrice(price)
 		if inStock {
+			shop.seller = offerSeller(offer)
 			return true, false, nil
 		}
 
@@ -426,18 +457,56 @@ func (shop *Webshop) CheckStockSidebar(webdriver selenium.WebDriver, productURL
 	}
 
 	if offerError != nil {
-		return false, false, err
+		return false, false, offerError
 	}
 
 	return false, false, nil
 }
 
-func checkout(webdriver selenium.WebDriver, product structs.ProductURL, addToCartButton selenium.WebElement) error {
+//CollectOfferPrices reads the prices of all offers in the sidebar the last stock check left open, so LowestPrice
+//covers the offers after the one it found in stock too. Offers without a readable price are skipped
+func (shop *Webshop) CollectOfferPrices(webdriver selenium.WebDriver) {
+	offers, err := webdriver.FindElements(selenium.ByCSSSelector, "#aod-pinned-offer, #aod-offer-list #aod-offer")
+	if err != nil {
+		return
+	}
+
+	for _, offer := range offers {
+		priceElement, err := offer.FindElement(selenium.ByCSSSelector, ".a-price-whole")
+		if err != nil {
+			continue
+		}
+		priceString, err := priceElement.Text()
+		if err != nil {
+			continue
+		}
+		price, err := parseWholePrice(priceString)
+		if err == nil {
+			shop.seePrice(price)
+		}
+	}
+}
+
+//offerSeller returns the name of the offer's seller, empty if the offer doesn't show one
+func offerSeller(offerElement selenium.WebElement) string {
+	sellerLink, err := offerElement.FindElement(selenium.ByCSSSelector, "#aod-offer-soldBy a")
+	if err != nil {
+		return ""
+	}
+	seller, err := sellerLink.Text()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(seller)
+}
+
+func checkout(webdriver selenium.WebDriver, product structs.ProductURL, addToCartButton selenium.WebElement, trace *webshop.CheckoutTrace) error {
 
 	_, err := webdriver.ExecuteScript("arguments[0].click();", []interface{}{addToCartButton})
 	if err != nil {
 		return err
 	}
+	trace.Step(webshop.STEP_ADDED_TO_CART)
 
 	var errContinueBtn error = nil
 	//click add to cart
@@ -460,92 +529,13 @@ func checkout(webdriver selenium.WebDriver, product structs.ProductURL, addToCar
 
 		return fmt.Errorf("Could not find place order button element (%v)", err)
 	}
+	trace.Step(webshop.STEP_CART_LOADED)
 
-	elemPlaceOrder.Click()
-	return nil
-}
-
-//LogInSelenium logs in to Amazon with the given username & password using the given webdriver interface
-func LogInSelenium(username, password string, webdriver selenium.WebDriver, signInURL string) error {
-
-	//navigate to sign in page
-	fmt.Println("Signing in")
-	//https://www.amazon.nl /ap/signin?openid.pape.max_auth_age=0                                                                     &openid.identity=http%3A%2F%2Fspecs.openid.net%2Fauth%2F2.0%2Fidentifier_select&openid.assoc_handle=nlflex&openid.mode=checkid_setup&openid.claimed_id=http%3A%2F%2Fspecs.openid.net%2Fauth%2F2.0%2Fidentifier_select&openid.ns=http%3A%2F%2Fspecs.openid.net%2Fauth%2F2.0&
-	//signInURL := "https://www.amazon.com/ap/signin?openid.pape.max_auth_age=0&openid.return_to=https%3A%2F%2Fwww.amazon.com%2F%3Fref_%3Dnav_signin&openid.identity=http%3A%2F%2Fspecs.openid.net%2Fauth%2F2.0%2Fidentifier_select&openid.assoc_handle=usflex&openid.mode=checkid_setup&openid.claimed_id=http%3A%2F%2Fspecs.openid.net%2Fauth%2F2.0%2Fidentifier_select&openid.ns=http%3A%2F%2Fspecs.openid.net%2Fauth%2F2.0&"
-	if err := webdriver.Get(signInURL); err != nil {
-		return err
-	}
-
-	//find email text box
-	elemEmail, err := webdriver.FindElement(selenium.ByCSSSelector, "#ap_email")
-	if err != nil {
-		return fmt.Errorf("Could not find email element (%v)", err)
-	}
-
-	//fill email
-	err = elemEmail.SendKeys(username)
-
-	//find continue button
-	elemContinue, err := webdriver.FindElement(selenium.ByCSSSelector, "#continue")
+	err = elemPlaceOrder.Click()
 	if err != nil {
-		return fmt.Errorf("Could not find login continue element (%v)", err)
+		return fmt.Errorf("Failed to click place order button (%v)", err)
 	}
-	elemContinue.Click()
-
-	webdriver.Wait(func(wd selenium.WebDriver) (bool, error) {
-		//for {
-		elemPassword, err := webdriver.FindElement(selenium.ByCSSSelector, "#ap_password")
-		if err != nil {
-			return false, nil
-		}
-		if elemPassword != nil {
-			return true, nil
-		}
-		return false, nil
-		//}
-	})
-
-	//find password textbox
-	elemPassword, err := webdriver.FindElement(selenium.ByCSSSelector, "#ap_password")
-	if err != nil {
-		return fmt.Errorf("Could not find password element (%v)", err)
-	}
-
-	//fill password textbox
-	err = elemPassword.SendKeys(password)
-
-	//find "keep me signed in" button
-	elemRememberMe, err := webdriver.FindElement(selenium.ByName, "rememberMe")
-	if err != nil {
-		return fmt.Errorf("Could not find remember me checkbox element (%v)", err)
-	}
-
-	//check checkbox
-	err = elemRememberMe.Click()
-	if err != nil {
-		return fmt.Errorf("Could not click remember me checkbox element (%v)", err)
-	}
-
-	//click sign in button
-	elemSignIn, err := webdriver.FindElement(selenium.ByCSSSelector, "#signInSubmit")
-	if err != nil {
-		return fmt.Errorf("Could not find sign in button element (%v)", err)
-	}
-	elemSignIn.Click()
-
-	//WAIT FOR search field to appear
-	webdriver.Wait(func(wd selenium.WebDriver) (bool, error) {
-		//for {
-		elemSearchBox, err := webdriver.FindElement(selenium.ByID, "twotabsearchtextbox")
-		if err != nil {
-			return false, nil
-		}
-		if elemSearchBox != nil {
-			return true, nil
-		}
-		return false, nil
-		//}
-	})
+	trace.Step(webshop.STEP_ORDER_PLACED)
 	return nil
 }
 
@@ -583,6 +573,10 @@ func KeepUserSessionAlive(webdriver selenium.WebDriver, globalConfig structs.Glo
 		//password field not here > check for user data form
 		_, err := webdriver.FindElement(selenium.ByCSSSelector, "#cnep_1a_name_form")
 		if err != nil {
+			//neither > we may have been sent to a verification or error page instead
+			if outcome := detectLoginOutcome(webdriver); outcome != webshop.LOGIN_OUTCOME_UNKNOWN && outcome != webshop.LOGIN_OUTCOME_SUCCESS {
+				return newLoginError(webdriver, outcome, nil)
+			}
 			return fmt.Errorf("Failed to find either the password field or the user data form (%v)", err)
 		}
 		//if exists, we good
@@ -604,8 +598,8 @@ func KeepUserSessionAlive(webdriver selenium.WebDriver, globalConfig structs.Glo
 		return fmt.Errorf("Failed to click submit button (%v)", err)
 	}
 
-	return nil
-
+	//make sure re-entering the password actually got us back in
+	return loginResult(webdriver)
 }
 
 func getCountryCode(url string) string {
@@ -627,6 +621,21 @@ func getCountryCode(url string) string {
 	return "ERROR"
 }
 
+//getOffersURL returns the URL of the ajax fragment listing all offers (the "sidebar") for the given ASIN
+func getOffersURL(kind structs.Webshop, asin string) string {
+	return fmt.Sprintf("https://www.amazon%s/gp/aod/ajax/ref=dp_aod_unknown_mbc?asin=%s&m=", getCountryCodeFromKind(kind), asin)
+}
+
+//loadOffers loads the offers fragment for the given ASIN. A session parked on that page by PrepareCheckout only refreshes it
+func loadOffers(webdriver selenium.WebDriver, kind structs.Webshop, asin string) error {
+	offersURL := getOffersURL(kind, asin)
+	currentURL, err := webdriver.CurrentURL()
+	if err == nil && currentURL == offersURL {
+		return webdriver.Refresh()
+	}
+	return webdriver.Get(offersURL)
+}
+
 func getCountryCodeFromKind(kind structs.Webshop) string {
 	switch kind {
 	case structs.WEBSHOP_AMAZON:
@@ -663,44 +672,8 @@ func (shop *Webshop) SolveCaptcha(webdriver selenium.WebDriver, captchaToken str
 	return nil
 }
 
-//CheckStockStatus checks if a product is in stock on Amazon. Takes a ProductURL struct
-//returns:
-//bool inStock - boolean representing whether or not the item is in stock
-//bool inStockCartButton - boolean representing whether or not the item is in stock, but only with a add to cart button
-//bool captcha - boolan representing whether or not a captcha is returned on the page and needs to be solved to proceed
-//struct CaptchaWrapper - struct containing all the necessary information about a captcha if one is present
-//error - in case something goes wrong in the request
-func (shop *Webshop) CheckStockStatus(productURL structs.ProductURL, proxy structs.Proxy) (bool, bool, bool, *structs.CaptchaWrapper, error) {
-	body, err := helperfuncs.GetBodyHTML(productURL.URL, proxy.IP, proxy.Port, proxy.User, proxy.Password)
-	if err != nil {
-		fmt.Println(fmt.Errorf("Failed to get body (%v)", err))
-		return false, false, false, nil, err
-	}
-
-	bodyOK, inStock, inStockCartButton, captcha, captchaURL := checkStockStatus(body)
-
-	if captcha {
-		//generate session id
-		sessionID := helperfuncs.GenerateRandomString(6)
-
-		captchaWrapper := &structs.CaptchaWrapper{
-			CaptchaURL: captchaURL,
-			SessionID:  sessionID,
-		}
-		return false, false, true, captchaWrapper, nil
-	}
-
-	//we check if the body contains an expected element, if it does not, then something went wrong while loading the page
-	if !bodyOK && !inStock && !inStockCartButton {
-		err = fmt.Errorf("Body failed to properly load for some reason...")
-
-		return false, false, false, nil, err
-	}
-
-	return inStock, inStockCartButton, false, nil, nil
-}
-
-func checkStockStatus(body io.ReadCloser) (bool, bool, bool, bool, string) {
+//checkStockStatus looks for the buy buttons and a captcha on a parsed product page
+func checkStockStatus(doc *html.Node) (bool, bool, bool, bool, string) {
 	var findElement func(bool, *html.Node) (bool, bool, bool, bool, string)
 	findElement = func(bodyAlreadyFound bool, n *html.Node) (bool, bool, bool, bool, string) {
 		bodyOK := bodyAlreadyFound
@@ -760,13 +733,6 @@ func checkStockStatus(body io.ReadCloser) (bool, bool, bool, bool, string) {
 		return bodyOK, false, false, false, ""
 	}
 
-	doc, err := html.Parse(body)
-	if err != nil {
-		fmt.Println(fmt.Sprintf("Failed to parse body into a html document (%v)", err))
-		return false, false, false, false, ""
-
-	}
-
 	return findElement(false, doc)
 
 }
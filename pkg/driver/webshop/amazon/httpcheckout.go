@@ -0,0 +1,265 @@
+package amazon
+
+import (
+	"bytes"
+	"context"
+	"dolos-dev/pkg/driver/webshop"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	//httpCheckoutTimeout bounds every single request of a browserless checkout
+	httpCheckoutTimeout = 15 * time.Second
+	//maxCheckoutPageSize caps how much of a response we read
+	maxCheckoutPageSize = 8 << 20
+)
+
+//httpCheckout holds the state of a single browserless checkout
+type httpCheckout struct {
+	client    *httpclient.Client
+	userAgent string
+	referer   string
+	//cartChanged is set right before the add to cart request is sent
+	cartChanged bool
+	//orderSubmitted is set right before the place order request is sent
+	orderSubmitted bool
+}
+
+//page is a fetched and parsed HTML page
+type page struct {
+	url  *url.URL
+	body []byte
+	doc  *html.Node
+}
+
+//CheckoutHTTP replays the sidebar checkout as plain HTTP requests using the cookies and user agent of a signed in browser session.
+//It applies the same price checks as the browser flow plus an ASIN and order total check, and returns a
+//*webshop.UnexpectedResponseError whenever Amazon answers with a page we don't recognise
+func (shop *Webshop) CheckoutHTTP(product structs.ProductURL, cookies []*http.Cookie, userAgent string, trace *webshop.CheckoutTrace) error {
+	fmt.Println("Attempting to checkout product over HTTP ", product.Name)
+
+	shopURL, err := url.Parse(fmt.Sprintf("https://www.amazon%s/", getCountryCodeFromKind(shop.Kind)))
+	if err != nil {
+		return err
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	jar.SetCookies(shopURL, cookies)
+
+	client, err := httpclient.New(httpclient.Options{
+		Jar:         jar,
+		Timeout:     httpCheckoutTimeout,
+		MaxBodySize: maxCheckoutPageSize,
+		Priority:    true,
+	})
+	if err != nil {
+		return err
+	}
+
+	replay := &httpCheckout{
+		client:    client,
+		userAgent: userAgent,
+	}
+
+	//offers
+	offersPage, err := replay.do(webshop.STEP_OFFERS_LOADED, "GET", getOffersURL(shop.Kind, product.ASIN), nil)
+	if err != nil {
+		return err
+	}
+	offers, pageOK := parseOffers(offersPage.doc)
+	if !pageOK {
+		return replay.unexpected(webshop.STEP_OFFERS_LOADED, fmt.Errorf("Response is not an offers page"))
+	}
+	trace.Step(webshop.STEP_OFFERS_LOADED)
+
+	var chosen *offer
+	for i := range offers {
+		if offers[i].priceErr != nil || !priceWithinLimits(offers[i].price, product) || offers[i].addToCart == nil {
+			continue
+		}
+		if offers[i].addToCart.asin() != product.ASIN {
+			return replay.unexpected(webshop.STEP_OFFER_FOUND, fmt.Errorf("Offer is for ASIN %s instead of %s", offers[i].addToCart.asin(), product.ASIN))
+		}
+		chosen = &offers[i]
+		break
+	}
+	if chosen == nil {
+		return fmt.Errorf("No offer within price range found")
+	}
+	trace.Step(webshop.STEP_OFFER_FOUND)
+
+	//add to cart
+	addToCartURL, err := offersPage.url.Parse(chosen.addToCart.action)
+	if err != nil {
+		return replay.unexpected(webshop.STEP_ADDED_TO_CART, fmt.Errorf("Invalid add to cart action %s (%v)", chosen.addToCart.action, err))
+	}
+	replay.cartChanged = true
+	_, err = replay.do(webshop.STEP_ADDED_TO_CART, "POST", addToCartURL.String(), chosen.addToCart.fields)
+	if err != nil {
+		return err
+	}
+	trace.Step(webshop.STEP_ADDED_TO_CART)
+
+	//checkout page
+	checkoutPage, err := replay.do(webshop.STEP_CART_LOADED, "GET", fmt.Sprint("https://www.amazon", getCountryCodeFromKind(shop.Kind), "/-/en/gp/cart/view.html/ref=lh_co?ie=UTF8&proceedToCheckout.x=129&cartInitiateId=1616029244603&hasWorkingJavascript=1"), nil)
+	if err != nil {
+		return err
+	}
+
+	placeOrderForm := findNode(checkoutPage.doc, func(n *html.Node) bool {
+		return byTag("form")(n) && findNode(n, byAttr("name", "placeYourOrder1")) != nil
+	})
+	if placeOrderForm == nil {
+		return replay.unexpected(webshop.STEP_CART_LOADED, fmt.Errorf("Could not find place order form"))
+	}
+	if !bytes.Contains(checkoutPage.body, []byte(product.ASIN)) {
+		return replay.unexpected(webshop.STEP_CART_LOADED, fmt.Errorf("Checkout page does not contain ASIN %s", product.ASIN))
+	}
+	totalNode := findNode(checkoutPage.doc, byClass("grand-total-price"))
+	if totalNode == nil {
+		return replay.unexpected(webshop.STEP_CART_LOADED, fmt.Errorf("Could not find order total"))
+	}
+	total, err := parseTotal(nodeText(totalNode))
+	if err != nil {
+		return replay.unexpected(webshop.STEP_CART_LOADED, err)
+	}
+	if !priceWithinLimits(total, product) {
+		//this is a real answer, not a reason to retry in the browser. The product must not stay in the cart though, the
+		//next checkout would order it along with its own product
+		err = replay.removeFromCart(shop.Kind, product.ASIN)
+		if err != nil {
+			//a browser retry starts from an empty cart and won't order outside of the price limits either
+			return replay.unexpected(webshop.STEP_CART_LOADED, fmt.Errorf("Order total of product %s is outside of parameters (%v) and it could not be removed from the cart (%v)", product.Name, total, err))
+		}
+		return fmt.Errorf("Order total of product %s is outside of parameters (%v)", product.Name, total)
+	}
+	trace.Step(webshop.STEP_CART_LOADED)
+
+	//place order
+	orderForm := parseForm(placeOrderForm)
+	placeOrderURL, err := checkoutPage.url.Parse(orderForm.action)
+	if err != nil {
+		return replay.unexpected(webshop.STEP_ORDER_PLACED, fmt.Errorf("Invalid place order action %s (%v)", orderForm.action, err))
+	}
+	replay.orderSubmitted = true
+	confirmationPage, err := replay.do(webshop.STEP_ORDER_PLACED, "POST", placeOrderURL.String(), orderForm.fields)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(confirmationPage.url.Path, "thankyou") && findNode(confirmationPage.doc, byID("widget-purchaseConfirmationStatus")) == nil {
+		return replay.unexpected(webshop.STEP_ORDER_PLACED, fmt.Errorf("Order was submitted but no confirmation page was returned [URL: %s]", confirmationPage.url))
+	}
+	trace.Step(webshop.STEP_ORDER_PLACED)
+
+	return nil
+}
+
+//removeFromCart deletes the product from the cart by submitting the cart form with the delete button of its item
+func (replay *httpCheckout) removeFromCart(kind structs.Webshop, asin string) error {
+	cartPage, err := replay.do(webshop.STEP_CART_LOADED, "GET", fmt.Sprintf("https://www.amazon%s/gp/cart/view.html", getCountryCodeFromKind(kind)), nil)
+	if err != nil {
+		return err
+	}
+	cartForm := findNode(cartPage.doc, byID("activeCartViewForm"))
+	if cartForm == nil {
+		return fmt.Errorf("Could not find cart form")
+	}
+	deleteButton := cartDeleteButton(cartForm, asin)
+	if deleteButton == nil {
+		return fmt.Errorf("Could not find ASIN %s in the cart", asin)
+	}
+
+	//the form has a delete button for every item, only the one that was pressed may be sent
+	deleteForm := parseForm(cartForm)
+	for name := range deleteForm.fields {
+		if strings.HasPrefix(name, "submit.") {
+			deleteForm.fields.Del(name)
+		}
+	}
+	deleteForm.fields.Set(attr(deleteButton, "name"), attr(deleteButton, "value"))
+	deleteURL, err := cartPage.url.Parse(deleteForm.action)
+	if err != nil {
+		return fmt.Errorf("Invalid cart form action %s (%v)", deleteForm.action, err)
+	}
+	updatedCart, err := replay.do(webshop.STEP_CART_LOADED, "POST", deleteURL.String(), deleteForm.fields)
+	if err != nil {
+		return err
+	}
+	if cartDeleteButton(updatedCart.doc, asin) != nil {
+		return fmt.Errorf("ASIN %s is still in the cart", asin)
+	}
+	return nil
+}
+
+//cartDeleteButton finds the delete button of the cart item with the ASIN
+func cartDeleteButton(cart *html.Node, asin string) *html.Node {
+	item := findNode(cart, byAttr("data-asin", asin))
+	if item == nil {
+		return nil
+	}
+	return findNode(item, func(n *html.Node) bool {
+		return byTag("input")(n) && strings.HasPrefix(attr(n, "name"), "submit.delete")
+	})
+}
+
+//do sends a request like the browser would and parses the HTML response. Any status but 200 and any redirect to the sign in page
+//is reported as an unexpected response
+func (replay *httpCheckout) do(step, method, rawURL string, fields url.Values) (*page, error) {
+	header := http.Header{}
+	header.Set("User-Agent", replay.userAgent)
+	if replay.referer != "" {
+		header.Set("Referer", replay.referer)
+	}
+
+	var (
+		resp *httpclient.Response
+		err  error
+	)
+	//a checkout that got this far is never cancelled halfway, it is only bounded by the client's timeout
+	if fields != nil {
+		resp, err = replay.client.PostForm(context.Background(), rawURL, fields, header)
+	} else {
+		resp, err = replay.client.Do(context.Background(), method, rawURL, nil, header)
+	}
+	if err != nil {
+		return nil, replay.unexpected(step, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, replay.unexpected(step, fmt.Errorf("Status %v from %s", resp.StatusCode, rawURL))
+	}
+	if strings.Contains(resp.URL.Path, "/ap/signin") {
+		return nil, replay.unexpected(step, fmt.Errorf("Redirected to the sign in page"))
+	}
+
+	doc, err := html.Parse(bytes.NewReader(resp.Body))
+	if err != nil {
+		return nil, replay.unexpected(step, fmt.Errorf("Failed to parse body into a html document (%v)", err))
+	}
+
+	replay.referer = resp.URL.String()
+	return &page{
+		url:  resp.URL,
+		body: resp.Body,
+		doc:  doc,
+	}, nil
+}
+
+func (replay *httpCheckout) unexpected(step string, err error) error {
+	return &webshop.UnexpectedResponseError{
+		Step:           step,
+		CartChanged:    replay.cartChanged,
+		OrderSubmitted: replay.orderSubmitted,
+		Err:            err,
+	}
+}
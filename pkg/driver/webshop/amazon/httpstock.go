@@ -0,0 +1,169 @@
+package amazon
+
+import (
+	"bytes"
+	"context"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+//CheckStockStatus checks if a product is in stock on Amazon without a browser. It fetches the offers ("sidebar") of the product's ASIN,
+//or the product page if there is no ASIN, over the proxy's shared HTTP client
+//returns:
+//bool inStock - boolean representing whether or not the item is in stock
+//bool inStockCartButton - boolean representing whether or not the item is in stock, but only with a add to cart button
+//bool captcha - boolan representing whether or not a captcha is returned on the page and needs to be solved to proceed
+//struct CaptchaWrapper - struct containing all the necessary information about a captcha if one is present
+//error - in case something goes wrong in the request
+func (shop *Webshop) CheckStockStatus(ctx context.Context, productURL structs.ProductURL, proxy structs.Proxy) (bool, bool, bool, *structs.CaptchaWrapper, error) {
+	shop.lowestPrice = 0
+	shop.seller = ""
+	pageURL := productURL.URL
+	if productURL.ASIN != "" {
+		pageURL = getOffersURL(shop.Kind, productURL.ASIN)
+	}
+
+	doc, err := getDocument(ctx, pageURL, proxy)
+	if err != nil {
+		return false, false, false, nil, err
+	}
+
+	if captchaWrapper := parseCaptcha(doc, pageURL); captchaWrapper != nil {
+		return false, false, true, captchaWrapper, nil
+	}
+
+	if productURL.ASIN == "" {
+		bodyOK, inStock, inStockCartButton, _, _ := checkStockStatus(doc)
+
+		//we check if the body contains an expected element, if it does not, then something went wrong while loading the page
+		if !bodyOK && !inStock && !inStockCartButton {
+			return false, false, false, nil, fmt.Errorf("Body failed to properly load for some reason...")
+		}
+		return inStock, inStockCartButton, false, nil, nil
+	}
+
+	offers, pageOK := parseOffers(doc)
+	if !pageOK {
+		return false, false, false, nil, fmt.Errorf("Response is not an offers page [URL: %s]", pageURL)
+	}
+
+	inStock := false
+	for _, offer := range offers {
+		if offer.priceErr != nil {
+			continue
+		}
+		shop.seePrice(offer.price)
+		if priceWithinLimits(offer.price, productURL) && offer.addToCart != nil {
+			if !inStock {
+				//the first offer in stock is the one the checkout goes for
+				shop.seller = offer.seller
+			}
+			inStock = true
+		}
+	}
+
+	//offers in the sidebar can only be bought with their add to cart button
+	return inStock, inStock, false, nil, nil
+}
+
+//SolveCaptchaHTTP submits the solved characters of a captcha returned by CheckStockStatus. The proxy's shared HTTP client keeps
+//the cookies Amazon hands out for it, so it must be the proxy the captcha was found with
+func (shop *Webshop) SolveCaptchaHTTP(ctx context.Context, captchaWrapper *structs.CaptchaWrapper, captchaToken string, proxy structs.Proxy) error {
+	if captchaWrapper.CaptchaSubmitURL == "" {
+		return fmt.Errorf("Captcha has no submit URL")
+	}
+
+	submitURL := captchaWrapper.CaptchaSubmitURL + url.QueryEscape(captchaToken)
+	doc, err := getDocument(ctx, submitURL, proxy)
+	if err != nil {
+		return err
+	}
+
+	if parseCaptcha(doc, submitURL) != nil {
+		return fmt.Errorf("Captcha characters %s were not accepted", captchaToken)
+	}
+
+	captchaWrapper.Solved = true
+	captchaWrapper.CaptchaChars = captchaToken
+	return nil
+}
+
+//getDocument fetches and parses a page with the proxy's shared client. Error pages that carry a captcha are returned as documents
+func getDocument(ctx context.Context, pageURL string, proxy structs.Proxy) (*html.Node, error) {
+	client, err := httpclient.ForProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	resp, err := client.Get(ctx, pageURL, nil)
+	if err != nil {
+		statusErr := httpclient.AsStatusError(err)
+		if statusErr == nil {
+			return nil, fmt.Errorf("Failed to get body (%w)", err)
+		}
+		//amazon answers bots with a captcha and a 503
+		body = statusErr.Body
+	} else {
+		body = resp.Body
+	}
+
+	doc, parseErr := html.Parse(bytes.NewReader(body))
+	if parseErr != nil {
+		return nil, fmt.Errorf("Failed to parse body into a html document (%v)", parseErr)
+	}
+	if err != nil && parseCaptcha(doc, pageURL) == nil {
+		//keep the status error so callers can back off on throttling
+		return nil, fmt.Errorf("Failed to get body (%w)", err)
+	}
+	return doc, nil
+}
+
+//parseCaptcha returns the captcha on the page, or nil if there is none. The submit URL is built from the captcha form
+//with the characters field left for last, so the solved characters only need to be appended
+func parseCaptcha(doc *html.Node, pageURL string) *structs.CaptchaWrapper {
+	captchaImage := findNode(doc, func(n *html.Node) bool {
+		return byTag("img")(n) && strings.Contains(attr(n, "src"), "captcha")
+	})
+	if captchaImage == nil {
+		return nil
+	}
+
+	captchaWrapper := &structs.CaptchaWrapper{
+		CaptchaURL: attr(captchaImage, "src"),
+		SessionID:  helperfuncs.GenerateRandomString(6),
+	}
+
+	captchaForm := findNode(doc, func(n *html.Node) bool {
+		return byTag("form")(n) && strings.Contains(attr(n, "action"), "validateCaptcha")
+	})
+	if captchaForm == nil {
+		return captchaWrapper
+	}
+
+	parsedForm := parseForm(captchaForm)
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return captchaWrapper
+	}
+	action, err := base.Parse(parsedForm.action)
+	if err != nil {
+		return captchaWrapper
+	}
+
+	parsedForm.fields.Del("field-keywords")
+	query := parsedForm.fields.Encode()
+	if query != "" {
+		query += "&"
+	}
+	action.RawQuery = ""
+	captchaWrapper.CaptchaSubmitURL = fmt.Sprint(action.String(), "?", query, "field-keywords=")
+
+	return captchaWrapper
+}
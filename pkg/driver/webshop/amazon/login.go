@@ -0,0 +1,226 @@
+package amazon
+
+import (
+	"dolos-dev/pkg/driver/webshop"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+const (
+	//loginStepTimeout bounds every wait for the next sign in page to show up
+	loginStepTimeout = 15 * time.Second
+	//loginPollInterval is how often the current page is inspected while waiting
+	loginPollInterval = 250 * time.Millisecond
+)
+
+//LogInSelenium logs in to Amazon with the given username & password using the given webdriver interface.
+//Returns a *webshop.LoginError describing the page Amazon landed on if the sign in did not succeed
+func LogInSelenium(username, password string, webdriver selenium.WebDriver, signInURL string) error {
+	//navigate to sign in page
+	fmt.Println("Signing in")
+	if err := webdriver.Get(signInURL); err != nil {
+		return fmt.Errorf("Failed to navigate to sign in page (%v)", err)
+	}
+
+	//step 1: email
+	elemEmail, err := waitForElement(webdriver, selenium.ByCSSSelector, "#ap_email")
+	if err != nil {
+		//we might already be signed in from a previous session's cookies
+		if outcome := detectLoginOutcome(webdriver); outcome == webshop.LOGIN_OUTCOME_SUCCESS {
+			return nil
+		}
+		return newLoginError(webdriver, webshop.LOGIN_OUTCOME_UNKNOWN, fmt.Errorf("Could not find email element (%v)", err))
+	}
+
+	err = elemEmail.SendKeys(username)
+	if err != nil {
+		return fmt.Errorf("Failed to fill email element (%v)", err)
+	}
+
+	elemContinue, err := webdriver.FindElement(selenium.ByCSSSelector, "#continue")
+	if err != nil {
+		return fmt.Errorf("Could not find login continue element (%v)", err)
+	}
+	err = elemContinue.Click()
+	if err != nil {
+		return fmt.Errorf("Failed to click login continue element (%v)", err)
+	}
+
+	//step 2: password. Amazon shows an error box instead when it does not know the email
+	outcome, err := waitForLoginOutcome(webdriver, func(wd selenium.WebDriver) bool {
+		return elementExists(wd, "#ap_password")
+	})
+	if err != nil {
+		return err
+	}
+	if outcome != webshop.LOGIN_OUTCOME_UNKNOWN {
+		return newLoginError(webdriver, outcome, nil)
+	}
+
+	elemPassword, err := webdriver.FindElement(selenium.ByCSSSelector, "#ap_password")
+	if err != nil {
+		return fmt.Errorf("Could not find password element (%v)", err)
+	}
+	err = elemPassword.SendKeys(password)
+	if err != nil {
+		return fmt.Errorf("Failed to fill password element (%v)", err)
+	}
+
+	//find "keep me signed in" button
+	elemRememberMe, err := webdriver.FindElement(selenium.ByName, "rememberMe")
+	if err != nil {
+		return fmt.Errorf("Could not find remember me checkbox element (%v)", err)
+	}
+	err = elemRememberMe.Click()
+	if err != nil {
+		return fmt.Errorf("Could not click remember me checkbox element (%v)", err)
+	}
+
+	elemSignIn, err := webdriver.FindElement(selenium.ByCSSSelector, "#signInSubmit")
+	if err != nil {
+		return fmt.Errorf("Could not find sign in button element (%v)", err)
+	}
+	err = elemSignIn.Click()
+	if err != nil {
+		return fmt.Errorf("Could not click sign in button element (%v)", err)
+	}
+
+	//step 3: whatever Amazon decided to show us
+	return loginResult(webdriver)
+}
+
+//AwaitLogin waits up to the given timeout for a sign in that is pending approval or a one time password to be completed by the
+//account owner in the browser window. Returns nil once signed in or the last *webshop.LoginError otherwise
+func AwaitLogin(webdriver selenium.WebDriver, timeout time.Duration) error {
+	var outcome webshop.LoginOutcome
+	err := webdriver.WaitWithTimeoutAndInterval(func(wd selenium.WebDriver) (bool, error) {
+		outcome = detectLoginOutcome(wd)
+		switch outcome {
+		case webshop.LOGIN_OUTCOME_APPROVAL_PENDING, webshop.LOGIN_OUTCOME_OTP_REQUIRED:
+			return false, nil
+		}
+		return true, nil
+	}, timeout, time.Second)
+	if err != nil {
+		return newLoginError(webdriver, outcome, err)
+	}
+
+	if outcome == webshop.LOGIN_OUTCOME_SUCCESS {
+		return nil
+	}
+	//approval or OTP is done but we did not land on the shop yet (e.g. an extra confirmation page)
+	return loginResult(webdriver)
+}
+
+//loginResult waits for a page we recognise after submitting credentials and turns it into an error (nil on success)
+func loginResult(webdriver selenium.WebDriver) error {
+	outcome, err := waitForLoginOutcome(webdriver, nil)
+	if err != nil {
+		return err
+	}
+	if outcome == webshop.LOGIN_OUTCOME_SUCCESS {
+		return nil
+	}
+	return newLoginError(webdriver, outcome, nil)
+}
+
+//waitForLoginOutcome polls the current page until a known outcome is recognised or until proceed returns true.
+//Returns LOGIN_OUTCOME_UNKNOWN when proceed matched first, or a timeout *webshop.LoginError when nothing matched in time
+func waitForLoginOutcome(webdriver selenium.WebDriver, proceed func(selenium.WebDriver) bool) (webshop.LoginOutcome, error) {
+	outcome := webshop.LOGIN_OUTCOME_UNKNOWN
+	err := webdriver.WaitWithTimeoutAndInterval(func(wd selenium.WebDriver) (bool, error) {
+		outcome = detectLoginOutcome(wd)
+		if outcome != webshop.LOGIN_OUTCOME_UNKNOWN {
+			return true, nil
+		}
+		return proceed != nil && proceed(wd), nil
+	}, loginStepTimeout, loginPollInterval)
+	if err != nil {
+		return outcome, newLoginError(webdriver, webshop.LOGIN_OUTCOME_TIMEOUT, err)
+	}
+
+	return outcome, nil
+}
+
+//detectLoginOutcome inspects the current page and returns which sign in outcome it represents
+func detectLoginOutcome(webdriver selenium.WebDriver) webshop.LoginOutcome {
+	currentURL, _ := webdriver.CurrentURL()
+
+	//signed in pages have the search box, sign in pages never do
+	if !strings.Contains(currentURL, "/ap/") && elementExists(webdriver, "#twotabsearchtextbox") {
+		return webshop.LOGIN_OUTCOME_SUCCESS
+	}
+
+	//two step verification via authenticator app or SMS
+	if elementExists(webdriver, "#auth-mfa-otpcode") {
+		return webshop.LOGIN_OUTCOME_OTP_REQUIRED
+	}
+
+	//"approve the notification sent to..."
+	if strings.Contains(currentURL, "/ap/cvf/approval") || elementExists(webdriver, "#resend-approval-link") {
+		return webshop.LOGIN_OUTCOME_APPROVAL_PENDING
+	}
+
+	//account verification code sent by email or SMS
+	if strings.Contains(currentURL, "/ap/cvf/") && elementExists(webdriver, "input[name='code']") {
+		return webshop.LOGIN_OUTCOME_OTP_REQUIRED
+	}
+
+	if elementExists(webdriver, "#auth-error-message-box") {
+		text := strings.ToLower(elementText(webdriver, "#auth-error-message-box"))
+		if strings.Contains(text, "locked") || strings.Contains(text, "on hold") || strings.Contains(text, "disabled") {
+			return webshop.LOGIN_OUTCOME_ACCOUNT_LOCKED
+		}
+		//incorrect password, unknown email, ...
+		return webshop.LOGIN_OUTCOME_WRONG_PASSWORD
+	}
+
+	if strings.Contains(currentURL, "/ap/accountlock") || strings.Contains(currentURL, "/ap/account-status") {
+		return webshop.LOGIN_OUTCOME_ACCOUNT_LOCKED
+	}
+
+	return webshop.LOGIN_OUTCOME_UNKNOWN
+}
+
+func newLoginError(webdriver selenium.WebDriver, outcome webshop.LoginOutcome, err error) *webshop.LoginError {
+	currentURL, _ := webdriver.CurrentURL()
+	return &webshop.LoginError{
+		Outcome: outcome,
+		URL:     currentURL,
+		Err:     err,
+	}
+}
+
+//waitForElement waits up to loginStepTimeout for the element to be present and returns it
+func waitForElement(webdriver selenium.WebDriver, by, value string) (selenium.WebElement, error) {
+	var elem selenium.WebElement
+	err := webdriver.WaitWithTimeoutAndInterval(func(wd selenium.WebDriver) (bool, error) {
+		found, err := wd.FindElement(by, value)
+		if err != nil {
+			return false, nil
+		}
+		elem = found
+		return true, nil
+	}, loginStepTimeout, loginPollInterval)
+	if err != nil {
+		return nil, err
+	}
+	return elem, nil
+}
+
+func elementExists(webdriver selenium.WebDriver, cssSelector string) bool {
+	elems, err := webdriver.FindElements(selenium.ByCSSSelector, cssSelector)
+	return err == nil && len(elems) > 0
+}
+
+func elementText(webdriver selenium.WebDriver, cssSelector string) string {
+	elem, err := webdriver.FindElement(selenium.ByCSSSelector, cssSelector)
+	if err != nil {
+		return ""
+	}
+	text, _ := elem.Text()
+	return text
+}
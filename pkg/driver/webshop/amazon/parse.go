@@ -0,0 +1,236 @@
+package amazon
+
+import (
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+//offer is a single offer parsed from the offers ("sidebar") HTML fragment
+type offer struct {
+	pinned bool
+	price  float64
+	//priceErr is set when the offer's price could not be read
+	priceErr error
+	seller   string
+	//addToCart is nil when the offer can't be added to the cart (e.g. unavailable)
+	addToCart *form
+}
+
+//form is an HTML form with everything needed to submit it without a browser
+type form struct {
+	action string
+	fields url.Values
+}
+
+//asin returns the ASIN the form refers to, if it carries one
+func (f *form) asin() string {
+	for key, values := range f.fields {
+		lowerKey := strings.ToLower(key)
+		if (lowerKey == "asin" || strings.HasSuffix(lowerKey, "[asin]")) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+//parseOffers finds the pinned offer and all other offers in a parsed offers fragment.
+//pageOK reports whether the document actually is an offers fragment
+func parseOffers(doc *html.Node) (offers []offer, pageOK bool) {
+	pageOK = findNode(doc, byID("aod-close")) != nil || findNode(doc, byID("aod-offer-list")) != nil || findNode(doc, byID("aod-pinned-offer")) != nil
+
+	if pinned := findNode(doc, byID("aod-pinned-offer")); pinned != nil {
+		parsed := parseOffer(pinned)
+		parsed.pinned = true
+		offers = append(offers, parsed)
+	}
+
+	//every offer in the list has the same (!) id
+	for _, offerNode := range findNodes(doc, byID("aod-offer")) {
+		offers = append(offers, parseOffer(offerNode))
+	}
+
+	return offers, pageOK
+}
+
+func parseOffer(offerNode *html.Node) offer {
+	parsed := offer{}
+
+	priceNode := findNode(offerNode, byClass("a-price-whole"))
+	if priceNode == nil {
+		parsed.priceErr = fmt.Errorf("Offer has no price")
+	} else {
+		parsed.price, parsed.priceErr = parseWholePrice(nodeText(priceNode))
+	}
+
+	if sellerNode := findNode(offerNode, byID("aod-offer-soldBy")); sellerNode != nil {
+		if link := findNode(sellerNode, byTag("a")); link != nil {
+			parsed.seller = strings.TrimSpace(nodeText(link))
+		}
+	}
+
+	for _, formNode := range findNodes(offerNode, byTag("form")) {
+		if findNode(formNode, byAttr("name", "submit.addToCart")) != nil {
+			parsed.addToCart = parseForm(formNode)
+			break
+		}
+	}
+
+	return parsed
+}
+
+//parseForm collects a form's action and the values of its inputs
+func parseForm(formNode *html.Node) *form {
+	parsed := &form{
+		action: attr(formNode, "action"),
+		fields: url.Values{},
+	}
+	for _, input := range findNodes(formNode, byTag("input")) {
+		name := attr(input, "name")
+		if name == "" {
+			continue
+		}
+		inputType := strings.ToLower(attr(input, "type"))
+		if (inputType == "checkbox" || inputType == "radio") && !hasAttr(input, "checked") {
+			continue
+		}
+		parsed.fields.Add(name, attr(input, "value"))
+	}
+	return parsed
+}
+
+//parseWholePrice parses the whole part of a price as shown by the a-price-whole element (e.g. "1,149")
+func parseWholePrice(priceString string) (float64, error) {
+	priceString = strings.TrimSpace(priceString)
+	priceString = strings.ReplaceAll(priceString, ",", "")
+	priceString = strings.ReplaceAll(priceString, ".", "")
+
+	price, err := strconv.ParseFloat(priceString, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse price %s (%v)", priceString, err)
+	}
+	return price, nil
+}
+
+//parseTotal parses a full price with currency and decimals in either notation ("$1,149.99", "1.149,99 €", "EUR 499,00")
+func parseTotal(totalString string) (float64, error) {
+	digits := strings.Builder{}
+	for _, r := range totalString {
+		if (r >= '0' && r <= '9') || r == ',' || r == '.' {
+			digits.WriteRune(r)
+		}
+	}
+	cleaned := digits.String()
+
+	//the last separator is a decimal separator if exactly two digits follow it
+	lastSeparator := strings.LastIndexAny(cleaned, ",.")
+	whole, decimals := cleaned, ""
+	if lastSeparator > -1 && len(cleaned)-lastSeparator-1 == 2 {
+		whole, decimals = cleaned[:lastSeparator], cleaned[lastSeparator+1:]
+	}
+	whole = strings.NewReplacer(",", "", ".", "").Replace(whole)
+	if decimals != "" {
+		whole = whole + "." + decimals
+	}
+
+	total, err := strconv.ParseFloat(whole, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse total %s (%v)", totalString, err)
+	}
+	return total, nil
+}
+
+//priceWithinLimits reports whether the price is within the product's configured price range
+func priceWithinLimits(price float64, product structs.ProductURL) bool {
+	return int(price) <= product.MaxPrice && int(price) >= product.MinPrice
+}
+
+type nodeMatcher func(*html.Node) bool
+
+func byID(id string) nodeMatcher {
+	return byAttr("id", id)
+}
+
+func byTag(tag string) nodeMatcher {
+	return func(n *html.Node) bool {
+		return n.Type == html.ElementNode && n.Data == tag
+	}
+}
+
+func byAttr(key, value string) nodeMatcher {
+	return func(n *html.Node) bool {
+		return n.Type == html.ElementNode && hasAttr(n, key) && attr(n, key) == value
+	}
+}
+
+func byClass(class string) nodeMatcher {
+	return func(n *html.Node) bool {
+		if n.Type != html.ElementNode {
+			return false
+		}
+		for _, c := range strings.Fields(attr(n, "class")) {
+			if c == class {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//findNode returns the first node below (and including) n that matches, depth first
+func findNode(n *html.Node, match nodeMatcher) *html.Node {
+	if match(n) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findNode(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+//findNodes returns all nodes below (and including) n that match. It does not look inside matched nodes
+func findNodes(n *html.Node, match nodeMatcher) []*html.Node {
+	if match(n) {
+		return []*html.Node{n}
+	}
+	found := make([]*html.Node, 0)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		found = append(found, findNodes(c, match)...)
+	}
+	return found
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	text := strings.Builder{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		text.WriteString(nodeText(c))
+	}
+	return text.String()
+}
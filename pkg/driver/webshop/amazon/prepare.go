@@ -0,0 +1,106 @@
+package amazon
+
+import (
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+const (
+	//cartDeleteSelector matches the delete button of every item in the cart
+	cartDeleteSelector = "#sc-active-cart input[value='Delete'], #sc-active-cart [data-action='delete'] input"
+	//defaultAddressSelector matches the default address card in the address book
+	defaultAddressSelector = "#ya-myab-default-shipping-address-icon, .ya-myab-default-address"
+	//paymentMethodSelector matches a saved card or bank account in the wallet
+	paymentMethodSelector = ".apx-wallet-selectable-payment-method-tab, .pmts-instrument-box"
+	//maxCartItems bounds how many items we try to delete so a broken page can't keep us busy forever
+	maxCartItems = 20
+)
+
+//PrepareCheckout empties the cart and parks the webdriver on the product's offers so a checkout only has to refresh the page.
+//If confirmAccount is set it also makes sure the account has a default shipping address and a payment method, since without
+//them Amazon shows extra pages instead of the place order button
+func (shop *Webshop) PrepareCheckout(product structs.ProductURL, webdriver selenium.WebDriver, confirmAccount bool) error {
+	err := emptyCart(webdriver, shop.Kind)
+	if err != nil {
+		return fmt.Errorf("Failed to empty cart (%v)", err)
+	}
+
+	if confirmAccount {
+		err = confirmCheckoutDetails(webdriver, shop.Kind)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = webdriver.Get(getOffersURL(shop.Kind, product.ASIN))
+	if err != nil {
+		return fmt.Errorf("Failed to park on offers of %s (%v)", product.Name, err)
+	}
+
+	return nil
+}
+
+//emptyCart deletes every item in the cart, so a checkout only ever orders the product it just added
+func emptyCart(webdriver selenium.WebDriver, kind structs.Webshop) error {
+	err := webdriver.Get(fmt.Sprintf("https://www.amazon%s/gp/cart/view.html", getCountryCodeFromKind(kind)))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < maxCartItems; i++ {
+		deleteButtons, err := webdriver.FindElements(selenium.ByCSSSelector, cartDeleteSelector)
+		if err != nil || len(deleteButtons) == 0 {
+			return nil
+		}
+
+		err = deleteButtons[0].Click()
+		if err != nil {
+			return fmt.Errorf("Failed to click delete button (%v)", err)
+		}
+
+		//the cart is updated with ajax, wait for the item count to go down
+		remaining := len(deleteButtons)
+		err = webdriver.WaitWithTimeoutAndInterval(func(wd selenium.WebDriver) (bool, error) {
+			buttons, err := wd.FindElements(selenium.ByCSSSelector, cartDeleteSelector)
+			return err != nil || len(buttons) < remaining, nil
+		}, loginStepTimeout, loginPollInterval)
+		if err != nil {
+			return fmt.Errorf("Timed out waiting for cart item to be deleted (%v)", err)
+		}
+	}
+
+	return fmt.Errorf("Cart still has items after deleting %v of them", maxCartItems)
+}
+
+//confirmCheckoutDetails makes sure the account has a default shipping address and a payment method
+func confirmCheckoutDetails(webdriver selenium.WebDriver, kind structs.Webshop) error {
+	countryCode := getCountryCodeFromKind(kind)
+
+	err := webdriver.Get(fmt.Sprintf("https://www.amazon%s/a/addresses", countryCode))
+	if err != nil {
+		return fmt.Errorf("Failed to load address book (%v)", err)
+	}
+	if !waitForSelector(webdriver, defaultAddressSelector) {
+		return fmt.Errorf("No default shipping address set on the account")
+	}
+
+	err = webdriver.Get(fmt.Sprintf("https://www.amazon%s/cpe/yourpayments/wallet", countryCode))
+	if err != nil {
+		return fmt.Errorf("Failed to load wallet (%v)", err)
+	}
+	if !waitForSelector(webdriver, paymentMethodSelector) {
+		return fmt.Errorf("No payment method saved on the account")
+	}
+
+	return nil
+}
+
+func waitForSelector(webdriver selenium.WebDriver, cssSelector string) bool {
+	err := webdriver.WaitWithTimeoutAndInterval(func(wd selenium.WebDriver) (bool, error) {
+		return elementExists(wd, cssSelector), nil
+	}, 10*time.Second, loginPollInterval)
+	return err == nil
+}
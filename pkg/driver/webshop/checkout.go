@@ -0,0 +1,167 @@
+package webshop
+
+import (
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/metrics"
+	"dolos-dev/pkg/structs"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//checkout step names shared by all webshop drivers so timings can be compared
+const (
+	STEP_SESSION_ACQUIRED = "session acquired"
+	STEP_OFFERS_LOADED    = "offers loaded"
+	STEP_OFFER_FOUND      = "offer found"
+	STEP_ADDED_TO_CART    = "added to cart"
+	STEP_CART_LOADED      = "checkout loaded"
+	STEP_ORDER_PLACED     = "order placed"
+	STEP_FALLBACK         = "fell back to browser"
+)
+
+//checkout strategies
+const (
+	STRATEGY_COLD = "cold"
+	STRATEGY_WARM = "warm"
+	//STRATEGY_HTTP replays the checkout as plain HTTP requests using a signed in session's cookies
+	STRATEGY_HTTP = "http"
+	//STRATEGY_HTTP_FALLBACK is an HTTP checkout that had to be finished in the browser
+	STRATEGY_HTTP_FALLBACK = "http+browser"
+)
+
+//UnexpectedResponseError is returned by a browserless checkout when the webshop answered with something we don't understand.
+//The checkout can be retried in a browser as long as OrderSubmitted is false
+type UnexpectedResponseError struct {
+	Step string
+	//CartChanged is set once the add to cart request was sent, so a retry must start from an empty cart
+	CartChanged bool
+	//OrderSubmitted is set once the place order request was sent, after which retrying could order twice
+	OrderSubmitted bool
+	Err            error
+}
+
+func (err *UnexpectedResponseError) Error() string {
+	return fmt.Sprintf("Unexpected response at step %s (%v)", err.Step, err.Err)
+}
+
+func (err *UnexpectedResponseError) Unwrap() error {
+	return err.Err
+}
+
+//CanFallBack reports whether err is an unexpected response of a browserless checkout that is safe to retry in a browser.
+//cartChanged tells the caller to empty the cart before retrying
+func CanFallBack(err error) (ok bool, cartChanged bool) {
+	var unexpectedErr *UnexpectedResponseError
+	if !errors.As(err, &unexpectedErr) || unexpectedErr.OrderSubmitted {
+		return false, false
+	}
+	return true, unexpectedErr.CartChanged
+}
+
+//CheckoutStep is a single timed step of a checkout
+type CheckoutStep struct {
+	Name string `json:"name"`
+	//Duration is the time since the previous step
+	Duration time.Duration `json:"duration"`
+	//SinceDetected is the time since stock was detected
+	SinceDetected time.Duration `json:"since_detected"`
+}
+
+//CheckoutTrace records how long each step of a checkout took, from the moment stock was detected until the order was placed.
+//A nil *CheckoutTrace can be used safely and records nothing
+type CheckoutTrace struct {
+	ProductID int             `json:"product_id"`
+	Product   string          `json:"product"`
+	Webshop   structs.Webshop `json:"webshop"`
+	Strategy  string          `json:"strategy"`
+	SessionID int             `json:"session_id"`
+	Detected  time.Time       `json:"detected"`
+	Steps     []CheckoutStep  `json:"steps"`
+	Total     time.Duration   `json:"total"`
+	Success   bool            `json:"success"`
+	Err       string          `json:"error,omitempty"`
+
+	lastStep time.Time
+}
+
+//NewCheckoutTrace starts a trace for a checkout of the given product. detected is when the stock checker saw the product in stock
+func NewCheckoutTrace(product structs.ProductURL, webshopKind structs.Webshop, strategy string, detected time.Time) *CheckoutTrace {
+	if detected.IsZero() {
+		detected = time.Now()
+	}
+	return &CheckoutTrace{
+		ProductID: product.ID,
+		Product:   product.Name,
+		Webshop:   webshopKind,
+		Strategy:  strategy,
+		Detected:  detected,
+		lastStep:  detected,
+	}
+}
+
+//Step records that the named step just completed and publishes it as an event
+func (trace *CheckoutTrace) Step(name string) {
+	if trace == nil {
+		return
+	}
+	now := time.Now()
+	step := CheckoutStep{
+		Name:          name,
+		Duration:      now.Sub(trace.lastStep),
+		SinceDetected: now.Sub(trace.Detected),
+	}
+	trace.Steps = append(trace.Steps, step)
+	trace.lastStep = now
+	metrics.CheckoutStepSeconds.Observe(step.SinceDetected.Seconds(), trace.Webshop.Name(), trace.Strategy, name)
+
+	data := map[string]interface{}{
+		"step":              step.Name,
+		"strategy":          trace.Strategy,
+		"webshop":           trace.Webshop,
+		"session_id":        trace.SessionID,
+		"duration_ms":       step.Duration.Milliseconds(),
+		"since_detected_ms": step.SinceDetected.Milliseconds(),
+	}
+	events.Publish(events.Event{
+		Type:      events.EVENT_CHECKOUT_STEP,
+		Time:      now,
+		ProductID: trace.ProductID,
+		Product:   trace.Product,
+		Data:      data,
+	})
+	if name == STEP_ORDER_PLACED {
+		events.Publish(events.Event{
+			Type:      events.EVENT_ORDER_PLACED,
+			Time:      now,
+			ProductID: trace.ProductID,
+			Product:   trace.Product,
+			Data:      data,
+		})
+	}
+}
+
+//Finish closes the trace with the checkout's result
+func (trace *CheckoutTrace) Finish(err error) {
+	if trace == nil {
+		return
+	}
+	trace.Total = time.Since(trace.Detected)
+	trace.Success = err == nil
+	if err != nil {
+		trace.Err = err.Error()
+	}
+}
+
+func (trace *CheckoutTrace) String() string {
+	steps := make([]string, 0, len(trace.Steps))
+	for _, step := range trace.Steps {
+		steps = append(steps, fmt.Sprintf("%s +%v", step.Name, step.Duration.Round(time.Millisecond)))
+	}
+	result := "ok"
+	if !trace.Success {
+		result = "failed"
+	}
+	return fmt.Sprintf("[checkout %s] %s %s in %v: %s", trace.Strategy, trace.Product, result, trace.Total.Round(time.Millisecond), strings.Join(steps, " | "))
+}
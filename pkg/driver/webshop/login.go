@@ -0,0 +1,80 @@
+package webshop
+
+import (
+	"errors"
+	"fmt"
+)
+
+//LoginOutcome represents the page a webshop lands on after a sign in attempt
+type LoginOutcome int
+
+const (
+	LOGIN_OUTCOME_UNKNOWN          LoginOutcome = 0
+	LOGIN_OUTCOME_SUCCESS          LoginOutcome = 1
+	LOGIN_OUTCOME_WRONG_PASSWORD   LoginOutcome = 2
+	LOGIN_OUTCOME_ACCOUNT_LOCKED   LoginOutcome = 3
+	LOGIN_OUTCOME_APPROVAL_PENDING LoginOutcome = 4
+	LOGIN_OUTCOME_OTP_REQUIRED     LoginOutcome = 5
+	LOGIN_OUTCOME_TIMEOUT          LoginOutcome = 6
+)
+
+func (outcome LoginOutcome) String() string {
+	switch outcome {
+	case LOGIN_OUTCOME_SUCCESS:
+		return "success"
+	case LOGIN_OUTCOME_WRONG_PASSWORD:
+		return "wrong password"
+	case LOGIN_OUTCOME_ACCOUNT_LOCKED:
+		return "account locked"
+	case LOGIN_OUTCOME_APPROVAL_PENDING:
+		return "approval notification pending"
+	case LOGIN_OUTCOME_OTP_REQUIRED:
+		return "one time password required"
+	case LOGIN_OUTCOME_TIMEOUT:
+		return "timed out"
+	}
+	return "unknown page"
+}
+
+//LoginError is returned by a webshop's sign in functions when the sign in did not succeed.
+//Outcome tells the caller which page the webshop landed on so it can decide what to do next
+type LoginError struct {
+	Outcome LoginOutcome
+	//URL is the page the browser was on when the outcome was recognised
+	URL string
+	Err error
+}
+
+func (err *LoginError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("Sign in failed: %s [URL: %s] (%v)", err.Outcome, err.URL, err.Err)
+	}
+	return fmt.Sprintf("Sign in failed: %s [URL: %s]", err.Outcome, err.URL)
+}
+
+func (err *LoginError) Unwrap() error {
+	return err.Err
+}
+
+//Retryable reports whether signing in again can succeed without anyone changing the credentials or the account
+func (err *LoginError) Retryable() bool {
+	switch err.Outcome {
+	case LOGIN_OUTCOME_WRONG_PASSWORD, LOGIN_OUTCOME_ACCOUNT_LOCKED:
+		return false
+	}
+	return true
+}
+
+//NeedsUser reports whether the sign in is waiting for the account owner to approve it or enter a code
+func (err *LoginError) NeedsUser() bool {
+	return err.Outcome == LOGIN_OUTCOME_APPROVAL_PENDING || err.Outcome == LOGIN_OUTCOME_OTP_REQUIRED
+}
+
+//AsLoginError returns the LoginError wrapped in err, if there is one
+func AsLoginError(err error) (*LoginError, bool) {
+	var loginErr *LoginError
+	if errors.As(err, &loginErr) {
+		return loginErr, true
+	}
+	return nil, false
+}
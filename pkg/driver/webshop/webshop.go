@@ -1,18 +1,32 @@
 package webshop
 
 import (
+	"context"
 	"dolos-dev/pkg/structs"
+	"net/http"
 
 	"github.com/tebeka/selenium"
 )
 
 type Webshop interface {
-	CheckStockStatus(structs.ProductURL, structs.Proxy) (bool, bool, bool, *structs.CaptchaWrapper, error)
+	CheckStockStatus(context.Context, structs.ProductURL, structs.Proxy) (bool, bool, bool, *structs.CaptchaWrapper, error)
 	CheckStockStatusSelenium(selenium.WebDriver, structs.ProductURL, bool /*, structs.Proxy*/) (bool, bool, bool, string, error)
 	SolveCaptcha(selenium.WebDriver, string) error
+	//SolveCaptchaHTTP submits a solved captcha found by CheckStockStatus through the same proxy
+	SolveCaptchaHTTP(context.Context, *structs.CaptchaWrapper, string, structs.Proxy) error
 
 	GetKind() structs.Webshop
+	//LowestPrice returns the lowest offer price seen by the last stock check, 0 if it saw none
+	LowestPrice() float64
+	//CollectOfferPrices adds the prices of the offers a selenium stock check that found stock returned before reading
+	CollectOfferPrices(selenium.WebDriver)
+	//Seller returns the seller of the offer the last stock check found in stock, empty if it found none or couldn't tell
+	Seller() string
 	//LogInSelenium(string, string, selenium.WebDriver) error
 	Checkout(bool, structs.ProductURL, selenium.WebDriver) error
-	CheckoutSidebar(bool, structs.ProductURL, selenium.WebDriver) error
+	CheckoutSidebar(bool, structs.ProductURL, selenium.WebDriver, *CheckoutTrace) error
+	//PrepareCheckout parks a signed in webdriver on the product's offers, ready to check out. The bool asks the driver to also confirm the account's address and payment method
+	PrepareCheckout(structs.ProductURL, selenium.WebDriver, bool) error
+	//CheckoutHTTP checks out without a browser using the cookies and user agent of a signed in session
+	CheckoutHTTP(structs.ProductURL, []*http.Cookie, string, *CheckoutTrace) error
 }
@@ -0,0 +1,190 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+//event types
+const (
+	EVENT_CHECK_STARTED     = "check_started"
+	EVENT_CHECK_FINISHED    = "check_finished"
+	EVENT_IN_STOCK          = "in_stock"
+	EVENT_OUT_OF_STOCK      = "out_of_stock"
+	EVENT_PRICE_CHANGED     = "price_changed"
+	EVENT_CHECKOUT_STEP     = "checkout_step"
+	EVENT_ORDER_PLACED      = "order_placed"
+	EVENT_SESSION_UNHEALTHY = "session_unhealthy"
+	EVENT_TASK_RESTARTED    = "task_restarted"
+)
+
+//Types are all event types in the order they are listed above
+var Types = []string{
+	EVENT_CHECK_STARTED, EVENT_CHECK_FINISHED, EVENT_IN_STOCK, EVENT_OUT_OF_STOCK, EVENT_PRICE_CHANGED,
+	EVENT_CHECKOUT_STEP, EVENT_ORDER_PLACED, EVENT_SESSION_UNHEALTHY, EVENT_TASK_RESTARTED,
+}
+
+const (
+	//historySize is how many past events the default bus keeps for clients that reconnect
+	historySize = 500
+	//subscriptionBuffer is how many events a subscriber may fall behind before it misses some
+	subscriptionBuffer = 256
+)
+
+//Event is something that happened in the bot. ProductID and TaskID are 0 for events that don't belong to a product or task
+type Event struct {
+	ID        uint64                 `json:"id"`
+	Type      string                 `json:"type"`
+	Time      time.Time              `json:"time"`
+	ProductID int                    `json:"product_id,omitempty"`
+	Product   string                 `json:"product,omitempty"`
+	TaskID    int                    `json:"task_id,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+//Filter selects events by type and product. An empty set matches everything
+type Filter struct {
+	Types      map[string]bool
+	ProductIDs map[int]bool
+}
+
+//Matches reports whether the event passes the filter
+func (filter Filter) Matches(event Event) bool {
+	if len(filter.Types) > 0 && !filter.Types[event.Type] {
+		return false
+	}
+	if len(filter.ProductIDs) > 0 && !filter.ProductIDs[event.ProductID] {
+		return false
+	}
+	return true
+}
+
+//Bus hands published events to all subscribers whose filter matches. Publishing never blocks, a subscriber that
+//falls too far behind misses events instead
+type Bus struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	subscribers map[*Subscription]bool
+	//history holds the most recent events, oldest first
+	history     []Event
+	historySize int
+}
+
+//Subscription receives the events matching its filter on C until it is unsubscribed
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	filter Filter
+	//dropped counts the events the subscriber missed because it was too slow
+	dropped int
+}
+
+//NewBus creates a bus keeping the given number of past events
+func NewBus(historySize int) *Bus {
+	return &Bus{
+		subscribers: make(map[*Subscription]bool),
+		historySize: historySize,
+	}
+}
+
+//Publish stamps the event with the next ID and the current time and hands it to all matching subscribers
+func (bus *Bus) Publish(event Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.lastID++
+	event.ID = bus.lastID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	bus.history = append(bus.history, event)
+	if len(bus.history) > bus.historySize {
+		bus.history = bus.history[len(bus.history)-bus.historySize:]
+	}
+
+	for subscription := range bus.subscribers {
+		if !subscription.filter.Matches(event) {
+			continue
+		}
+		select {
+		case subscription.c <- event:
+		default:
+			subscription.dropped++
+		}
+	}
+}
+
+//Subscribe starts receiving the events matching filter. It also returns the kept past events after afterID that match,
+//so a client that reconnects with the last ID it saw doesn't miss anything in between. afterID 0 returns none
+func (bus *Bus) Subscribe(filter Filter, afterID uint64) (*Subscription, []Event) {
+	c := make(chan Event, subscriptionBuffer)
+	subscription := &Subscription{
+		C:      c,
+		c:      c,
+		filter: filter,
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	backlog := make([]Event, 0)
+	if afterID > 0 {
+		for _, event := range bus.history {
+			if event.ID > afterID && filter.Matches(event) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	bus.subscribers[subscription] = true
+
+	return subscription, backlog
+}
+
+//Recent returns up to limit of the most recent kept events that match filter, oldest first
+func (bus *Bus) Recent(filter Filter, limit int) []Event {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	recent := make([]Event, 0)
+	for i := len(bus.history) - 1; i >= 0 && len(recent) < limit; i-- {
+		if filter.Matches(bus.history[i]) {
+			recent = append(recent, bus.history[i])
+		}
+	}
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+	return recent
+}
+
+//Unsubscribe stops the subscription and closes its channel
+func (bus *Bus) Unsubscribe(subscription *Subscription) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if bus.subscribers[subscription] {
+		delete(bus.subscribers, subscription)
+		close(subscription.c)
+	}
+}
+
+//Dropped returns how many events the subscription missed so far
+func (bus *Bus) Dropped(subscription *Subscription) int {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	return subscription.dropped
+}
+
+//defaultBus is the bus all parts of the bot publish to
+var defaultBus = NewBus(historySize)
+
+//Default returns the bus all parts of the bot publish to
+func Default() *Bus {
+	return defaultBus
+}
+
+//Publish publishes the event on the default bus
+func Publish(event Event) {
+	defaultBus.Publish(event)
+}
@@ -0,0 +1,191 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//heartbeatInterval keeps idle streams from being closed by proxies in between
+const heartbeatInterval = 15 * time.Second
+
+//ParseFilter reads the filter of a stream request. product and type take comma separated product IDs and event types
+func ParseFilter(r *http.Request) (Filter, error) {
+	filter := Filter{
+		Types:      make(map[string]bool),
+		ProductIDs: make(map[int]bool),
+	}
+
+	known := make(map[string]bool)
+	for _, eventType := range Types {
+		known[eventType] = true
+	}
+	for _, value := range r.URL.Query()["type"] {
+		for _, eventType := range strings.Split(value, ",") {
+			eventType = strings.TrimSpace(eventType)
+			if eventType == "" {
+				continue
+			}
+			if !known[eventType] {
+				return filter, fmt.Errorf("Unknown event type %s, expected one of %s", eventType, strings.Join(Types, ", "))
+			}
+			filter.Types[eventType] = true
+		}
+	}
+
+	for _, value := range r.URL.Query()["product"] {
+		for _, id := range strings.Split(value, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+			productID, err := strconv.Atoi(id)
+			if err != nil || productID < 1 {
+				return filter, fmt.Errorf("Invalid product ID %s", id)
+			}
+			filter.ProductIDs[productID] = true
+		}
+	}
+
+	return filter, nil
+}
+
+//lastEventID returns the ID of the last event a reconnecting client saw, from the Last-Event-ID header browsers send
+//or the last_event_id query parameter
+func lastEventID(r *http.Request) uint64 {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+//IsWebSocket reports whether the request asks for a websocket instead of a server-sent events stream
+func IsWebSocket(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+//ServeSSE streams the bus' events matching filter as server-sent events until the client goes away
+func (bus *Bus) ServeSSE(w http.ResponseWriter, r *http.Request, filter Filter) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("Failed to stream events (response writer can't flush)")
+	}
+
+	subscription, backlog := bus.Subscribe(filter, lastEventID(r))
+	defer bus.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	//keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	//tells the browser how long to wait before reconnecting
+	fmt.Fprintf(w, "retry: 3000\n\n")
+
+	for _, event := range backlog {
+		err := writeSSE(w, event)
+		if err != nil {
+			return err
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-heartbeat.C:
+			_, err := fmt.Fprintf(w, ": heartbeat\n\n")
+			if err != nil {
+				return fmt.Errorf("Failed to write heartbeat (%v)", err)
+			}
+		case event, ok := <-subscription.C:
+			if !ok {
+				return nil
+			}
+			err := writeSSE(w, event)
+			if err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+//writeSSE writes one event in the server-sent events format
+func writeSSE(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Failed to encode event %v (%v)", event.ID, err)
+	}
+	_, err = fmt.Fprintf(w, "id: %v\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	if err != nil {
+		return fmt.Errorf("Failed to write event %v (%v)", event.ID, err)
+	}
+	return nil
+}
+
+//ServeWebSocket upgrades the request to a websocket and sends the bus' events matching filter as json text messages
+//until the client closes it. Pages of allowedOrigins may open the websocket besides the API's own
+func (bus *Bus) ServeWebSocket(w http.ResponseWriter, r *http.Request, filter Filter, allowedOrigins []string) error {
+	conn, err := upgradeWebSocket(w, r, allowedOrigins)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	subscription, backlog := bus.Subscribe(filter, lastEventID(r))
+	defer bus.Unsubscribe(subscription)
+
+	//reading is how a closed connection is noticed
+	closed := make(chan struct{})
+	go func() {
+		readUntilClosed(conn)
+		close(closed)
+	}()
+
+	for _, event := range backlog {
+		err := writeWebSocket(conn, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-heartbeat.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if err != nil {
+				return fmt.Errorf("Failed to write ping (%v)", err)
+			}
+		case event, ok := <-subscription.C:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+				return nil
+			}
+			err := writeWebSocket(conn, event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
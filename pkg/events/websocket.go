@@ -0,0 +1,69 @@
+package events
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	//writeTimeout drops clients that stop reading
+	writeTimeout = 10 * time.Second
+	//maxClientMessage caps the messages read from clients, the stream is one way so they only send control frames
+	maxClientMessage = 512
+)
+
+//upgradeWebSocket answers the websocket handshake. Browsers don't apply CORS to websockets, so only pages of the API's
+//own origin and of the allowed origins may open one
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (*websocket.Conn, error) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+				return true
+			}
+			for _, allowed := range allowedOrigins {
+				if origin == strings.TrimSuffix(allowed, "/") {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	//the upgrader answers failed handshakes itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upgrade to websocket (%v)", err)
+	}
+	conn.SetReadLimit(maxClientMessage)
+	return conn, nil
+}
+
+//writeWebSocket sends the event as a json text message
+func writeWebSocket(conn *websocket.Conn, event Event) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := conn.WriteJSON(event)
+	if err != nil {
+		return fmt.Errorf("Failed to write event %v (%v)", event.ID, err)
+	}
+	return nil
+}
+
+//readUntilClosed reads the client's messages until the connection is closed. Pings and the closing handshake are
+//answered while reading, anything else the client sends is ignored
+func readUntilClosed(conn *websocket.Conn) {
+	for {
+		_, _, err := conn.NextReader()
+		if err != nil {
+			return
+		}
+	}
+}
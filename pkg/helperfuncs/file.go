@@ -8,8 +8,23 @@ import (
 	"image/png"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"time"
 )
 
+//SCREENSHOT_DIR is where SaveImage saves screenshots
+const SCREENSHOT_DIR = "screenshots"
+
+//NOTIFICATION_SCREENSHOT_DIR is where SaveNotificationScreenshot saves the screenshots attached to notifications
+const NOTIFICATION_SCREENSHOT_DIR = "screenshots/notifications"
+
+//NOTIFICATION_SCREENSHOT_MAX_AGE is how long notification screenshots are kept before PruneNotificationScreenshots deletes them
+const NOTIFICATION_SCREENSHOT_MAX_AGE = 24 * time.Hour
+
+//unsafeFileNameChars matches what is replaced in the metadata of screenshot file names
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
 func AddFileToZip(zipWriter *zip.Writer, filePath, fileName string) error {
 
 	fileToZip, err := os.Open(filePath)
@@ -46,13 +61,35 @@ func DeleteFileOrDir(path string) error {
 }
 
 func SaveImage(metadata string, imageBytes []byte) (string, error) {
+	return saveImage(SCREENSHOT_DIR, metadata, imageBytes)
+}
+
+//SaveNotificationScreenshot saves a screenshot to attach to notifications. Unlike the debug screenshots of SaveImage these
+//are taken on their own, so PruneNotificationScreenshots deletes them once they are old
+func SaveNotificationScreenshot(metadata string, imageBytes []byte) (string, error) {
+	return saveImage(NOTIFICATION_SCREENSHOT_DIR, metadata, imageBytes)
+}
+
+func saveImage(dir string, metadata string, imageBytes []byte) (string, error) {
 	// Encode to `PNG` with `DefaultCompression` level
 	// then save to file
 
 	img, _, err := image.Decode(bytes.NewReader(imageBytes))
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode image (%v)", err)
+	}
 
-	imagePath := fmt.Sprintf("screenshots/screenshot_%s_%s.png", metadata, GenerateRandomString(5))
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create screenshot directory (%v)", err)
+	}
+	metadata = unsafeFileNameChars.ReplaceAllString(metadata, "_")
+	imagePath := fmt.Sprintf("%s/screenshot_%s_%s.png", dir, metadata, GenerateRandomString(5))
 	f, err := os.Create(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("Failed to save image (%v)", err)
+	}
+	defer f.Close()
 	err = png.Encode(f, img)
 	if err != nil {
 		return "", fmt.Errorf("Failed to save image (%v)", err)
@@ -60,3 +97,18 @@ func SaveImage(metadata string, imageBytes []byte) (string, error) {
 
 	return imagePath, nil
 }
+
+//PruneNotificationScreenshots deletes the notification screenshots older than NOTIFICATION_SCREENSHOT_MAX_AGE
+func PruneNotificationScreenshots() {
+	entries, err := os.ReadDir(NOTIFICATION_SCREENSHOT_DIR)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || time.Since(info.ModTime()) < NOTIFICATION_SCREENSHOT_MAX_AGE {
+			continue
+		}
+		os.Remove(filepath.Join(NOTIFICATION_SCREENSHOT_DIR, entry.Name()))
+	}
+}
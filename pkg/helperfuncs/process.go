@@ -3,6 +3,7 @@ package helperfuncs
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -84,6 +85,54 @@ func KillProcesses(names ...string) error {
 	return nil
 }
 
+//KillChildProcesses kills the processes with the given names that this process started, directly or through other
+//processes it started, along with their own children. Processes of the same name that belong to others are left alone
+func KillChildProcesses(names ...string) error {
+	processes, err := processes()
+	if err != nil {
+		return fmt.Errorf("Failed to get processes (%v)", err)
+	}
+
+	parents := make(map[int]int, len(processes))
+	for _, p := range processes {
+		parents[p.ProcessID] = p.ParentProcessID
+	}
+
+	for _, p := range processes {
+		if !isDescendant(p.ProcessID, os.Getpid(), parents) {
+			continue
+		}
+		for _, processName := range names {
+			if !strings.EqualFold(p.Exe, processName) {
+				continue
+			}
+			fmt.Println(fmt.Sprintf("Killing process %s [%v]", processName, p.ProcessID))
+			kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.ProcessID))
+			err := kill.Run()
+			if err != nil {
+				fmt.Println(fmt.Errorf("Error killing process (%v)", err))
+			}
+		}
+	}
+	return nil
+}
+
+//isDescendant reports whether the process pid was started by ancestor, directly or further down. Windows reuses process
+//ids, so the walk up the parents is bounded instead of trusting the chain to end
+func isDescendant(pid, ancestor int, parents map[int]int) bool {
+	for depth := 0; depth < 32; depth++ {
+		parent, ok := parents[pid]
+		if !ok || parent == pid || parent == 0 {
+			return false
+		}
+		if parent == ancestor {
+			return true
+		}
+		pid = parent
+	}
+	return false
+}
+
 func findProcessesByName(name string) ([]*WindowsProcess, error) {
 	processes, err := processes()
 	if err != nil {
@@ -2,10 +2,12 @@ package helperfuncs
 
 import (
 	"bufio"
+	"dolos-dev/pkg/scheduler"
 	"dolos-dev/pkg/structs"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strings"
 )
@@ -65,14 +67,80 @@ func LoadState(productURLs *[]*structs.ProductURL) (err error) {
 	}
 
 	for _, productURL := range *productURLs {
-		urlSplit := strings.Split(productURL.URL, "/")
+		err = NormalizeProduct(productURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//NormalizeProduct validates a product and derives its ASIN from the URL. It leaves optional fields the user didn't set
+//empty so their defaults aren't written back to the product config, ProductDefaults fills them in
+func NormalizeProduct(productURL *structs.ProductURL) error {
+	if productURL.Name == "" {
+		return fmt.Errorf("Product with URL %s has no name", productURL.URL)
+	}
+	parsedURL, err := url.Parse(productURL.URL)
+	if err != nil || parsedURL.Host == "" {
+		return fmt.Errorf("Invalid URL %s of product %s", productURL.URL, productURL.Name)
+	}
+	if GetWebshopFromString(productURL.URL) == structs.WEBSHOP_NONE {
+		return fmt.Errorf("Webshop of product %s is not supported [URL: %s]", productURL.Name, productURL.URL)
+	}
 
-		productURL.ASIN = urlSplit[len(urlSplit)-1]
+	//the ASIN follows /dp/ in amazon URLs, otherwise it's the last path segment
+	urlSplit := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
+	productURL.ASIN = urlSplit[len(urlSplit)-1]
+	for i := 0; i < len(urlSplit)-1; i++ {
+		if urlSplit[i] == "dp" {
+			productURL.ASIN = urlSplit[i+1]
+			break
+		}
+	}
+
+	if productURL.Threads < 0 || productURL.ProxiesCount < 0 || productURL.MaxPurchases < 0 {
+		return fmt.Errorf("Threads, proxies_count and max_purchases of product %s can't be negative", productURL.Name)
+	}
+	if productURL.MinPrice < 0 || (productURL.MaxPrice > 0 && productURL.MinPrice > productURL.MaxPrice) {
+		return fmt.Errorf("Invalid price range %v-%v of product %s", productURL.MinPrice, productURL.MaxPrice, productURL.Name)
+	}
+
+	switch productURL.CheckMode {
+	case "", structs.CHECK_MODE_SELENIUM, structs.CHECK_MODE_HTTP:
+	default:
+		return fmt.Errorf("Unknown check_mode %s of product %s", productURL.CheckMode, productURL.Name)
+	}
+
+	switch productURL.State {
+	case "", structs.PRODUCT_STATE_RUNNING, structs.PRODUCT_STATE_PAUSED, structs.PRODUCT_STATE_STOPPED:
+	default:
+		return fmt.Errorf("Unknown state %s of product %s", productURL.State, productURL.Name)
+	}
+
+	_, err = scheduler.NewPlan(productURL.Schedule, productURL.Timezone, 0)
+	if err != nil {
+		return fmt.Errorf("Invalid schedule of product %s (%v)", productURL.Name, err)
 	}
 
 	return nil
 }
 
+//ProductDefaults returns a copy of the product with the defaults of the optional fields it leaves empty filled in
+func ProductDefaults(productURL structs.ProductURL) structs.ProductURL {
+	if productURL.Threads == 0 {
+		productURL.Threads = 1
+	}
+	if productURL.CheckMode == "" {
+		productURL.CheckMode = structs.CHECK_MODE_SELENIUM
+	}
+	if productURL.State == "" {
+		productURL.State = structs.PRODUCT_STATE_RUNNING
+	}
+	return productURL
+}
+
 //LoadGlobalConfig reads the global-config.json file and loads the necessary parameters
 func LoadGlobalConfig(config **structs.GlobalConfig) (err error) {
 	_, err = os.Stat("stockalert-config/global-config.json")
@@ -0,0 +1,70 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//StatusError is returned for responses with a status other than 2xx
+type StatusError struct {
+	StatusCode int
+	Status     string
+	URL        string
+	Header     http.Header
+	//Body is the (size capped) response body
+	Body []byte
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("Status %s from %s", err.Status, err.URL)
+}
+
+//Throttled reports whether the server asked us to slow down (429 Too Many Requests or 503 Service Unavailable)
+func (err *StatusError) Throttled() bool {
+	return err.StatusCode == http.StatusTooManyRequests || err.StatusCode == http.StatusServiceUnavailable
+}
+
+//RetryAfter returns how long the server asked us to wait with its Retry-After header, given in seconds or as a date
+func (err *StatusError) RetryAfter() (time.Duration, bool) {
+	value := strings.TrimSpace(err.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, convErr := strconv.Atoi(value); convErr == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, parseErr := http.ParseTime(value); parseErr == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+//BodyTooLargeError is returned when a response body is larger than the size cap
+type BodyTooLargeError struct {
+	URL   string
+	Limit int64
+}
+
+func (err *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("Response from %s is larger than %v bytes", err.URL, err.Limit)
+}
+
+//AsStatusError returns the *StatusError wrapped in err, or nil if there is none
+func AsStatusError(err error) *StatusError {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr
+	}
+	return nil
+}
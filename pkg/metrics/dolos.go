@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"net/http"
+)
+
+//outcomes of a stock check
+const (
+	CHECK_OUTCOME_IN_STOCK = "in_stock"
+	CHECK_OUTCOME_SOLD_OUT = "sold_out"
+	CHECK_OUTCOME_CAPTCHA  = "captcha"
+	CHECK_OUTCOME_ERROR    = "error"
+)
+
+//results of a checkout
+const (
+	CHECKOUT_RESULT_SUCCESS    = "success"
+	CHECKOUT_RESULT_FAILED     = "failed"
+	CHECKOUT_RESULT_NO_SESSION = "no_session"
+)
+
+//error types counted by Errors
+const (
+	ERROR_CHECK_FAILED      = "check_failed"
+	ERROR_CHECK_THROTTLED   = "check_throttled"
+	ERROR_CAPTCHA_FAILED    = "captcha_failed"
+	ERROR_TASK_CRASHED      = "task_crashed"
+	ERROR_SESSION_UNHEALTHY = "session_unhealthy"
+	ERROR_CHECKOUT_FAILED   = "checkout_failed"
+)
+
+//defaultRegistry holds all of the bot's metrics
+var defaultRegistry = NewRegistry()
+
+var (
+	//StockChecks counts finished stock checks by product, webshop, check mode and outcome
+	StockChecks = defaultRegistry.NewCounterVec("dolos_stock_checks_total", "Finished stock checks by outcome.", "product", "webshop", "mode", "outcome")
+	//StockCheckDuration is how long stock checks take, including waiting for the rate limit and a browser
+	StockCheckDuration = defaultRegistry.NewHistogramVec("dolos_stock_check_duration_seconds", "Duration of stock checks, including waiting for the rate limit and a browser.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "product", "webshop", "mode")
+	//Captchas counts the captchas stock checks ran into
+	Captchas = defaultRegistry.NewCounterVec("dolos_captchas_total", "Captchas found by stock checks.", "product", "webshop")
+
+	//CheckoutAttempts counts started checkouts by strategy
+	CheckoutAttempts = defaultRegistry.NewCounterVec("dolos_checkout_attempts_total", "Started checkouts by strategy.", "product", "webshop", "strategy")
+	//CheckoutResults counts finished checkouts by result and the last step they completed
+	CheckoutResults = defaultRegistry.NewCounterVec("dolos_checkout_results_total", "Finished checkouts by result and the last step they completed.", "product", "webshop", "strategy", "result", "step")
+	//CheckoutStepSeconds is how long after stock was detected each checkout step completed
+	CheckoutStepSeconds = defaultRegistry.NewHistogramVec("dolos_checkout_step_seconds", "Time from detecting stock until a checkout step completed.",
+		[]float64{0.25, 0.5, 1, 2, 3, 5, 10, 20, 30, 60}, "webshop", "strategy", "step")
+
+	//Errors counts errors by type
+	Errors = defaultRegistry.NewCounterVec("dolos_errors_total", "Errors by type.", "type")
+
+	//the gauges are read from the running bot, which sets their functions once it started
+	StockCheckWorkers = defaultRegistry.NewGaugeFunc("dolos_stock_check_workers", "Stock check workers by state.", nil, "state")
+	StockCheckQueue   = defaultRegistry.NewGaugeFunc("dolos_stock_check_queue", "Stock checks waiting for a worker.", nil)
+	CheckerBrowsers   = defaultRegistry.NewGaugeFunc("dolos_checker_browsers", "Running stock check browsers by state, max is the pool's size.", nil, "state")
+	CheckoutSessions  = defaultRegistry.NewGaugeFunc("dolos_checkout_sessions", "Checkout sessions by webshop and state.", nil, "webshop", "state")
+	Tasks             = defaultRegistry.NewGaugeFunc("dolos_tasks", "Stock check tasks by state.", nil, "state")
+	PendingCheckouts  = defaultRegistry.NewGaugeFunc("dolos_pending_checkouts", "Checkouts waiting for approval.", nil)
+)
+
+//Handler serves all of the bot's metrics in the Prometheus text format
+func Handler() http.Handler {
+	return defaultRegistry
+}
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+//labelSeparator joins label values into map keys, it can't appear in valid UTF-8
+const labelSeparator = "\xff"
+
+//Registry holds metric families and serves them in the Prometheus exposition format
+type Registry struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+}
+
+//NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	registry := prometheus.NewRegistry()
+	return &Registry{
+		registry: registry,
+		//a gauge that fails to collect only drops its own series instead of the whole scrape
+		handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}),
+	}
+}
+
+//ServeHTTP answers a scrape
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.handler.ServeHTTP(w, r)
+}
+
+//CounterVec is a counter with one series per combination of label values
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+//NewCounterVec registers a counter with the given label names
+func (registry *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{
+		vec: prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels),
+	}
+	registry.registry.MustRegister(counter.vec)
+	return counter
+}
+
+//Inc adds one to the series with the given label values
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+//Add adds delta to the series with the given label values. Counters can't decrease, negative deltas are dropped. So are
+//values with the wrong number of labels, so a mistake in the instrumentation can't take the bot down
+func (counter *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	series, err := counter.vec.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		return
+	}
+	series.Add(delta)
+}
+
+//Sum returns the total of all series
+func (counter *CounterVec) Sum() float64 {
+	sum := 0.0
+	for _, series := range collect(counter.vec) {
+		sum += series.GetCounter().GetValue()
+	}
+	return sum
+}
+
+//SumBy returns the total of the series whose label has the given value
+func (counter *CounterVec) SumBy(label string, value string) float64 {
+	sum := 0.0
+	for _, series := range collect(counter.vec) {
+		for _, pair := range series.GetLabel() {
+			if pair.GetName() == label && pair.GetValue() == value {
+				sum += series.GetCounter().GetValue()
+			}
+		}
+	}
+	return sum
+}
+
+//HistogramVec counts observations into buckets, with one histogram per combination of label values
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+//NewHistogramVec registers a histogram with the given upper bucket bounds and label names. The +Inf bucket is added
+func (registry *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogramVec := &HistogramVec{
+		vec: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels),
+	}
+	registry.registry.MustRegister(histogramVec.vec)
+	return histogramVec
+}
+
+//Observe adds a value to the histogram with the given label values
+func (histogramVec *HistogramVec) Observe(value float64, labelValues ...string) {
+	series, err := histogramVec.vec.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		return
+	}
+	series.Observe(value)
+}
+
+//Sample is a single series of a gauge read at scrape time
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+//GaugeFunc is a gauge whose series are read from the running bot on every scrape
+type GaugeFunc struct {
+	desc    *prometheus.Desc
+	labels  []string
+	mutex   sync.Mutex
+	collect func() []Sample
+}
+
+//NewGaugeFunc registers a gauge with the given label names. collect is called on every scrape until SetFunc replaces it
+func (registry *Registry) NewGaugeFunc(name string, help string, collect func() []Sample, labels ...string) *GaugeFunc {
+	gauge := &GaugeFunc{
+		desc:    prometheus.NewDesc(name, help, labels, nil),
+		labels:  labels,
+		collect: collect,
+	}
+	registry.registry.MustRegister(gauge)
+	return gauge
+}
+
+//SetFunc replaces the function the gauge is read from
+func (gauge *GaugeFunc) SetFunc(collect func() []Sample) {
+	gauge.mutex.Lock()
+	gauge.collect = collect
+	gauge.mutex.Unlock()
+}
+
+//Describe implements prometheus.Collector
+func (gauge *GaugeFunc) Describe(descs chan<- *prometheus.Desc) {
+	descs <- gauge.desc
+}
+
+//Collect implements prometheus.Collector. Samples with the same label values are added up, a series may only be
+//exposed once
+func (gauge *GaugeFunc) Collect(metrics chan<- prometheus.Metric) {
+	gauge.mutex.Lock()
+	collect := gauge.collect
+	gauge.mutex.Unlock()
+	if collect == nil {
+		return
+	}
+
+	values := make(map[string]float64)
+	labelValues := make([][]string, 0)
+	for _, sample := range collect() {
+		if len(sample.LabelValues) != len(gauge.labels) {
+			continue
+		}
+		key := strings.Join(sample.LabelValues, labelSeparator)
+		if _, ok := values[key]; !ok {
+			labelValues = append(labelValues, sample.LabelValues)
+		}
+		values[key] += sample.Value
+	}
+	for _, series := range labelValues {
+		metric, err := prometheus.NewConstMetric(gauge.desc, prometheus.GaugeValue, values[strings.Join(series, labelSeparator)], series...)
+		if err == nil {
+			metrics <- metric
+		}
+	}
+}
+
+//collect returns the current value of every series of the collector
+func collect(collector prometheus.Collector) []*dto.Metric {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(metrics)
+		close(metrics)
+	}()
+
+	series := make([]*dto.Metric, 0)
+	for metric := range metrics {
+		written := &dto.Metric{}
+		if metric.Write(written) == nil {
+			series = append(series, written)
+		}
+	}
+	return series
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//DefaultDeadLetterPath is where undeliverable notifications go if notify_dead_letter_file is not configured
+const DefaultDeadLetterPath = "stockalert-config/dead-letters.jsonl"
+
+//DeadLetter is a notification that could not be delivered, one json object per line of the dead letter log
+type DeadLetter struct {
+	Time     time.Time    `json:"time"`
+	Notifier string       `json:"notifier"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Event    events.Event `json:"event"`
+}
+
+//deadLetterLog appends undeliverable notifications to a file so they can be looked at or replayed by hand
+type deadLetterLog struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func newDeadLetterLog(path string) *deadLetterLog {
+	if path == "" {
+		path = DefaultDeadLetterPath
+	}
+	return &deadLetterLog{
+		path: path,
+	}
+}
+
+//add appends the notification to the log. A notification that can't even be written there is only logged
+func (log *deadLetterLog) add(notifier string, event events.Event, attempts int, reason error) {
+	line, err := json.Marshal(DeadLetter{
+		Time:     time.Now(),
+		Notifier: notifier,
+		Attempts: attempts,
+		Error:    reason.Error(),
+		Event:    event,
+	})
+	if err != nil {
+		helperfuncs.Log("Failed to encode dead letter of notifier %s (%v)", notifier, err)
+		return
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(log.path), 0700)
+	if err != nil {
+		helperfuncs.Log("Failed to create dead letter directory (%v)", err)
+		return
+	}
+	file, err := os.OpenFile(log.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		helperfuncs.Log("Failed to open dead letter log %s (%v)", log.path, err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		helperfuncs.Log("Failed to write dead letter log %s (%v)", log.path, err)
+	}
+}
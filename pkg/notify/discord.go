@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/structs"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+//discord posts events as embeds to a Discord channel's incoming webhook. Screenshots are attached to the message
+type discord struct {
+	url    string
+	client *httpclient.Client
+	gate   rateGate
+}
+
+type discordPayload struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title     string              `json:"title"`
+	URL       string              `json:"url,omitempty"`
+	Color     int                 `json:"color"`
+	Timestamp string              `json:"timestamp,omitempty"`
+	Fields    []discordEmbedField `json:"fields,omitempty"`
+	Image     *discordEmbedImage  `json:"image,omitempty"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+func newDiscord(config structs.NotifierConfig) (*discord, error) {
+	client, err := newHTTPClient(config.URL, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &discord{
+		url:    config.URL,
+		client: client,
+	}, nil
+}
+
+func (hook *discord) Notify(ctx context.Context, event events.Event) error {
+	msg := newMessage(event)
+	embed := discordEmbed{
+		Title: msg.title,
+		URL:   msg.url,
+		Color: msg.color,
+	}
+	if !msg.time.IsZero() {
+		embed.Timestamp = msg.time.UTC().Format(time.RFC3339)
+	}
+	addField := func(name, value string, inline bool) {
+		if value != "" {
+			embed.Fields = append(embed.Fields, discordEmbedField{Name: name, Value: value, Inline: inline})
+		}
+	}
+	addField("Product", msg.product, false)
+	addField("Marketplace", msg.webshop, true)
+	addField("Price", msg.price, true)
+	addField("Old price", msg.oldPrice, true)
+	addField("Seller", msg.seller, true)
+	for _, field := range msg.fields {
+		addField(field.name, field.value, true)
+	}
+	if msg.url != "" {
+		addField("Offer", fmt.Sprintf("[Open offer](%s)", msg.url), false)
+	}
+
+	var screenshot []byte
+	if msg.screenshot != "" {
+		var err error
+		screenshot, err = os.ReadFile(msg.screenshot)
+		if err == nil {
+			embed.Image = &discordEmbedImage{URL: "attachment://" + filepath.Base(msg.screenshot)}
+		}
+	}
+
+	payload, err := json.Marshal(discordPayload{Embeds: []discordEmbed{embed}})
+	if err != nil {
+		return &DeliveryError{Err: fmt.Errorf("Failed to encode discord message (%v)", err)}
+	}
+
+	err = hook.gate.wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	var resp *httpclient.Response
+	if embed.Image == nil {
+		resp, err = post(ctx, hook.client, hook.url, payload, http.Header{"Content-Type": {"application/json"}})
+	} else {
+		var body []byte
+		var contentType string
+		body, contentType, err = discordMultipart(payload, filepath.Base(msg.screenshot), screenshot)
+		if err != nil {
+			return &DeliveryError{Err: err}
+		}
+		resp, err = post(ctx, hook.client, hook.url, body, http.Header{"Content-Type": {contentType}})
+	}
+	if resp != nil {
+		hook.observeRateLimit(resp.Header)
+	}
+	return err
+}
+
+//discordMultipart puts the message and the attached file into a multipart form, the way Discord takes attachments
+func discordMultipart(payload []byte, fileName string, file []byte) ([]byte, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	err := writer.WriteField("payload_json", string(payload))
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to write discord message (%v)", err)
+	}
+	part, err := writer.CreateFormFile("files[0]", fileName)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to attach %s (%v)", fileName, err)
+	}
+	_, err = part.Write(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to attach %s (%v)", fileName, err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to write discord message (%v)", err)
+	}
+	return body.Bytes(), writer.FormDataContentType(), nil
+}
+
+//observeRateLimit holds the next message back if Discord says the webhook's bucket is used up
+func (hook *discord) observeRateLimit(header http.Header) {
+	if header.Get("X-RateLimit-Remaining") != "0" {
+		return
+	}
+	resetAfter, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil || resetAfter <= 0 {
+		return
+	}
+	hook.gate.holdUntil(time.Now().Add(time.Duration(resetAfter * float64(time.Second))))
+}
@@ -0,0 +1,362 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/structs"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//ways of securing the SMTP connection
+const (
+	SMTP_TLS_STARTTLS = "starttls"
+	SMTP_TLS_IMPLICIT = "tls"
+	SMTP_TLS_NONE     = "none"
+)
+
+//names of the email templates, a file of the same name in the configured templates directory overrides the built in one
+const (
+	TEMPLATE_SUBJECT = "subject.tmpl"
+	TEMPLATE_TEXT    = "email.txt.tmpl"
+	TEMPLATE_HTML    = "email.html.tmpl"
+)
+
+//defaultTemplates are the built in email templates
+//go:embed templates
+var defaultTemplates embed.FS
+
+//EmailData is what the email templates are executed with
+type EmailData struct {
+	Events []EmailEvent
+	Time   time.Time
+}
+
+//EmailEvent is a single event of an email
+type EmailEvent struct {
+	Type     string
+	Title    string
+	Time     time.Time
+	Product  string
+	Webshop  string
+	Price    string
+	OldPrice string
+	Seller   string
+	URL      string
+	//Color is the event's color as #rrggbb
+	Color  string
+	Fields []EmailField
+}
+
+//EmailField is event data that doesn't have its own field in EmailEvent
+type EmailField struct {
+	Name  string
+	Value string
+}
+
+//email sends events as mails over SMTP, several events that come in at once are sent in one mail
+type email struct {
+	config   structs.SMTPConfig
+	address  string
+	from     *mail.Address
+	to       []string
+	subject  *texttemplate.Template
+	text     *texttemplate.Template
+	html     *htmltemplate.Template
+	hostname string
+}
+
+func newEmail(config structs.NotifierConfig) (*email, error) {
+	if config.SMTP == nil || config.SMTP.Host == "" {
+		return nil, fmt.Errorf("No SMTP host configured")
+	}
+	smtpConfig := *config.SMTP
+	if smtpConfig.TLS == "" {
+		smtpConfig.TLS = SMTP_TLS_STARTTLS
+	}
+	if smtpConfig.Port == 0 {
+		switch smtpConfig.TLS {
+		case SMTP_TLS_IMPLICIT:
+			smtpConfig.Port = 465
+		case SMTP_TLS_STARTTLS:
+			smtpConfig.Port = 587
+		default:
+			smtpConfig.Port = 25
+		}
+	}
+	if smtpConfig.TLS != SMTP_TLS_STARTTLS && smtpConfig.TLS != SMTP_TLS_IMPLICIT && smtpConfig.TLS != SMTP_TLS_NONE {
+		return nil, fmt.Errorf("Unknown SMTP TLS mode %s", smtpConfig.TLS)
+	}
+
+	from, err := mail.ParseAddress(smtpConfig.From)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid from address %s (%v)", smtpConfig.From, err)
+	}
+	if len(smtpConfig.To) == 0 {
+		return nil, fmt.Errorf("No recipients configured")
+	}
+	to := make([]string, 0, len(smtpConfig.To))
+	for _, recipient := range smtpConfig.To {
+		address, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recipient %s (%v)", recipient, err)
+		}
+		to = append(to, address.Address)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	notifier := &email{
+		config:   smtpConfig,
+		address:  net.JoinHostPort(smtpConfig.Host, strconv.Itoa(smtpConfig.Port)),
+		from:     from,
+		to:       to,
+		hostname: hostname,
+	}
+
+	subject, err := loadTemplate(smtpConfig.Templates, TEMPLATE_SUBJECT)
+	if err == nil {
+		notifier.subject, err = texttemplate.New(TEMPLATE_SUBJECT).Parse(subject)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template %s (%v)", TEMPLATE_SUBJECT, err)
+	}
+	text, err := loadTemplate(smtpConfig.Templates, TEMPLATE_TEXT)
+	if err == nil {
+		notifier.text, err = texttemplate.New(TEMPLATE_TEXT).Parse(text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template %s (%v)", TEMPLATE_TEXT, err)
+	}
+	html, err := loadTemplate(smtpConfig.Templates, TEMPLATE_HTML)
+	if err == nil {
+		notifier.html, err = htmltemplate.New(TEMPLATE_HTML).Parse(html)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template %s (%v)", TEMPLATE_HTML, err)
+	}
+
+	return notifier, nil
+}
+
+//loadTemplate reads the template from the directory if it has it and falls back to the built in one
+func loadTemplate(dir string, name string) (string, error) {
+	if dir != "" {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(content), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	content, err := defaultTemplates.ReadFile("templates/" + name)
+	return string(content), err
+}
+
+func (notifier *email) Notify(ctx context.Context, event events.Event) error {
+	return notifier.NotifyBatch(ctx, []events.Event{event})
+}
+
+//NotifyBatch sends the events in a single mail
+func (notifier *email) NotifyBatch(ctx context.Context, batch []events.Event) error {
+	message, err := notifier.compose(batch)
+	if err != nil {
+		return &DeliveryError{Err: err}
+	}
+	return notifier.send(ctx, message)
+}
+
+//compose builds the mail with a plain text and a html body from the templates
+func (notifier *email) compose(batch []events.Event) ([]byte, error) {
+	data := EmailData{
+		Time: time.Now(),
+	}
+	for _, event := range batch {
+		msg := newMessage(event)
+		emailEvent := EmailEvent{
+			Type:     event.Type,
+			Title:    msg.title,
+			Time:     msg.time,
+			Product:  msg.product,
+			Webshop:  msg.webshop,
+			Price:    msg.price,
+			OldPrice: msg.oldPrice,
+			Seller:   msg.seller,
+			URL:      msg.url,
+			Color:    fmt.Sprintf("#%06x", msg.color),
+		}
+		for _, field := range msg.fields {
+			emailEvent.Fields = append(emailEvent.Fields, EmailField{Name: field.name, Value: field.value})
+		}
+		data.Events = append(data.Events, emailEvent)
+	}
+
+	subject := &bytes.Buffer{}
+	err := notifier.subject.Execute(subject, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute template %s (%v)", TEMPLATE_SUBJECT, err)
+	}
+	text := &bytes.Buffer{}
+	err = notifier.text.Execute(text, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute template %s (%v)", TEMPLATE_TEXT, err)
+	}
+	html := &bytes.Buffer{}
+	err = notifier.html.Execute(html, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute template %s (%v)", TEMPLATE_HTML, err)
+	}
+
+	message := &bytes.Buffer{}
+	body := multipart.NewWriter(message)
+	header := []string{
+		"From: " + notifier.from.String(),
+		"To: " + strings.Join(notifier.to, ", "),
+		//newlines in a subject would end the header
+		"Subject: " + mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")),
+		"Date: " + data.Time.Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%d.%s@%s>", data.Time.UnixNano(), helperfuncs.GenerateRandomString(8), notifier.hostname),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + body.Boundary(),
+	}
+	message.WriteString(strings.Join(header, "\r\n") + "\r\n\r\n")
+
+	//mail clients show the last alternative they understand, so html goes last
+	err = writePart(body, "text/plain; charset=utf-8", text.Bytes())
+	if err == nil {
+		err = writePart(body, "text/html; charset=utf-8", html.Bytes())
+	}
+	if err == nil {
+		err = body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write mail (%v)", err)
+	}
+	return message.Bytes(), nil
+}
+
+//writePart adds a quoted-printable encoded part to the mail
+func writePart(body *multipart.Writer, contentType string, content []byte) error {
+	part, err := body.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	encoder := quotedprintable.NewWriter(part)
+	_, err = encoder.Write(content)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+//send delivers the mail to the SMTP server. Temporary (4xx) answers and connection problems are retried, permanent ones are not
+func (notifier *email) send(ctx context.Context, message []byte) error {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", notifier.address)
+	if err != nil {
+		return &DeliveryError{Err: fmt.Errorf("Failed to connect to %s (%v)", notifier.address, err), Retry: true}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tlsConfig := &tls.Config{ServerName: notifier.config.Host}
+	if notifier.config.TLS == SMTP_TLS_IMPLICIT {
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return &DeliveryError{Err: fmt.Errorf("Failed TLS handshake with %s (%v)", notifier.address, err), Retry: true}
+		}
+		conn = tlsConn
+	}
+
+	client, err := smtp.NewClient(conn, notifier.config.Host)
+	if err != nil {
+		conn.Close()
+		return smtpError("connect", err)
+	}
+	defer client.Close()
+
+	err = client.Hello(notifier.hostname)
+	if err != nil {
+		return smtpError("greet", err)
+	}
+	if notifier.config.TLS == SMTP_TLS_STARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return &DeliveryError{Err: fmt.Errorf("SMTP server %s does not support STARTTLS", notifier.address)}
+		}
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return smtpError("start TLS", err)
+		}
+	}
+	if notifier.config.Username != "" {
+		//PlainAuth refuses to send the password unencrypted, unless the server is on localhost
+		err = client.Auth(smtp.PlainAuth("", notifier.config.Username, notifier.config.Password, notifier.config.Host))
+		var protocolErr *textproto.Error
+		if err != nil && !errors.As(err, &protocolErr) {
+			return &DeliveryError{Err: fmt.Errorf("Failed to authenticate (%v)", err)}
+		} else if err != nil {
+			return smtpError("authenticate", err)
+		}
+	}
+
+	err = client.Mail(notifier.from.Address)
+	if err != nil {
+		return smtpError("send from", err)
+	}
+	for _, recipient := range notifier.to {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return smtpError("send to "+recipient, err)
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return smtpError("start mail", err)
+	}
+	_, err = io.Copy(writer, bytes.NewReader(message))
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return smtpError("send mail", err)
+	}
+	//the mail was accepted, it must not be sent again if saying goodbye fails
+	client.Quit()
+	return nil
+}
+
+//smtpError retries everything but permanent (5xx) answers of the server
+func smtpError(action string, err error) error {
+	var protocolErr *textproto.Error
+	if errors.As(err, &protocolErr) && protocolErr.Code >= 500 {
+		return &DeliveryError{Err: fmt.Errorf("SMTP server refused to %s (%v)", action, err)}
+	}
+	return &DeliveryError{Err: fmt.Errorf("Failed to %s (%v)", action, err), Retry: true}
+}
@@ -0,0 +1,184 @@
+package notify
+
+import (
+	"context"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//maxTitleLength and maxFieldLength keep messages within what chat services accept
+	maxTitleLength = 250
+	maxFieldLength = 1000
+)
+
+//colors of the chat messages by event type, as RGB
+const (
+	COLOR_GOOD    = 0x2eb886
+	COLOR_BAD     = 0xd40e0d
+	COLOR_NEUTRAL = 0x439fe0
+	COLOR_WARNING = 0xdaa038
+)
+
+//message is an event prepared for chat services. Formats turn it into their own payload
+type message struct {
+	title      string
+	color      int
+	time       time.Time
+	product    string
+	webshop    string
+	price      string
+	oldPrice   string
+	seller     string
+	url        string
+	screenshot string
+	//fields are the event's other data, sorted by name
+	fields []messageField
+}
+
+type messageField struct {
+	name  string
+	value string
+}
+
+//titles of the event types, the product's name is appended
+var eventTitles = map[string]string{
+	events.EVENT_CHECK_STARTED:     "Check started",
+	events.EVENT_CHECK_FINISHED:    "Check finished",
+	events.EVENT_IN_STOCK:          "In stock",
+	events.EVENT_OUT_OF_STOCK:      "Out of stock",
+	events.EVENT_PRICE_CHANGED:     "Price changed",
+	events.EVENT_CHECKOUT_STEP:     "Checkout step",
+	events.EVENT_ORDER_PLACED:      "Order placed",
+	events.EVENT_SESSION_UNHEALTHY: "Checkout session unhealthy",
+	events.EVENT_TASK_RESTARTED:    "Task restarted",
+	EVENT_TEST:                     "Test notification",
+}
+
+//escalatedTitle is the title of in stock events of products that stayed in stock for long
+const escalatedTitle = "Still in stock"
+
+var eventColors = map[string]int{
+	events.EVENT_IN_STOCK:          COLOR_GOOD,
+	events.EVENT_ORDER_PLACED:      COLOR_GOOD,
+	events.EVENT_OUT_OF_STOCK:      COLOR_BAD,
+	events.EVENT_SESSION_UNHEALTHY: COLOR_WARNING,
+	events.EVENT_TASK_RESTARTED:    COLOR_WARNING,
+}
+
+//newMessage picks the fields chat messages show out of the event's data
+func newMessage(event events.Event) message {
+	msg := message{
+		title:   eventTitles[event.Type],
+		color:   COLOR_NEUTRAL,
+		time:    event.Time,
+		product: event.Product,
+	}
+	if msg.title == "" {
+		msg.title = event.Type
+	}
+	if escalated, _ := event.Data["escalated"].(bool); escalated {
+		msg.title = escalatedTitle
+	}
+	if event.Product != "" {
+		msg.title += ": " + event.Product
+	}
+	msg.title = truncate(msg.title, maxTitleLength)
+	if color, ok := eventColors[event.Type]; ok {
+		msg.color = color
+	}
+
+	for key, value := range event.Data {
+		switch key {
+		case "webshop":
+			msg.webshop = webshopName(value)
+		case "price":
+			msg.price = formatPrice(value)
+		case "old_price":
+			msg.oldPrice = formatPrice(value)
+		case "seller":
+			msg.seller = fmt.Sprint(value)
+		case "url":
+			msg.url = fmt.Sprint(value)
+		case "screenshot":
+			//events only carry the screenshot's file name
+			msg.screenshot = filepath.Join(helperfuncs.NOTIFICATION_SCREENSHOT_DIR, filepath.Base(fmt.Sprint(value)))
+		case "escalated":
+		default:
+			msg.fields = append(msg.fields, messageField{name: key, value: truncate(fmt.Sprint(value), maxFieldLength)})
+		}
+	}
+	sort.Slice(msg.fields, func(i, j int) bool {
+		return msg.fields[i].name < msg.fields[j].name
+	})
+	return msg
+}
+
+//webshopName returns the webshop's domain. Events carry the webshop kind, which knows its name
+func webshopName(value interface{}) string {
+	if named, ok := value.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprint(value)
+}
+
+func formatPrice(value interface{}) string {
+	if price, ok := value.(float64); ok {
+		return fmt.Sprintf("%.2f", price)
+	}
+	return fmt.Sprint(value)
+}
+
+//truncate cuts the text to at most max bytes without splitting a character
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	cut := 0
+	for i := range text {
+		if i > max-3 {
+			break
+		}
+		cut = i
+	}
+	return text[:cut] + "..."
+}
+
+//rateGate holds requests back until a rate limit a chat service told us about has passed
+type rateGate struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+//wait blocks until the next request may be sent or ctx is done
+func (gate *rateGate) wait(ctx context.Context) error {
+	gate.mutex.Lock()
+	wait := time.Until(gate.next)
+	gate.mutex.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return &DeliveryError{Err: fmt.Errorf("Rate limited for another %v", wait.Round(time.Millisecond)), Retry: true, RetryAfter: wait}
+	}
+}
+
+//holdUntil keeps requests from being sent before t
+func (gate *rateGate) holdUntil(t time.Time) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if t.After(gate.next) {
+		gate.next = t
+	}
+}
@@ -0,0 +1,399 @@
+package notify
+
+import (
+	"context"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/structs"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	//DefaultMQTTTopicPrefix and DefaultMQTTDiscoveryPrefix are used if topic_prefix and discovery_prefix are not configured
+	DefaultMQTTTopicPrefix     = "dolos"
+	DefaultMQTTDiscoveryPrefix = "homeassistant"
+
+	//mqttDefaultKeepAlive is the keep alive interval if keep_alive is not configured
+	mqttDefaultKeepAlive = time.Minute
+	//mqttConnectTimeout caps connecting to the broker, mqttPublishTimeout waiting for a publish to be written
+	mqttConnectTimeout = 15 * time.Second
+	mqttPublishTimeout = 10 * time.Second
+	//mqttConnectRetry is the wait between attempts to connect at first, mqttReconnectMax caps the wait before
+	//reconnecting after the connection was lost, doubled with every failed attempt
+	mqttConnectRetry = 10 * time.Second
+	mqttReconnectMax = time.Minute
+	//mqttDisconnectQuiesce is how many milliseconds the client waits for the last publishes when it disconnects
+	mqttDisconnectQuiesce = 250
+
+	//payloads of the availability topic
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+//mqttNodeIDPattern matches what Home Assistant doesn't allow in discovery node IDs
+var mqttNodeIDPattern = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+//mqtt publishes the bot's events and a retained state per product to an MQTT broker, together with the Home Assistant
+//discovery config of the products. It takes pause, resume and check commands on the products' command topics
+type mqtt struct {
+	client          paho.Client
+	broker          string
+	prefix          string
+	discoveryPrefix string
+	nodeID          string
+	discovery       bool
+
+	mutex      sync.Mutex
+	controller Controller
+	//states holds the last state of every product, published again whenever the client (re)connects. discovered holds
+	//the products whose discovery config was published on the current connection
+	states     map[int]*MQTTProductState
+	discovered map[int]bool
+}
+
+//MQTTProductState is the retained state of a product, published to <prefix>/product/<id>/state
+type MQTTProductState struct {
+	ProductID int        `json:"product_id"`
+	Product   string     `json:"product"`
+	InStock   bool       `json:"in_stock"`
+	Price     float64    `json:"price,omitempty"`
+	Webshop   string     `json:"webshop,omitempty"`
+	URL       string     `json:"url,omitempty"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+func newMQTT(config structs.NotifierConfig) (*mqtt, error) {
+	if config.MQTT == nil || config.MQTT.Broker == "" {
+		return nil, fmt.Errorf("No MQTT broker configured")
+	}
+	mqttConfig := config.MQTT
+
+	notifier := &mqtt{
+		broker:          mqttConfig.Broker,
+		prefix:          strings.Trim(mqttConfig.TopicPrefix, "/"),
+		discoveryPrefix: strings.Trim(mqttConfig.DiscoveryPrefix, "/"),
+		discovery:       !mqttConfig.DisableDiscovery,
+		states:          make(map[int]*MQTTProductState),
+		discovered:      make(map[int]bool),
+	}
+	if notifier.prefix == "" {
+		notifier.prefix = DefaultMQTTTopicPrefix
+	}
+	if notifier.discoveryPrefix == "" {
+		notifier.discoveryPrefix = DefaultMQTTDiscoveryPrefix
+	}
+	if strings.ContainsAny(notifier.prefix, "+#") || strings.ContainsAny(notifier.discoveryPrefix, "+#") {
+		return nil, fmt.Errorf("Topic prefixes can't contain wildcards")
+	}
+	clientID := mqttConfig.ClientID
+	if clientID == "" {
+		clientID = notifier.prefix
+	}
+	keepAlive := time.Duration(mqttConfig.KeepAlive) * time.Second
+	if keepAlive <= 0 {
+		keepAlive = mqttDefaultKeepAlive
+	}
+	notifier.nodeID = mqttNodeIDPattern.ReplaceAllString(notifier.prefix, "_")
+
+	//the client keeps reconnecting on its own once Listen connected it
+	options := paho.NewClientOptions().
+		AddBroker(mqttConfig.Broker).
+		SetClientID(clientID).
+		SetUsername(mqttConfig.Username).
+		SetPassword(mqttConfig.Password).
+		SetKeepAlive(keepAlive).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetWriteTimeout(mqttPublishTimeout).
+		SetWill(notifier.availabilityTopic(), mqttOffline, 0, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttConnectRetry).
+		SetMaxReconnectInterval(mqttReconnectMax).
+		SetOnConnectHandler(notifier.connected).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			helperfuncs.Log("Lost connection to MQTT broker %s, reconnecting (%v)", notifier.broker, err)
+		})
+	notifier.client = paho.NewClient(options)
+	return notifier, nil
+}
+
+func (notifier *mqtt) availabilityTopic() string {
+	return notifier.prefix + "/status"
+}
+
+func (notifier *mqtt) stateTopic(productID int) string {
+	return fmt.Sprintf("%s/product/%d/state", notifier.prefix, productID)
+}
+
+func (notifier *mqtt) commandTopic(productID int) string {
+	return fmt.Sprintf("%s/product/%d/command", notifier.prefix, productID)
+}
+
+//publish publishes the payload with QoS 0 and waits until it is written
+func (notifier *mqtt) publish(topic string, payload []byte, retain bool) error {
+	token := notifier.client.Publish(topic, 0, retain, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return fmt.Errorf("Timed out publishing to %s", topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("Failed to publish to %s (%v)", topic, err)
+	}
+	return nil
+}
+
+//connected runs whenever the client (re)connected. It subscribes to the command topics, marks the bot online and
+//publishes the discovery configs and states of all products, so the broker holds the latest ones after an outage
+func (notifier *mqtt) connected(client paho.Client) {
+	helperfuncs.Log("Connected to MQTT broker %s", notifier.broker)
+	token := client.Subscribe(notifier.prefix+"/product/+/command", 0, func(_ paho.Client, message paho.Message) {
+		notifier.handleMessage(message.Topic(), message.Payload())
+	})
+	if token.WaitTimeout(mqttPublishTimeout) && token.Error() != nil {
+		helperfuncs.Log("Failed to subscribe to MQTT command topics (%v)", token.Error())
+	}
+	err := notifier.publish(notifier.availabilityTopic(), []byte(mqttOnline), true)
+	if err != nil {
+		helperfuncs.Log("Failed to mark the bot online on MQTT broker %s (%v)", notifier.broker, err)
+		return
+	}
+
+	notifier.mutex.Lock()
+	notifier.discovered = make(map[int]bool)
+	states := make([]MQTTProductState, 0, len(notifier.states))
+	for _, state := range notifier.states {
+		states = append(states, *state)
+	}
+	notifier.mutex.Unlock()
+	for _, state := range states {
+		err = notifier.publishState(state)
+		if err != nil {
+			helperfuncs.Log("Failed to republish MQTT state of product %v (%v)", state.ProductID, err)
+			return
+		}
+	}
+}
+
+//Notify publishes the event and updates its product's state. State updates alone (check_finished) are dropped while
+//the broker is unreachable instead of retried, the latest states are published again once the client reconnects
+func (notifier *mqtt) Notify(ctx context.Context, event events.Event) error {
+	state, changed := notifier.updateState(event)
+	stateOnly := event.Type == events.EVENT_CHECK_FINISHED
+	if !notifier.client.IsConnectionOpen() {
+		if stateOnly {
+			return nil
+		}
+		return &DeliveryError{Err: fmt.Errorf("Not connected to MQTT broker %s", notifier.broker), Retry: true}
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return &DeliveryError{Err: fmt.Errorf("Failed to encode event %v (%v)", event.ID, err)}
+	}
+	err = notifier.publish(notifier.prefix+"/events/"+event.Type, payload, false)
+	if err == nil && changed {
+		err = notifier.publishState(state)
+	}
+	if err != nil && !stateOnly {
+		return &DeliveryError{Err: err, Retry: true}
+	}
+	return nil
+}
+
+//publishState publishes the product's discovery config if it wasn't yet on this connection and its retained state
+func (notifier *mqtt) publishState(state MQTTProductState) error {
+	err := notifier.publishDiscovery(state)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed to encode state of product %v (%v)", state.ProductID, err)
+	}
+	return notifier.publish(notifier.stateTopic(state.ProductID), payload, true)
+}
+
+//updateState applies the event to its product's state and returns a copy of it. It reports false for events that
+//don't say anything about a product's stock
+func (notifier *mqtt) updateState(event events.Event) (MQTTProductState, bool) {
+	if event.ProductID == 0 {
+		return MQTTProductState{}, false
+	}
+	switch event.Type {
+	case events.EVENT_CHECK_FINISHED, events.EVENT_IN_STOCK, events.EVENT_OUT_OF_STOCK, events.EVENT_PRICE_CHANGED:
+	default:
+		return MQTTProductState{}, false
+	}
+
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	state, ok := notifier.states[event.ProductID]
+	if !ok {
+		state = &MQTTProductState{ProductID: event.ProductID}
+		notifier.states[event.ProductID] = state
+	}
+	if event.Product != "" {
+		state.Product = event.Product
+	}
+
+	switch event.Type {
+	case events.EVENT_IN_STOCK:
+		state.InStock = true
+	case events.EVENT_OUT_OF_STOCK:
+		state.InStock = false
+	case events.EVENT_CHECK_FINISHED:
+		eventTime := event.Time
+		state.LastCheck = &eventTime
+		state.LastError = ""
+		if checkErr, ok := event.Data["error"].(string); ok {
+			state.LastError = checkErr
+		} else if inStock, ok := event.Data["in_stock"].(bool); ok {
+			state.InStock = inStock
+		}
+	case events.EVENT_PRICE_CHANGED:
+		if inStock, ok := event.Data["in_stock"].(bool); ok {
+			state.InStock = inStock
+		}
+	}
+	if price, ok := event.Data["price"].(float64); ok && price > 0 {
+		state.Price = price
+	}
+	if webshop, ok := event.Data["webshop"]; ok {
+		state.Webshop = webshopName(webshop)
+	}
+	if productURL, ok := event.Data["url"].(string); ok {
+		state.URL = productURL
+	}
+	return *state, true
+}
+
+//publishDiscovery publishes the Home Assistant discovery config of the product once per connection: a binary sensor
+//for its availability, a sensor for its price and buttons to check, pause and resume it
+func (notifier *mqtt) publishDiscovery(state MQTTProductState) error {
+	if !notifier.discovery {
+		return nil
+	}
+	notifier.mutex.Lock()
+	discovered := notifier.discovered[state.ProductID]
+	notifier.discovered[state.ProductID] = true
+	notifier.mutex.Unlock()
+	if discovered {
+		return nil
+	}
+
+	objectID := fmt.Sprintf("%s_product_%d", notifier.nodeID, state.ProductID)
+	stateTopic := notifier.stateTopic(state.ProductID)
+	device := map[string]interface{}{
+		"identifiers":  []string{objectID},
+		"name":         state.Product,
+		"manufacturer": "dolos",
+	}
+	if state.Product == "" {
+		device["name"] = fmt.Sprintf("Product %d", state.ProductID)
+	}
+	if state.Webshop != "" {
+		device["model"] = state.Webshop
+	}
+
+	entities := []struct {
+		component string
+		suffix    string
+		config    map[string]interface{}
+	}{
+		{"binary_sensor", "in_stock", map[string]interface{}{
+			"name":                  "In stock",
+			"state_topic":           stateTopic,
+			"value_template":        "{{ 'ON' if value_json.in_stock else 'OFF' }}",
+			"json_attributes_topic": stateTopic,
+		}},
+		{"sensor", "price", map[string]interface{}{
+			"name":           "Price",
+			"state_topic":    stateTopic,
+			"value_template": "{{ value_json.price | default(none) }}",
+			"icon":           "mdi:cash",
+		}},
+		{"button", "check", map[string]interface{}{
+			"name":          "Check now",
+			"command_topic": notifier.commandTopic(state.ProductID),
+			"payload_press": ACTION_CHECK,
+		}},
+		{"button", "pause", map[string]interface{}{
+			"name":          "Pause",
+			"command_topic": notifier.commandTopic(state.ProductID),
+			"payload_press": ACTION_PAUSE,
+		}},
+		{"button", "resume", map[string]interface{}{
+			"name":          "Resume",
+			"command_topic": notifier.commandTopic(state.ProductID),
+			"payload_press": ACTION_RESUME,
+		}},
+	}
+	for _, entity := range entities {
+		entity.config["unique_id"] = objectID + "_" + entity.suffix
+		entity.config["availability_topic"] = notifier.availabilityTopic()
+		entity.config["device"] = device
+		payload, err := json.Marshal(entity.config)
+		if err != nil {
+			return fmt.Errorf("Failed to encode discovery config of product %v (%v)", state.ProductID, err)
+		}
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", notifier.discoveryPrefix, entity.component, objectID, entity.suffix)
+		err = notifier.publish(topic, payload, true)
+		if err != nil {
+			//publish it again on the next event
+			notifier.mutex.Lock()
+			delete(notifier.discovered, state.ProductID)
+			notifier.mutex.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+//Listen connects to the broker and runs the commands sent to the products' command topics until ctx is done. The
+//client keeps reconnecting in the meantime. It then marks the bot offline
+func (notifier *mqtt) Listen(ctx context.Context, controller Controller) {
+	notifier.mutex.Lock()
+	notifier.controller = controller
+	notifier.mutex.Unlock()
+
+	//with connect retry the token only completes once connected, the client keeps trying until then
+	notifier.client.Connect()
+	<-ctx.Done()
+
+	if notifier.client.IsConnectionOpen() {
+		notifier.publish(notifier.availabilityTopic(), []byte(mqttOffline), true)
+	}
+	notifier.client.Disconnect(mqttDisconnectQuiesce)
+}
+
+//handleMessage runs a command sent to <prefix>/product/<id>/command, the payload is the action. The outcome is
+//published to the command topic's /result
+func (notifier *mqtt) handleMessage(topic string, payload []byte) {
+	idText := strings.TrimSuffix(strings.TrimPrefix(topic, notifier.prefix+"/product/"), "/command")
+	id, err := strconv.Atoi(idText)
+	if err != nil || id < 1 {
+		return
+	}
+	notifier.mutex.Lock()
+	controller := notifier.controller
+	notifier.mutex.Unlock()
+	if controller == nil {
+		return
+	}
+
+	action := strings.ToLower(strings.TrimSpace(string(payload)))
+	//commands may take a while, the client has to keep reading in the meantime
+	go func() {
+		result := productAction(controller, action, id)
+		helperfuncs.Log("MQTT command %s: %s", action, result)
+		notifier.publish(notifier.commandTopic(id)+"/result", []byte(result), false)
+	}()
+}
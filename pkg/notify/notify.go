@@ -0,0 +1,559 @@
+package notify
+
+import (
+	"context"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/structs"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//notifier types
+const (
+	NOTIFIER_WEBHOOK  = "webhook"
+	NOTIFIER_DISCORD  = "discord"
+	NOTIFIER_SLACK    = "slack"
+	NOTIFIER_EMAIL    = "email"
+	NOTIFIER_TELEGRAM = "telegram"
+	NOTIFIER_MQTT     = "mqtt"
+)
+
+const (
+	//defaultTimeout caps a single delivery attempt if the notifier's timeout is not configured
+	defaultTimeout = 10 * time.Second
+	//defaultBatchWindow is how long batching notifiers collect events if batch_window is not configured
+	defaultBatchWindow = 10 * time.Second
+	//defaultMaxRetries is how often a failed delivery is retried if max_retries is not configured
+	defaultMaxRetries = 3
+	//retryBackoffMin and retryBackoffMax bound the wait between attempts, doubled with every retry
+	retryBackoffMin = time.Second
+	retryBackoffMax = time.Minute
+	//queueSize is how many notifications a notifier may fall behind before new ones go to the dead letter log
+	queueSize = 1000
+	//maxBatchSize caps how many events a batching notifier sends at once
+	maxBatchSize = 50
+	//rulesInterval is how often held events are checked for release and old repeats forgotten
+	rulesInterval = 30 * time.Second
+)
+
+//EVENT_TEST is the type of the events sent by Dispatcher.Test. It is never published on the bus
+const EVENT_TEST = "test"
+
+//ErrUnknownNotifier is returned by Test for names that aren't configured
+var ErrUnknownNotifier = errors.New("Unknown notifier")
+
+//DefaultEvents are the event types a notifier gets if it doesn't list its own
+var DefaultEvents = []string{events.EVENT_IN_STOCK, events.EVENT_OUT_OF_STOCK, events.EVENT_PRICE_CHANGED, events.EVENT_ORDER_PLACED}
+
+//Notifier delivers events somewhere outside the bot
+type Notifier interface {
+	//Notify delivers a single event. Errors are retried unless they are a *DeliveryError that says otherwise
+	Notify(ctx context.Context, event events.Event) error
+}
+
+//BatchNotifier is a notifier that can deliver several events at once. The dispatcher collects the events that come in
+//within the notifier's batch window and hands them over together
+type BatchNotifier interface {
+	Notifier
+	NotifyBatch(ctx context.Context, batch []events.Event) error
+}
+
+//Controller lets notifiers that take commands act on the bot. Status and Products describe the bot as text
+type Controller interface {
+	Status() string
+	Products() string
+	PauseProduct(id int) error
+	ResumeProduct(id int) error
+	CheckProduct(id int) error
+}
+
+//actions notifiers that take commands can run on a product
+const (
+	ACTION_PAUSE  = "pause"
+	ACTION_RESUME = "resume"
+	ACTION_CHECK  = "check"
+)
+
+//Listener is a notifier that also takes commands. Listen runs until ctx is done
+type Listener interface {
+	Notifier
+	Listen(ctx context.Context, controller Controller)
+}
+
+//DeliveryError is a failed delivery that tells the dispatcher whether and when to retry it
+type DeliveryError struct {
+	Err   error
+	Retry bool
+	//RetryAfter is how long the receiver asked us to wait, 0 if it didn't
+	RetryAfter time.Duration
+}
+
+func (err *DeliveryError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *DeliveryError) Unwrap() error {
+	return err.Err
+}
+
+//ProductRoutes returns the notifiers a product's events are routed to in addition to the global ones
+type ProductRoutes func(productID int) []string
+
+//Dispatcher feeds the events of the bus to the configured notifiers, each with its own queue so a slow one doesn't
+//hold up the others
+type Dispatcher struct {
+	bus        *events.Bus
+	routes     ProductRoutes
+	rules      *rules
+	deadLetter *deadLetterLog
+	workers    []*worker
+
+	subscription *events.Subscription
+	stop         chan struct{}
+	wg           sync.WaitGroup
+
+	//controller is handed to the notifiers that take commands, they only listen if it is set
+	controller      Controller
+	stopListening   context.CancelFunc
+	listenersWaiter sync.WaitGroup
+}
+
+//worker delivers the events of a single notifier one at a time
+type worker struct {
+	name       string
+	notifier   Notifier
+	events     map[string]bool
+	perProduct bool
+	timeout    time.Duration
+	maxRetries int
+	queue      chan events.Event
+	//batcher is set if the notifier takes batches, it gets the events that come in within batchWindow of the first one
+	batcher     BatchNotifier
+	batchWindow time.Duration
+	//minSeverity is the level of the least severe events the notifier gets. Events below critical are held in held
+	//during quiet hours, unless the notifier ignores them
+	minSeverity      int
+	ignoreQuietHours bool
+	held             []events.Event
+}
+
+//NewDispatcher creates the configured notifiers and the rules that decide which events reach them. routes names the
+//per product notifiers of a product, failed deliveries are appended to the dead letter log at deadLetterPath
+func NewDispatcher(bus *events.Bus, configs []structs.NotifierConfig, rulesConfig structs.NotifyRulesConfig, routes ProductRoutes, deadLetterPath string) (*Dispatcher, error) {
+	eventRules, err := newRules(rulesConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid notification rules (%v)", err)
+	}
+	dispatcher := &Dispatcher{
+		bus:        bus,
+		routes:     routes,
+		rules:      eventRules,
+		deadLetter: newDeadLetterLog(deadLetterPath),
+		stop:       make(chan struct{}),
+	}
+
+	known := make(map[string]bool)
+	for _, eventType := range events.Types {
+		known[eventType] = true
+	}
+	names := make(map[string]bool)
+	for i, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("Notifier %v has no name", i+1)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("Notifier name %s is used twice", config.Name)
+		}
+		names[config.Name] = true
+
+		notifier, err := newNotifier(config)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid notifier %s (%v)", config.Name, err)
+		}
+
+		eventTypes := config.Events
+		if len(eventTypes) == 0 && config.Type == NOTIFIER_MQTT {
+			//the product states are kept up to date with every check
+			eventTypes = append([]string{events.EVENT_CHECK_FINISHED}, DefaultEvents...)
+		} else if len(eventTypes) == 0 {
+			eventTypes = DefaultEvents
+		}
+		w := &worker{
+			name:       config.Name,
+			notifier:   notifier,
+			events:     make(map[string]bool),
+			perProduct: config.PerProduct,
+			timeout:    time.Duration(config.Timeout) * time.Second,
+			maxRetries: config.MaxRetries,
+			queue:      make(chan events.Event, queueSize),
+			//mqtt keeps the states of machines up to date, there is nobody to wake up
+			ignoreQuietHours: config.IgnoreQuietHours || config.Type == NOTIFIER_MQTT,
+		}
+		if config.MinSeverity != "" {
+			level, ok := severityLevels[config.MinSeverity]
+			if !ok {
+				return nil, fmt.Errorf("Notifier %s has unknown min severity %s", config.Name, config.MinSeverity)
+			}
+			w.minSeverity = level
+		}
+		if batcher, ok := notifier.(BatchNotifier); ok {
+			w.batcher = batcher
+			w.batchWindow = time.Duration(config.BatchWindow) * time.Second
+			if config.BatchWindow == 0 {
+				w.batchWindow = defaultBatchWindow
+			}
+		}
+		for _, eventType := range eventTypes {
+			if !known[eventType] {
+				return nil, fmt.Errorf("Notifier %s has unknown event type %s", config.Name, eventType)
+			}
+			w.events[eventType] = true
+		}
+		if w.timeout <= 0 {
+			w.timeout = defaultTimeout
+		}
+		if config.MaxRetries == 0 {
+			w.maxRetries = defaultMaxRetries
+		} else if config.MaxRetries < 0 {
+			//-1 turns retries off
+			w.maxRetries = 0
+		}
+		dispatcher.workers = append(dispatcher.workers, w)
+	}
+
+	return dispatcher, nil
+}
+
+//newNotifier creates the notifier of the configured type
+func newNotifier(config structs.NotifierConfig) (Notifier, error) {
+	switch config.Type {
+	case NOTIFIER_WEBHOOK:
+		return newWebhook(config)
+	case NOTIFIER_DISCORD:
+		return newDiscord(config)
+	case NOTIFIER_SLACK:
+		return newSlack(config)
+	case NOTIFIER_EMAIL:
+		return newEmail(config)
+	case NOTIFIER_TELEGRAM:
+		return newTelegram(config)
+	case NOTIFIER_MQTT:
+		return newMQTT(config)
+	}
+	return nil, fmt.Errorf("Unknown notifier type %s", config.Type)
+}
+
+//Names returns the names of the configured notifiers
+func (dispatcher *Dispatcher) Names() []string {
+	names := make([]string, 0, len(dispatcher.workers))
+	for _, w := range dispatcher.workers {
+		names = append(names, w.name)
+	}
+	return names
+}
+
+//Test sends a test event straight to the named notifier, without retries or the dead letter log
+func (dispatcher *Dispatcher) Test(ctx context.Context, name string) error {
+	for _, w := range dispatcher.workers {
+		if w.name != name {
+			continue
+		}
+		event := events.Event{
+			Type: EVENT_TEST,
+			Time: time.Now(),
+			Data: map[string]interface{}{
+				"message": fmt.Sprintf("Notifier %s works", name),
+			},
+		}
+		if w.batcher != nil {
+			return w.batcher.NotifyBatch(ctx, []events.Event{event})
+		}
+		return w.notifier.Notify(ctx, event)
+	}
+	return ErrUnknownNotifier
+}
+
+//SetController lets the notifiers that take commands act on the bot. It has to be called before Start
+func (dispatcher *Dispatcher) SetController(controller Controller) {
+	dispatcher.controller = controller
+}
+
+//Start subscribes to the bus and starts delivering. Notifiers that take commands start listening for them
+func (dispatcher *Dispatcher) Start() {
+	if len(dispatcher.workers) == 0 {
+		return
+	}
+	dispatcher.subscription, _ = dispatcher.bus.Subscribe(events.Filter{}, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher.stopListening = cancel
+	for _, w := range dispatcher.workers {
+		listener, ok := w.notifier.(Listener)
+		if !ok || dispatcher.controller == nil {
+			continue
+		}
+		dispatcher.listenersWaiter.Add(1)
+		go func() {
+			defer dispatcher.listenersWaiter.Done()
+			listener.Listen(ctx, dispatcher.controller)
+		}()
+	}
+
+	for _, w := range dispatcher.workers {
+		dispatcher.wg.Add(1)
+		go dispatcher.deliver(w)
+	}
+	go dispatcher.route()
+}
+
+//Stop stops taking new events and waits for the queued ones to be delivered until ctx is done. Whatever is left then
+//goes to the dead letter log
+func (dispatcher *Dispatcher) Stop(ctx context.Context) {
+	if dispatcher.subscription == nil {
+		return
+	}
+	dispatcher.bus.Unsubscribe(dispatcher.subscription)
+	dispatcher.stopListening()
+
+	done := make(chan struct{})
+	go func() {
+		dispatcher.wg.Wait()
+		dispatcher.listenersWaiter.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(dispatcher.stop)
+		<-done
+	}
+}
+
+//route runs every event through the rules and hands it to the queues of the notifiers it is meant for
+func (dispatcher *Dispatcher) route() {
+	ticker := time.NewTicker(rulesInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-dispatcher.subscription.C:
+			if !ok {
+				dispatcher.closeQueues()
+				return
+			}
+			event, ok = dispatcher.rules.apply(event)
+			if ok {
+				dispatcher.dispatch(event)
+			}
+		case now := <-ticker.C:
+			dispatcher.rules.forget(now)
+			if !dispatcher.rules.quiet(now) {
+				for _, w := range dispatcher.workers {
+					dispatcher.release(w, 0)
+				}
+			}
+		}
+	}
+}
+
+//dispatch queues the event for the notifiers it is meant for, or holds it back for them during quiet hours
+func (dispatcher *Dispatcher) dispatch(event events.Event) {
+	severity := eventSeverity(event)
+	quiet := dispatcher.rules.quiet(time.Now())
+	var productRoutes map[string]bool
+	for _, w := range dispatcher.workers {
+		if !w.events[event.Type] || severity < w.minSeverity {
+			continue
+		}
+		if w.perProduct {
+			if event.ProductID == 0 {
+				continue
+			}
+			if productRoutes == nil {
+				productRoutes = make(map[string]bool)
+				if dispatcher.routes != nil {
+					for _, name := range dispatcher.routes(event.ProductID) {
+						productRoutes[name] = true
+					}
+				}
+			}
+			if !productRoutes[w.name] {
+				continue
+			}
+		}
+
+		if quiet && !w.ignoreQuietHours {
+			if severity < severityLevels[SEVERITY_CRITICAL] {
+				if len(w.held) >= queueSize {
+					dispatcher.deadLetter.add(w.name, event, 0, fmt.Errorf("Too many events held during quiet hours"))
+					continue
+				}
+				w.held = append(w.held, event)
+				continue
+			}
+			//what was held back about the product comes first, so it doesn't arrive after the news it is older than
+			if event.ProductID != 0 {
+				dispatcher.release(w, event.ProductID)
+			}
+		}
+		dispatcher.enqueue(w, event)
+	}
+}
+
+//release queues the events held back for the notifier, only those of the product if productID isn't 0
+func (dispatcher *Dispatcher) release(w *worker, productID int) {
+	if len(w.held) == 0 {
+		return
+	}
+	kept := w.held[:0]
+	released := 0
+	for _, event := range w.held {
+		if productID != 0 && event.ProductID != productID {
+			kept = append(kept, event)
+			continue
+		}
+		dispatcher.enqueue(w, event)
+		released++
+	}
+	w.held = kept
+	if productID == 0 {
+		helperfuncs.Log("Sending %v notification(s) held during quiet hours to notifier %s", released, w.name)
+	}
+}
+
+func (dispatcher *Dispatcher) enqueue(w *worker, event events.Event) {
+	select {
+	case w.queue <- event:
+	default:
+		dispatcher.deadLetter.add(w.name, event, 0, fmt.Errorf("Queue full"))
+	}
+}
+
+//closeQueues lets the notifiers finish once they delivered their queues. Events still held for quiet hours go to the dead letter log
+func (dispatcher *Dispatcher) closeQueues() {
+	for _, w := range dispatcher.workers {
+		for _, event := range w.held {
+			dispatcher.deadLetter.add(w.name, event, 0, fmt.Errorf("Shut down during quiet hours"))
+		}
+		w.held = nil
+		close(w.queue)
+	}
+}
+
+//deliver works off the notifier's queue until it is closed
+func (dispatcher *Dispatcher) deliver(w *worker) {
+	defer dispatcher.wg.Done()
+
+	for event := range w.queue {
+		batch := []events.Event{event}
+		if w.batcher != nil && w.batchWindow > 0 {
+			batch = dispatcher.collectBatch(w, batch)
+		}
+
+		select {
+		case <-dispatcher.stop:
+			for _, event := range batch {
+				dispatcher.deadLetter.add(w.name, event, 0, fmt.Errorf("Shut down before delivery"))
+			}
+			continue
+		default:
+		}
+
+		attempts, err := dispatcher.deliverWithRetries(w, batch)
+		if err != nil {
+			helperfuncs.Log("Failed to deliver %v event(s) starting with %s event %v to notifier %s after %v attempt(s) (%v)", len(batch), event.Type, event.ID, w.name, attempts, err)
+			for _, event := range batch {
+				dispatcher.deadLetter.add(w.name, event, attempts, err)
+			}
+		}
+	}
+}
+
+//collectBatch adds the events that come in within the batch window to the batch. A shutdown sends what was collected right away
+func (dispatcher *Dispatcher) collectBatch(w *worker, batch []events.Event) []events.Event {
+	timer := time.NewTimer(w.batchWindow)
+	defer timer.Stop()
+	for len(batch) < maxBatchSize {
+		select {
+		case event, ok := <-w.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, event)
+		case <-timer.C:
+			return batch
+		case <-dispatcher.stop:
+			return batch
+		}
+	}
+	return batch
+}
+
+//deliverWithRetries tries to deliver the events, backing off exponentially between attempts or as long as the receiver asks
+func (dispatcher *Dispatcher) deliverWithRetries(w *worker, batch []events.Event) (int, error) {
+	backoff := retryBackoffMin
+	attempt := 0
+	for {
+		attempt++
+		ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		var err error
+		if w.batcher != nil {
+			err = w.batcher.NotifyBatch(ctx, batch)
+		} else {
+			err = w.notifier.Notify(ctx, batch[0])
+		}
+		cancel()
+		if err == nil {
+			return attempt, nil
+		}
+
+		wait := backoff
+		if deliveryErr, ok := err.(*DeliveryError); ok {
+			if !deliveryErr.Retry {
+				return attempt, err
+			}
+			if deliveryErr.RetryAfter > wait {
+				wait = deliveryErr.RetryAfter
+			}
+		}
+		if attempt > w.maxRetries {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-dispatcher.stop:
+			timer.Stop()
+			return attempt, err
+		}
+		backoff *= 2
+		if backoff > retryBackoffMax {
+			backoff = retryBackoffMax
+		}
+	}
+}
+
+//productAction pauses, resumes or checks a product and describes the outcome
+func productAction(controller Controller, action string, id int) string {
+	var err error
+	var done string
+	switch action {
+	case ACTION_PAUSE:
+		err, done = controller.PauseProduct(id), "paused"
+	case ACTION_RESUME:
+		err, done = controller.ResumeProduct(id), "resumed"
+	case ACTION_CHECK:
+		err, done = controller.CheckProduct(id), "is being checked"
+	default:
+		return fmt.Sprintf("Unknown action %s", action)
+	}
+	if err != nil {
+		return fmt.Sprintf("Product %v: %v", id, err)
+	}
+	return fmt.Sprintf("Product %v %s", id, done)
+}
@@ -0,0 +1,224 @@
+package notify
+
+import (
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//severities of events, notifiers only get events of at least their min_severity
+const (
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_CRITICAL = "critical"
+)
+
+//defaultRepeatWindow is how long repeats are collapsed if repeat_window is not configured
+const defaultRepeatWindow = time.Minute
+
+var severityLevels = map[string]int{
+	SEVERITY_INFO:     0,
+	SEVERITY_WARNING:  1,
+	SEVERITY_CRITICAL: 2,
+}
+
+//eventSeverities are the severities of the event types that aren't just info
+var eventSeverities = map[string]string{
+	events.EVENT_IN_STOCK:          SEVERITY_CRITICAL,
+	events.EVENT_ORDER_PLACED:      SEVERITY_CRITICAL,
+	events.EVENT_SESSION_UNHEALTHY: SEVERITY_WARNING,
+	events.EVENT_TASK_RESTARTED:    SEVERITY_WARNING,
+}
+
+//repeatFields are the event types whose repeats are collapsed, with the data that tells a repeat from a new event
+//besides the product. Other types are never collapsed, in stock is already only let through when a product comes back
+var repeatFields = map[string][]string{
+	events.EVENT_PRICE_CHANGED:     {"price"},
+	events.EVENT_SESSION_UNHEALTHY: {"session_id", "state"},
+	events.EVENT_TASK_RESTARTED:    nil,
+}
+
+//eventSeverity returns the level of the event's severity
+func eventSeverity(event events.Event) int {
+	if event.Type == EVENT_TEST {
+		return severityLevels[SEVERITY_CRITICAL]
+	}
+	severity, ok := eventSeverities[event.Type]
+	if !ok {
+		severity = SEVERITY_INFO
+	}
+	return severityLevels[severity]
+}
+
+//rules decide which events of the bus reach the notifiers. A product's stock is only announced when it changes,
+//repeats within the repeat window are collapsed into the first one and products that stay in stock for long are
+//announced again
+type rules struct {
+	repeatWindow  time.Duration
+	escalateAfter time.Duration
+	quietHours    *quietHours
+
+	mutex sync.Mutex
+	//inStock holds since when the notifiers were told a product is in stock, escalated the products that were
+	//announced again since then
+	inStock   map[int]time.Time
+	escalated map[int]bool
+	//repeats holds when an event was last let through and how many repeats were collapsed since then
+	repeats map[string]*repeat
+}
+
+type repeat struct {
+	sent      time.Time
+	collapsed int
+}
+
+func newRules(config structs.NotifyRulesConfig) (*rules, error) {
+	r := &rules{
+		repeatWindow:  time.Duration(config.RepeatWindow) * time.Second,
+		escalateAfter: time.Duration(config.EscalateAfter) * time.Minute,
+		inStock:       make(map[int]time.Time),
+		escalated:     make(map[int]bool),
+		repeats:       make(map[string]*repeat),
+	}
+	if config.RepeatWindow == 0 {
+		r.repeatWindow = defaultRepeatWindow
+	} else if config.RepeatWindow < 0 {
+		//-1 turns collapsing off
+		r.repeatWindow = 0
+	}
+	if config.QuietHoursStart != "" || config.QuietHoursEnd != "" {
+		quiet, err := parseQuietHours(config.QuietHoursStart, config.QuietHoursEnd)
+		if err != nil {
+			return nil, err
+		}
+		r.quietHours = quiet
+	}
+	return r, nil
+}
+
+//apply returns the event as the notifiers should get it and false if it is held back
+func (r *rules) apply(event events.Event) (events.Event, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch event.Type {
+	case events.EVENT_IN_STOCK:
+		if since, ok := r.inStock[event.ProductID]; ok {
+			//in stock is published on every check that finds the product, only its first one or an escalation goes out
+			if r.escalateAfter <= 0 || r.escalated[event.ProductID] || event.Time.Sub(since) < r.escalateAfter {
+				return event, false
+			}
+			r.escalated[event.ProductID] = true
+			return escalate(event, since), true
+		}
+	case events.EVENT_OUT_OF_STOCK:
+		if _, ok := r.inStock[event.ProductID]; !ok {
+			//no in stock event went out before it, so the notifiers still think it's sold out
+			return event, false
+		}
+		delete(r.inStock, event.ProductID)
+		delete(r.escalated, event.ProductID)
+		return event, true
+	}
+
+	event, ok := r.collapse(event)
+	if ok && event.Type == events.EVENT_IN_STOCK {
+		r.inStock[event.ProductID] = event.Time
+	}
+	return event, ok
+}
+
+//collapse holds back repeats of an event within the repeat window. The first event after the window says how many were collapsed
+func (r *rules) collapse(event events.Event) (events.Event, bool) {
+	fields, ok := repeatFields[event.Type]
+	if !ok || r.repeatWindow <= 0 {
+		return event, true
+	}
+	key := fmt.Sprintf("%s/%d", event.Type, event.ProductID)
+	for _, field := range fields {
+		key += fmt.Sprintf("/%v", event.Data[field])
+	}
+
+	last, ok := r.repeats[key]
+	if ok && event.Time.Sub(last.sent) < r.repeatWindow {
+		last.collapsed++
+		return event, false
+	}
+	if ok && last.collapsed > 0 {
+		event = withData(event, map[string]interface{}{"repeats": last.collapsed})
+	}
+	r.repeats[key] = &repeat{sent: event.Time}
+	return event, true
+}
+
+//forget drops what is remembered about repeats that are past the repeat window
+func (r *rules) forget(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, last := range r.repeats {
+		if now.Sub(last.sent) >= r.repeatWindow {
+			delete(r.repeats, key)
+		}
+	}
+}
+
+//quiet reports whether non-critical events are held back at t
+func (r *rules) quiet(t time.Time) bool {
+	return r.quietHours != nil && r.quietHours.contains(t)
+}
+
+//escalate turns an in stock event into the announcement that the product is still in stock
+func escalate(event events.Event, since time.Time) events.Event {
+	return withData(event, map[string]interface{}{
+		"escalated":    true,
+		"in_stock_for": event.Time.Sub(since).Round(time.Second).String(),
+	})
+}
+
+//withData returns a copy of the event with more data. The bus hands the same data to all subscribers, so it must not be changed
+func withData(event events.Event, data map[string]interface{}) events.Event {
+	merged := make(map[string]interface{}, len(event.Data)+len(data))
+	for key, value := range event.Data {
+		merged[key] = value
+	}
+	for key, value := range data {
+		merged[key] = value
+	}
+	event.Data = merged
+	return event
+}
+
+//quietHours is a daily span of local time, it wraps around midnight if it ends before it starts
+type quietHours struct {
+	start int
+	end   int
+}
+
+func parseQuietHours(start string, end string) (*quietHours, error) {
+	startTime, err := time.Parse("15:04", start)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid quiet hours start %s (%v)", start, err)
+	}
+	endTime, err := time.Parse("15:04", end)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid quiet hours end %s (%v)", end, err)
+	}
+	quiet := &quietHours{
+		start: startTime.Hour()*60 + startTime.Minute(),
+		end:   endTime.Hour()*60 + endTime.Minute(),
+	}
+	if quiet.start == quiet.end {
+		return nil, fmt.Errorf("Quiet hours start and end at %s", start)
+	}
+	return quiet, nil
+}
+
+func (quiet *quietHours) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if quiet.start < quiet.end {
+		return minute >= quiet.start && minute < quiet.end
+	}
+	return minute >= quiet.start || minute < quiet.end
+}
@@ -0,0 +1,152 @@
+package notify
+
+import (
+	"context"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/structs"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	//slackMessageInterval is how often Slack lets an incoming webhook post, bursts are throttled
+	slackMessageInterval = time.Second
+	//slackHeaderLength is the longest header Slack accepts
+	slackHeaderLength = 150
+)
+
+//slack posts events as Block Kit messages to a Slack channel's incoming webhook. Incoming webhooks can't upload files,
+//screenshots are only shown if they are published under the notifier's screenshot_url
+type slack struct {
+	url           string
+	screenshotURL string
+	client        *httpclient.Client
+	gate          rateGate
+}
+
+type slackPayload struct {
+	//Text is shown where blocks can't be, e.g. in push notifications
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string        `json:"type"`
+	Text     *slackText    `json:"text,omitempty"`
+	Fields   []slackText   `json:"fields,omitempty"`
+	Elements []interface{} `json:"elements,omitempty"`
+	ImageURL string        `json:"image_url,omitempty"`
+	AltText  string        `json:"alt_text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackButton struct {
+	Type string    `json:"type"`
+	Text slackText `json:"text"`
+	URL  string    `json:"url"`
+}
+
+func newSlack(config structs.NotifierConfig) (*slack, error) {
+	client, err := newHTTPClient(config.URL, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if config.ScreenshotURL != "" {
+		parsedURL, err := url.Parse(config.ScreenshotURL)
+		if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+			return nil, fmt.Errorf("Invalid screenshot URL %s", config.ScreenshotURL)
+		}
+	}
+	return &slack{
+		url:           config.URL,
+		screenshotURL: strings.TrimSuffix(config.ScreenshotURL, "/"),
+		client:        client,
+	}, nil
+}
+
+func (hook *slack) Notify(ctx context.Context, event events.Event) error {
+	msg := newMessage(event)
+	payload := slackPayload{
+		Text: msg.title,
+		Blocks: []slackBlock{{
+			Type: "header",
+			Text: &slackText{Type: "plain_text", Text: truncate(msg.title, slackHeaderLength)},
+		}},
+	}
+
+	fields := make([]slackText, 0)
+	addField := func(name, value string) {
+		if value != "" {
+			fields = append(fields, slackText{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%s", name, slackEscape(value))})
+		}
+	}
+	addField("Product", msg.product)
+	addField("Marketplace", msg.webshop)
+	addField("Price", msg.price)
+	addField("Old price", msg.oldPrice)
+	addField("Seller", msg.seller)
+	for _, field := range msg.fields {
+		addField(field.name, field.value)
+	}
+	//sections take at most 10 fields
+	for len(fields) > 0 {
+		count := len(fields)
+		if count > 10 {
+			count = 10
+		}
+		payload.Blocks = append(payload.Blocks, slackBlock{Type: "section", Fields: fields[:count]})
+		fields = fields[count:]
+	}
+
+	if msg.url != "" {
+		payload.Blocks = append(payload.Blocks, slackBlock{
+			Type: "actions",
+			Elements: []interface{}{slackButton{
+				Type: "button",
+				Text: slackText{Type: "plain_text", Text: "Open offer"},
+				URL:  msg.url,
+			}},
+		})
+	}
+	if msg.screenshot != "" && hook.screenshotURL != "" {
+		payload.Blocks = append(payload.Blocks, slackBlock{
+			Type:     "image",
+			ImageURL: hook.screenshotURL + "/" + url.PathEscape(filepath.Base(msg.screenshot)),
+			AltText:  "Screenshot of " + msg.product,
+		})
+	}
+	if !msg.time.IsZero() {
+		payload.Blocks = append(payload.Blocks, slackBlock{
+			Type:     "context",
+			Elements: []interface{}{slackText{Type: "mrkdwn", Text: msg.time.Format("2006-01-02 15:04:05")}},
+		})
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return &DeliveryError{Err: fmt.Errorf("Failed to encode slack message (%v)", err)}
+	}
+
+	err = hook.gate.wait(ctx)
+	if err != nil {
+		return err
+	}
+	err = postJSON(ctx, hook.client, hook.url, body, http.Header{})
+	hook.gate.holdUntil(time.Now().Add(slackMessageInterval))
+	return err
+}
+
+//slackEscape escapes the characters Slack's mrkdwn treats as control characters
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
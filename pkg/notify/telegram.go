@@ -0,0 +1,393 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/structs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DefaultTelegramAPIURL is the Bot API the telegram notifier talks to if api_url is not configured
+const DefaultTelegramAPIURL = "https://api.telegram.org"
+
+const (
+	//telegramPollTimeout is how long a getUpdates call waits for updates before it returns empty
+	telegramPollTimeout = 30 * time.Second
+	//telegramPollBackoff is how long polling pauses after a failed getUpdates
+	telegramPollBackoff = 5 * time.Second
+	//telegramMessageInterval spaces the messages to a chat, Telegram throttles bursts
+	telegramMessageInterval = time.Second
+	//telegramStaleCommand is how long before the bot started a command may have been sent, older ones are ignored
+	telegramStaleCommand = time.Minute
+	//telegramMaxText, telegramMaxCaption and telegramMaxCallbackAnswer are the longest message, photo caption and
+	//button answer Telegram accepts
+	telegramMaxText           = 4000
+	telegramMaxCaption        = 1000
+	telegramMaxCallbackAnswer = 200
+	//telegramMaxResponseSize caps what we read of the Bot API's answers
+	telegramMaxResponseSize = 1 << 20
+)
+
+//telegramHelp answers /help and /start
+const telegramHelp = `/status - tasks, stock check workers and checkout sessions
+/products - products and their stock
+/pause <id> - pause a product
+/resume <id> - resume a product
+/check <id> - check a product now`
+
+//telegram sends events to a Telegram chat through a bot and takes commands from that chat. Alerts carry inline buttons
+//to open the offer, pause the product and check it right away, their callback data is "<action>:<product ID>"
+type telegram struct {
+	token  string
+	chatID int64
+	apiURL string
+	client *httpclient.Client
+	//pollClient waits longer than the long polling of getUpdates
+	pollClient *httpclient.Client
+	gate       rateGate
+}
+
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description"`
+	ErrorCode   int             `json:"error_code"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+type telegramUpdate struct {
+	UpdateID      int                    `json:"update_id"`
+	Message       *telegramMessage       `json:"message"`
+	CallbackQuery *telegramCallbackQuery `json:"callback_query"`
+}
+
+type telegramMessage struct {
+	MessageID int          `json:"message_id"`
+	Date      int64        `json:"date"`
+	Chat      telegramChat `json:"chat"`
+	Text      string       `json:"text"`
+}
+
+type telegramChat struct {
+	ID int64 `json:"id"`
+}
+
+type telegramCallbackQuery struct {
+	ID      string           `json:"id"`
+	Message *telegramMessage `json:"message"`
+	Data    string           `json:"data"`
+}
+
+type telegramKeyboard struct {
+	InlineKeyboard [][]telegramButton `json:"inline_keyboard"`
+}
+
+type telegramButton struct {
+	Text         string `json:"text"`
+	URL          string `json:"url,omitempty"`
+	CallbackData string `json:"callback_data,omitempty"`
+}
+
+func newTelegram(config structs.NotifierConfig) (*telegram, error) {
+	if config.Telegram == nil || config.Telegram.Token == "" {
+		return nil, fmt.Errorf("No bot token configured")
+	}
+	if config.Telegram.ChatID == 0 {
+		return nil, fmt.Errorf("No chat ID configured")
+	}
+	apiURL := strings.TrimSuffix(config.Telegram.APIURL, "/")
+	if apiURL == "" {
+		apiURL = DefaultTelegramAPIURL
+	}
+
+	client, err := newHTTPClient(apiURL, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	pollClient, err := httpclient.New(httpclient.Options{
+		Timeout:     telegramPollTimeout + 15*time.Second,
+		MaxBodySize: telegramMaxResponseSize,
+		Unlimited:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &telegram{
+		token:      config.Telegram.Token,
+		chatID:     config.Telegram.ChatID,
+		apiURL:     apiURL,
+		client:     client,
+		pollClient: pollClient,
+	}, nil
+}
+
+func (bot *telegram) Notify(ctx context.Context, event events.Event) error {
+	msg := newMessage(event)
+
+	lines := []string{msg.title}
+	addLine := func(name, value string) {
+		if value != "" {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	addLine("Marketplace", msg.webshop)
+	if msg.oldPrice != "" {
+		addLine("Price", msg.price+" (was "+msg.oldPrice+")")
+	} else {
+		addLine("Price", msg.price)
+	}
+	addLine("Seller", msg.seller)
+	for _, field := range msg.fields {
+		addLine(field.name, field.value)
+	}
+	text := strings.Join(lines, "\n")
+
+	keyboard := telegramKeyboard{InlineKeyboard: make([][]telegramButton, 0)}
+	if msg.url != "" {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []telegramButton{{Text: "Open offer", URL: msg.url}})
+	}
+	if event.ProductID != 0 && event.Type != EVENT_TEST {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []telegramButton{
+			{Text: "Pause product", CallbackData: fmt.Sprintf("%s:%d", ACTION_PAUSE, event.ProductID)},
+			{Text: "Check now", CallbackData: fmt.Sprintf("%s:%d", ACTION_CHECK, event.ProductID)},
+		})
+	}
+	replyMarkup, err := json.Marshal(keyboard)
+	if err != nil {
+		return &DeliveryError{Err: fmt.Errorf("Failed to encode buttons (%v)", err)}
+	}
+
+	err = bot.gate.wait(ctx)
+	if err != nil {
+		return err
+	}
+	defer bot.gate.holdUntil(time.Now().Add(telegramMessageInterval))
+
+	if msg.screenshot != "" {
+		photo, readErr := os.ReadFile(msg.screenshot)
+		if readErr == nil {
+			return bot.sendPhoto(ctx, truncate(text, telegramMaxCaption), string(replyMarkup), filepath.Base(msg.screenshot), photo)
+		}
+	}
+	return bot.sendMessage(ctx, bot.chatID, text, string(replyMarkup))
+}
+
+func (bot *telegram) sendMessage(ctx context.Context, chatID int64, text string, replyMarkup string) error {
+	fields := url.Values{
+		"chat_id":                  {strconv.FormatInt(chatID, 10)},
+		"text":                     {truncate(text, telegramMaxText)},
+		"disable_web_page_preview": {"true"},
+	}
+	if replyMarkup != "" {
+		fields.Set("reply_markup", replyMarkup)
+	}
+	_, err := bot.call(ctx, bot.client, "sendMessage", []byte(fields.Encode()), "application/x-www-form-urlencoded")
+	return err
+}
+
+//sendPhoto uploads the photo with the text as its caption
+func (bot *telegram) sendPhoto(ctx context.Context, caption string, replyMarkup string, fileName string, photo []byte) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	err := writer.WriteField("chat_id", strconv.FormatInt(bot.chatID, 10))
+	if err == nil {
+		err = writer.WriteField("caption", caption)
+	}
+	if err == nil {
+		err = writer.WriteField("reply_markup", replyMarkup)
+	}
+	if err == nil {
+		var part io.Writer
+		part, err = writer.CreateFormFile("photo", fileName)
+		if err == nil {
+			_, err = part.Write(photo)
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return &DeliveryError{Err: fmt.Errorf("Failed to write photo message (%v)", err)}
+	}
+
+	_, err = bot.call(ctx, bot.client, "sendPhoto", body.Bytes(), writer.FormDataContentType())
+	return err
+}
+
+//call calls a Bot API method. Errors never contain the bot's token, it is part of the URL
+func (bot *telegram) call(ctx context.Context, client *httpclient.Client, method string, body []byte, contentType string) (json.RawMessage, error) {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Accept", "application/json")
+	header.Set("User-Agent", userAgent)
+
+	methodURL := bot.apiURL + "/bot" + bot.token + "/" + method
+	resp, err := client.Do(ctx, "POST", methodURL, bytes.NewReader(body), header)
+	var answer []byte
+	if resp != nil {
+		answer = resp.Body
+	}
+	statusErr := httpclient.AsStatusError(err)
+	if statusErr != nil {
+		answer = statusErr.Body
+	} else if err != nil {
+		return nil, &DeliveryError{Err: bot.hideToken(err), Retry: true}
+	}
+
+	parsed := telegramResponse{}
+	parseErr := json.Unmarshal(answer, &parsed)
+	if parseErr != nil && statusErr == nil {
+		return nil, &DeliveryError{Err: fmt.Errorf("Failed to parse %s answer (%v)", method, parseErr)}
+	}
+	if statusErr == nil && parsed.OK {
+		return parsed.Result, nil
+	}
+
+	description := parsed.Description
+	if description == "" && statusErr != nil {
+		description = statusErr.Status
+	}
+	deliveryErr := &DeliveryError{Err: fmt.Errorf("%s failed (%s)", method, description)}
+	if statusErr != nil {
+		deliveryErr.Retry = statusErr.Throttled() || statusErr.StatusCode >= 500
+	}
+	if parsed.Parameters.RetryAfter > 0 {
+		deliveryErr.Retry = true
+		deliveryErr.RetryAfter = time.Duration(parsed.Parameters.RetryAfter) * time.Second
+		bot.gate.holdUntil(time.Now().Add(deliveryErr.RetryAfter))
+	}
+	return nil, deliveryErr
+}
+
+func (bot *telegram) hideToken(err error) error {
+	return errors.New(strings.ReplaceAll(err.Error(), bot.token, "<token>"))
+}
+
+//Listen long polls the Bot API for commands and button presses until ctx is done
+func (bot *telegram) Listen(ctx context.Context, controller Controller) {
+	started := time.Now()
+	offset := 0
+	for ctx.Err() == nil {
+		fields := url.Values{
+			"offset":          {strconv.Itoa(offset)},
+			"timeout":         {strconv.Itoa(int(telegramPollTimeout.Seconds()))},
+			"allowed_updates": {`["message","callback_query"]`},
+		}
+		result, err := bot.call(ctx, bot.pollClient, "getUpdates", []byte(fields.Encode()), "application/x-www-form-urlencoded")
+		updates := make([]telegramUpdate, 0)
+		if err == nil {
+			err = json.Unmarshal(result, &updates)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			helperfuncs.Log("Failed to get telegram updates (%v)", err)
+			wait := telegramPollBackoff
+			var deliveryErr *DeliveryError
+			if errors.As(err, &deliveryErr) && deliveryErr.RetryAfter > wait {
+				wait = deliveryErr.RetryAfter
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			switch {
+			case update.Message != nil:
+				if time.Unix(update.Message.Date, 0).Before(started.Add(-telegramStaleCommand)) {
+					continue
+				}
+				bot.handleCommand(ctx, controller, update.Message)
+			case update.CallbackQuery != nil:
+				bot.handleCallback(ctx, controller, update.CallbackQuery)
+			}
+		}
+	}
+}
+
+//handleCommand answers a command sent to the bot in its chat, messages from other chats are ignored
+func (bot *telegram) handleCommand(ctx context.Context, controller Controller, message *telegramMessage) {
+	if message.Chat.ID != bot.chatID || !strings.HasPrefix(message.Text, "/") {
+		return
+	}
+	args := strings.Fields(message.Text)
+	//in groups commands may be addressed to a bot, /status@dolos_bot
+	command := strings.ToLower(strings.SplitN(args[0], "@", 2)[0])
+	args = args[1:]
+
+	var answer string
+	switch command {
+	case "/start", "/help":
+		answer = telegramHelp
+	case "/status":
+		answer = controller.Status()
+	case "/products":
+		answer = controller.Products()
+	case "/pause", "/resume", "/check":
+		if len(args) != 1 {
+			answer = fmt.Sprintf("Usage: %s <product id>", command)
+			break
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil || id < 1 {
+			answer = fmt.Sprintf("Invalid product ID %s", args[0])
+			break
+		}
+		answer = productAction(controller, strings.TrimPrefix(command, "/"), id)
+	default:
+		answer = "Unknown command, see /help"
+	}
+
+	err := bot.sendMessage(ctx, message.Chat.ID, answer, "")
+	if err != nil {
+		helperfuncs.Log("Failed to answer telegram command %s (%v)", command, err)
+	}
+}
+
+//handleCallback runs the action of an inline button pressed in the bot's chat
+func (bot *telegram) handleCallback(ctx context.Context, controller Controller, query *telegramCallbackQuery) {
+	answer := "Not allowed in this chat"
+	if query.Message != nil && query.Message.Chat.ID == bot.chatID {
+		parts := strings.SplitN(query.Data, ":", 2)
+		id := 0
+		if len(parts) == 2 {
+			id, _ = strconv.Atoi(parts[1])
+		}
+		if id < 1 {
+			answer = "Unknown button"
+		} else {
+			answer = productAction(controller, parts[0], id)
+		}
+	}
+
+	fields := url.Values{
+		"callback_query_id": {query.ID},
+		"text":              {truncate(answer, telegramMaxCallbackAnswer)},
+	}
+	_, err := bot.call(ctx, bot.client, "answerCallbackQuery", []byte(fields.Encode()), "application/x-www-form-urlencoded")
+	if err != nil {
+		helperfuncs.Log("Failed to answer telegram button %s (%v)", query.Data, err)
+	}
+}
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/structs"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	//maxResponseSize caps what we read of a receiver's answer, we only look at its status
+	maxResponseSize = 64 << 10
+	//maxAnswerInError is how much of a receiver's error answer ends up in the error
+	maxAnswerInError = 200
+)
+
+//userAgent identifies our requests to receivers
+const userAgent = "dolos-notify/1"
+
+//webhook posts every event as json to a URL. If a secret is configured, the body is signed so the receiver can tell
+//the request came from us
+type webhook struct {
+	url    string
+	secret []byte
+	client *httpclient.Client
+}
+
+func newWebhook(config structs.NotifierConfig) (*webhook, error) {
+	client, err := newHTTPClient(config.URL, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook{
+		url:    config.URL,
+		secret: []byte(config.Secret),
+		client: client,
+	}, nil
+}
+
+//newHTTPClient checks the receiver's URL and creates a client for it. Notifications are not rate limited like the
+//webshops, their retries back off on their own
+func newHTTPClient(rawURL string, timeoutSeconds int) (*httpclient.Client, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return nil, fmt.Errorf("Invalid URL %s", rawURL)
+	}
+	timeout := defaultTimeout
+	if timeoutSeconds > 0 {
+		timeout = time.Duration(timeoutSeconds) * time.Second
+	}
+	return httpclient.New(httpclient.Options{
+		Timeout:     timeout,
+		MaxBodySize: maxResponseSize,
+		Unlimited:   true,
+	})
+}
+
+func (hook *webhook) Notify(ctx context.Context, event events.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return &DeliveryError{Err: fmt.Errorf("Failed to encode event %v (%v)", event.ID, err)}
+	}
+
+	header := http.Header{}
+	header.Set("X-Dolos-Event", event.Type)
+	header.Set("X-Dolos-Delivery", strconv.FormatUint(event.ID, 10))
+	if len(hook.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set("X-Dolos-Timestamp", timestamp)
+		header.Set("X-Dolos-Signature", "sha256="+sign(hook.secret, timestamp, body))
+	}
+
+	return postJSON(ctx, hook.client, hook.url, body, header)
+}
+
+//sign returns the hex encoded HMAC-SHA256 of "timestamp.body". Signing the timestamp lets receivers reject replayed requests
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//postJSON posts the json body, see post
+func postJSON(ctx context.Context, client *httpclient.Client, rawURL string, body []byte, header http.Header) error {
+	header.Set("Content-Type", "application/json")
+	_, err := post(ctx, client, rawURL, body, header)
+	return err
+}
+
+//post posts the body and tells the dispatcher whether a failure is worth retrying: network errors, 5xx and
+//throttled requests are, other 4xx answers are not. The header has to carry the body's content type
+func post(ctx context.Context, client *httpclient.Client, rawURL string, body []byte, header http.Header) (*httpclient.Response, error) {
+	header.Set("Accept", "application/json")
+	header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(ctx, "POST", rawURL, bytes.NewReader(body), header)
+	if err == nil {
+		return resp, nil
+	}
+
+	if statusErr := httpclient.AsStatusError(err); statusErr != nil {
+		answer := bytes.TrimSpace(statusErr.Body)
+		if len(answer) > maxAnswerInError {
+			answer = answer[:maxAnswerInError]
+		}
+		deliveryErr := &DeliveryError{
+			Err:   fmt.Errorf("%v (%s)", statusErr, answer),
+			Retry: statusErr.Throttled() || statusErr.StatusCode >= 500,
+		}
+		if retryAfter, ok := statusErr.RetryAfter(); ok {
+			deliveryErr.RetryAfter = retryAfter
+		}
+		return nil, deliveryErr
+	}
+	if _, ok := err.(*httpclient.BodyTooLargeError); ok {
+		//we can't tell what the receiver made of it, sending it again could deliver it twice
+		return nil, &DeliveryError{Err: err}
+	}
+	return nil, &DeliveryError{Err: err, Retry: true}
+}
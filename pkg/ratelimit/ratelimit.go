@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Limiter is a token bucket per host. Every host gets the same budget unless it has its own rate
+type Limiter struct {
+	mutex sync.Mutex
+	//defaultRate is the budget in requests per minute of hosts without their own rate, 0 means unlimited
+	defaultRate int
+	rates       map[string]int
+	buckets     map[string]*bucket
+}
+
+type bucket struct {
+	perMinute int
+	//tokens goes below zero when requests are waiting for their turn
+	tokens  float64
+	updated time.Time
+	waiting int
+	spent   int
+}
+
+//HostState is the current state of a host's bucket
+type HostState struct {
+	Host      string  `json:"host"`
+	PerMinute int     `json:"per_minute"`
+	Tokens    float64 `json:"tokens"`
+	Waiting   int     `json:"waiting"`
+	Requests  int     `json:"requests"`
+}
+
+//shared is the limiter used by all stock checks and HTTP requests of this process
+var shared = New(0, nil)
+
+//New creates a limiter. rates holds requests per minute per host, defaultRate applies to all other hosts (0 means unlimited)
+func New(defaultRate int, rates map[string]int) *Limiter {
+	limiter := &Limiter{
+		buckets: make(map[string]*bucket),
+	}
+	limiter.Configure(defaultRate, rates)
+	return limiter
+}
+
+//Configure replaces the rates of the shared limiter
+func Configure(defaultRate int, rates map[string]int) {
+	shared.Configure(defaultRate, rates)
+}
+
+//Wait blocks until the shared limiter allows a request to host
+func Wait(ctx context.Context, host string) error {
+	return shared.Wait(ctx, host)
+}
+
+//Spend counts a request to host against the shared limiter without waiting
+func Spend(host string) {
+	shared.Spend(host)
+}
+
+//States returns the state of every host the shared limiter has seen
+func States() []HostState {
+	return shared.States()
+}
+
+//Configure replaces the rates. Buckets keep their tokens, so a running process can be reconfigured
+func (limiter *Limiter) Configure(defaultRate int, rates map[string]int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.defaultRate = defaultRate
+	limiter.rates = make(map[string]int)
+	for host, perMinute := range rates {
+		limiter.rates[normalizeHost(host)] = perMinute
+	}
+	for host, hostBucket := range limiter.buckets {
+		hostBucket.perMinute = limiter.rateOf(host)
+	}
+}
+
+//Wait blocks until a request to host is allowed or ctx is done. Waiting requests are served in order
+func (limiter *Limiter) Wait(ctx context.Context, host string) error {
+	limiter.mutex.Lock()
+	hostBucket := limiter.bucketOf(normalizeHost(host))
+	if hostBucket.perMinute <= 0 {
+		hostBucket.spent++
+		limiter.mutex.Unlock()
+		return nil
+	}
+
+	//reserve a token, if there is none yet we wait until the bucket has refilled up to our reservation
+	hostBucket.refill()
+	hostBucket.tokens--
+	hostBucket.spent++
+	wait := time.Duration(0)
+	if hostBucket.tokens < 0 {
+		wait = time.Duration(-hostBucket.tokens * float64(time.Minute) / float64(hostBucket.perMinute))
+	}
+	if wait == 0 {
+		limiter.mutex.Unlock()
+		return nil
+	}
+	hostBucket.waiting++
+	limiter.mutex.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		limiter.mutex.Lock()
+		hostBucket.waiting--
+		limiter.mutex.Unlock()
+		return nil
+	case <-ctx.Done():
+		//give the reservation back
+		limiter.mutex.Lock()
+		hostBucket.waiting--
+		hostBucket.tokens++
+		hostBucket.spent--
+		limiter.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+//Spend counts a request to host without waiting for it, for requests that must not be delayed (e.g. checkouts).
+//Requests waiting afterwards are delayed accordingly
+func (limiter *Limiter) Spend(host string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	hostBucket := limiter.bucketOf(normalizeHost(host))
+	hostBucket.spent++
+	if hostBucket.perMinute <= 0 {
+		return
+	}
+	hostBucket.refill()
+	hostBucket.tokens--
+}
+
+//States returns the state of every host the limiter has seen
+func (limiter *Limiter) States() []HostState {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	states := make([]HostState, 0, len(limiter.buckets))
+	for host, hostBucket := range limiter.buckets {
+		if hostBucket.perMinute > 0 {
+			hostBucket.refill()
+		}
+		states = append(states, HostState{
+			Host:      host,
+			PerMinute: hostBucket.perMinute,
+			Tokens:    hostBucket.tokens,
+			Waiting:   hostBucket.waiting,
+			Requests:  hostBucket.spent,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Host < states[j].Host
+	})
+	return states
+}
+
+//bucketOf returns the bucket of a normalized host, creating it full. The caller holds the mutex
+func (limiter *Limiter) bucketOf(host string) *bucket {
+	hostBucket, ok := limiter.buckets[host]
+	if !ok {
+		hostBucket = &bucket{
+			perMinute: limiter.rateOf(host),
+			tokens:    1,
+			updated:   time.Now(),
+		}
+		limiter.buckets[host] = hostBucket
+	}
+	return hostBucket
+}
+
+func (limiter *Limiter) rateOf(host string) int {
+	if perMinute, ok := limiter.rates[host]; ok {
+		return perMinute
+	}
+	return limiter.defaultRate
+}
+
+//refill adds the tokens earned since the last update. The bucket holds at most one token so requests are spread evenly
+func (hostBucket *bucket) refill() {
+	now := time.Now()
+	hostBucket.tokens += now.Sub(hostBucket.updated).Minutes() * float64(hostBucket.perMinute)
+	if hostBucket.tokens > 1 {
+		hostBucket.tokens = 1
+	}
+	hostBucket.updated = now
+}
+
+//normalizeHost makes www.amazon.de and amazon.de share a bucket
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if i := strings.LastIndex(host, ":"); i > -1 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.TrimPrefix(host, "www.")
+}
@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//cronExpression is a parsed 5 field cron expression: minute hour day-of-month month day-of-week
+type cronExpression struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek uint64
+	//domAny and dowAny are set when the field is "*", since cron matches either day field if both are restricted
+	domAny, dowAny bool
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+//parseCron parses a cron expression like "*/5 9-11 * * thu"
+func parseCron(expression string) (*cronExpression, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression %s must have 5 fields", expression)
+	}
+
+	cron := &cronExpression{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	var err error
+	if cron.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("Invalid minute field of %s (%v)", expression, err)
+	}
+	if cron.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("Invalid hour field of %s (%v)", expression, err)
+	}
+	if cron.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("Invalid day of month field of %s (%v)", expression, err)
+	}
+	if cron.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("Invalid month field of %s (%v)", expression, err)
+	}
+	if cron.daysOfWeek, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("Invalid day of week field of %s (%v)", expression, err)
+	}
+	//7 is sunday as well
+	if cron.daysOfWeek&(1<<7) != 0 {
+		cron.daysOfWeek |= 1
+	}
+
+	return cron, nil
+}
+
+//parseCronField parses a comma separated list of values, ranges and steps (e.g. "1,5-10,*/15") into a bit set
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i > -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("Invalid step %s", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = parseCronValue(bounds[0], names)
+			if err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = parseCronValue(bounds[1], names)
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				//"5/15" means from 5 to the end in steps of 15
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("Range %s is outside of %v-%v", part, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if named, ok := names[strings.ToLower(value)]; ok {
+		return named, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value %s", value)
+	}
+	return number, nil
+}
+
+//matches reports whether the expression matches the minute t falls in
+func (cron *cronExpression) matches(t time.Time) bool {
+	if cron.minutes&(1<<uint(t.Minute())) == 0 || cron.hours&(1<<uint(t.Hour())) == 0 || cron.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	domMatch := cron.daysOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := cron.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if cron.domAny || cron.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,163 @@
+package scheduler
+
+import (
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"strings"
+	"time"
+	//embeds the zoneinfo database, Windows machines without Go installed have none for LoadLocation
+	_ "time/tzdata"
+)
+
+//maxPauseLookahead bounds how far NextActive looks for the end of a pause
+const maxPauseLookahead = 8 * 24 * time.Hour
+
+//Plan decides a product's check interval at any time from its schedule rules. The first active rule wins,
+//the default interval applies when none is
+type Plan struct {
+	location        *time.Location
+	rules           []planRule
+	defaultInterval time.Duration
+}
+
+type planRule struct {
+	cron *cronExpression
+	//window is used instead of cron for weekday/time window rules
+	days     [7]bool
+	from, to int
+	interval time.Duration
+	paused   bool
+}
+
+//NewPlan compiles a product's schedule rules. timezone is an IANA name (e.g. "Europe/Berlin") and defaults to local time
+func NewPlan(rules []structs.ScheduleRule, timezone string, defaultInterval time.Duration) (*Plan, error) {
+	location := time.Local
+	if timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown timezone %s (%v)", timezone, err)
+		}
+	}
+
+	plan := &Plan{
+		location:        location,
+		defaultInterval: defaultInterval,
+	}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule rule %v (%v)", i+1, err)
+		}
+		plan.rules = append(plan.rules, compiled)
+	}
+
+	return plan, nil
+}
+
+func compileRule(rule structs.ScheduleRule) (planRule, error) {
+	compiled := planRule{
+		interval: time.Duration(rule.Interval) * time.Millisecond,
+		paused:   rule.Paused,
+	}
+	if !compiled.paused && compiled.interval <= 0 {
+		return compiled, fmt.Errorf("A rule needs an interval or has to pause checks")
+	}
+
+	if rule.Cron != "" {
+		if len(rule.Days) > 0 || rule.From != "" || rule.To != "" {
+			return compiled, fmt.Errorf("A rule has either a cron expression or a time window")
+		}
+		cron, err := parseCron(rule.Cron)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.cron = cron
+		return compiled, nil
+	}
+
+	if len(rule.Days) == 0 {
+		for day := range compiled.days {
+			compiled.days[day] = true
+		}
+	}
+	for _, day := range rule.Days {
+		dayName := strings.ToLower(day)
+		if len(dayName) > 3 {
+			dayName = dayName[:3]
+		}
+		weekday, ok := dayNames[dayName]
+		if !ok {
+			return compiled, fmt.Errorf("Unknown day %s", day)
+		}
+		compiled.days[weekday] = true
+	}
+
+	var err error
+	compiled.from, err = parseClock(rule.From, 0)
+	if err != nil {
+		return compiled, err
+	}
+	compiled.to, err = parseClock(rule.To, 24*60)
+	if err != nil {
+		return compiled, err
+	}
+	if compiled.from == compiled.to {
+		return compiled, fmt.Errorf("Time window %s-%s is empty", rule.From, rule.To)
+	}
+
+	return compiled, nil
+}
+
+//parseClock parses "15:04" into minutes since midnight
+func parseClock(clock string, empty int) (int, error) {
+	if clock == "" {
+		return empty, nil
+	}
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %s, expected HH:MM", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+//active reports whether the rule applies at t, which is in the plan's location
+func (rule *planRule) active(t time.Time) bool {
+	if rule.cron != nil {
+		return rule.cron.matches(t)
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if rule.from < rule.to {
+		return rule.days[t.Weekday()] && minute >= rule.from && minute < rule.to
+	}
+	//the window crosses midnight, its end belongs to the day it started on
+	if minute >= rule.from {
+		return rule.days[t.Weekday()]
+	}
+	return minute < rule.to && rule.days[(t.Weekday()+6)%7]
+}
+
+//IntervalAt returns the check interval at t and whether checks are paused then
+func (plan *Plan) IntervalAt(t time.Time) (time.Duration, bool) {
+	local := t.In(plan.location)
+	for i := range plan.rules {
+		if plan.rules[i].active(local) {
+			return plan.rules[i].interval, plan.rules[i].paused
+		}
+	}
+	return plan.defaultInterval, false
+}
+
+//NextActive returns the first minute after t in which checks are not paused. It gives up after a week and a day
+//and returns that time, so a plan that always pauses is looked at again now and then
+func (plan *Plan) NextActive(t time.Time) time.Time {
+	next := t.Truncate(time.Minute)
+	for end := t.Add(maxPauseLookahead); next.Before(end); {
+		next = next.Add(time.Minute)
+		if _, paused := plan.IntervalAt(next); !paused {
+			return next
+		}
+	}
+	return next
+}
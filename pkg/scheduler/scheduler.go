@@ -0,0 +1,256 @@
+package scheduler
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+//RunFunc runs a single due job of the task and returns when the task is due next. A zero time removes the task
+type RunFunc func(ctx context.Context, taskID int) time.Time
+
+//Scheduler keeps a queue of due jobs ordered by time and runs them on a bounded, resizable pool of workers.
+//A task is never run by two workers at once
+type Scheduler struct {
+	mutex   sync.Mutex
+	run     RunFunc
+	workers int
+	busy    int
+	queue   jobQueue
+	//queued holds the queued job of every task that is waiting for its turn
+	queued map[int]*job
+	//running holds the cancel func of every task a worker is busy with
+	running map[int]context.CancelFunc
+	//removed holds the running tasks that must not be queued again once their job returns
+	removed map[int]bool
+	//rescheduled holds the running tasks that were scheduled while running, with the time they are due once their job returns
+	rescheduled map[int]time.Time
+	wake        chan struct{}
+	wg          sync.WaitGroup
+}
+
+//Stats is a snapshot of the scheduler's queue and workers
+type Stats struct {
+	Workers int `json:"workers"`
+	Busy    int `json:"busy"`
+	Queued  int `json:"queued"`
+	//NextDue is when the next queued job is due, zero if the queue is empty
+	NextDue time.Time `json:"next_due"`
+}
+
+type job struct {
+	taskID int
+	due    time.Time
+	index  int
+}
+
+//New creates a scheduler running jobs with run on at most workers workers at once
+func New(workers int, run RunFunc) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Scheduler{
+		run:         run,
+		workers:     workers,
+		queued:      make(map[int]*job),
+		running:     make(map[int]context.CancelFunc),
+		removed:     make(map[int]bool),
+		rescheduled: make(map[int]time.Time),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+//Start dispatches due jobs to workers until ctx is done. Cancelling ctx also cancels all running jobs
+func (scheduler *Scheduler) Start(ctx context.Context) {
+	scheduler.wg.Add(1)
+	go scheduler.dispatch(ctx)
+}
+
+//Wait blocks until the dispatcher and all running jobs returned after the scheduler's context was cancelled
+func (scheduler *Scheduler) Wait() {
+	scheduler.wg.Wait()
+}
+
+//Schedule queues the task to run at due. A task that is already queued is moved, a running task is queued again once it returns
+func (scheduler *Scheduler) Schedule(taskID int, due time.Time) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if _, ok := scheduler.running[taskID]; ok {
+		delete(scheduler.removed, taskID)
+		scheduler.rescheduled[taskID] = due
+		return
+	}
+	scheduler.push(taskID, due)
+	scheduler.signal()
+}
+
+//Remove takes the task off the queue and cancels its running job, if any, right away
+func (scheduler *Scheduler) Remove(taskID int) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if queuedJob, ok := scheduler.queued[taskID]; ok {
+		heap.Remove(&scheduler.queue, queuedJob.index)
+		delete(scheduler.queued, taskID)
+	}
+	if cancel, ok := scheduler.running[taskID]; ok {
+		scheduler.removed[taskID] = true
+		delete(scheduler.rescheduled, taskID)
+		cancel()
+	}
+	scheduler.signal()
+}
+
+//Resize changes the number of workers. When shrinking, running jobs finish and no new ones start until enough workers are free
+func (scheduler *Scheduler) Resize(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	scheduler.mutex.Lock()
+	scheduler.workers = workers
+	scheduler.signal()
+	scheduler.mutex.Unlock()
+}
+
+//Stats returns a snapshot of the queue and workers
+func (scheduler *Scheduler) Stats() Stats {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	stats := Stats{
+		Workers: scheduler.workers,
+		Busy:    scheduler.busy,
+		Queued:  scheduler.queue.Len(),
+	}
+	if scheduler.queue.Len() > 0 {
+		stats.NextDue = scheduler.queue[0].due
+	}
+	return stats
+}
+
+//Due returns when the task is due next, or false if it is not queued
+func (scheduler *Scheduler) Due(taskID int) (time.Time, bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	queuedJob, ok := scheduler.queued[taskID]
+	if !ok {
+		return time.Time{}, false
+	}
+	return queuedJob.due, true
+}
+
+func (scheduler *Scheduler) dispatch(ctx context.Context) {
+	defer scheduler.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		scheduler.mutex.Lock()
+		wait := time.Hour
+		if scheduler.busy < scheduler.workers && scheduler.queue.Len() > 0 {
+			wait = time.Until(scheduler.queue[0].due)
+			if wait <= 0 {
+				dueJob := heap.Pop(&scheduler.queue).(*job)
+				delete(scheduler.queued, dueJob.taskID)
+				scheduler.startJob(ctx, dueJob.taskID)
+				scheduler.mutex.Unlock()
+				continue
+			}
+		}
+		scheduler.mutex.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-scheduler.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+//startJob runs the task on a free worker. The caller holds the mutex
+func (scheduler *Scheduler) startJob(ctx context.Context, taskID int) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	scheduler.running[taskID] = cancel
+	scheduler.busy++
+	scheduler.wg.Add(1)
+
+	go func() {
+		defer scheduler.wg.Done()
+		next := scheduler.run(jobCtx, taskID)
+		cancel()
+
+		scheduler.mutex.Lock()
+		defer scheduler.mutex.Unlock()
+
+		delete(scheduler.running, taskID)
+		scheduler.busy--
+		if due, ok := scheduler.rescheduled[taskID]; ok {
+			next = due
+			delete(scheduler.rescheduled, taskID)
+		}
+		if !next.IsZero() && !scheduler.removed[taskID] && ctx.Err() == nil {
+			scheduler.push(taskID, next)
+		}
+		delete(scheduler.removed, taskID)
+		scheduler.signal()
+	}()
+}
+
+//push queues the task or moves its queued job. The caller holds the mutex
+func (scheduler *Scheduler) push(taskID int, due time.Time) {
+	if queuedJob, ok := scheduler.queued[taskID]; ok {
+		queuedJob.due = due
+		heap.Fix(&scheduler.queue, queuedJob.index)
+		return
+	}
+	newJob := &job{taskID: taskID, due: due}
+	heap.Push(&scheduler.queue, newJob)
+	scheduler.queued[taskID] = newJob
+}
+
+func (scheduler *Scheduler) signal() {
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+//jobQueue is a min heap of jobs ordered by due time
+type jobQueue []*job
+
+func (queue jobQueue) Len() int { return len(queue) }
+
+func (queue jobQueue) Less(i, j int) bool { return queue[i].due.Before(queue[j].due) }
+
+func (queue jobQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+
+func (queue *jobQueue) Push(x interface{}) {
+	newJob := x.(*job)
+	newJob.index = len(*queue)
+	*queue = append(*queue, newJob)
+}
+
+func (queue *jobQueue) Pop() interface{} {
+	old := *queue
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return last
+}
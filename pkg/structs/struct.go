@@ -15,13 +15,61 @@ type ProductURL struct {
 	MaxPurchases     int `json:"max_purchases"`
 	CurrentPurchases int
 	OnlyCheckStock   bool `json:"only_check_stock"`
+	//CheckMode is how the product's stock is checked, one of the CHECK_MODE constants. Defaults to CHECK_MODE_SELENIUM
+	CheckMode string `json:"check_mode"`
+	//Schedule overrides the webshop's check interval at certain times, the first active rule wins. Timezone is the
+	//IANA name (e.g. "Europe/Berlin") the rules are written in, local time if empty
+	Schedule []ScheduleRule `json:"schedule"`
+	Timezone string         `json:"timezone"`
+	//State is whether the product is checked, one of the PRODUCT_STATE constants. Defaults to PRODUCT_STATE_RUNNING
+	State string `json:"state"`
+	//RequireApproval holds checkouts of the product until they are approved through the API or dashboard
+	RequireApproval bool `json:"require_approval"`
+	//Notifiers names the per product notifiers the product's events are sent to, on top of the global ones
+	Notifiers []string `json:"notifiers,omitempty"`
 }
 
+//ScheduleRule is a time during which a product is checked at its own interval, or not at all. It is either a cron
+//expression, active during every minute it matches, or a weekly time window
+type ScheduleRule struct {
+	//Cron is a 5 field cron expression: minute hour day-of-month month day-of-week (e.g. "* 9-10 * * thu")
+	Cron string `json:"cron,omitempty"`
+	//Days (e.g. ["thu", "fri"], every day if empty) and From/To ("09:00"-"11:00") describe a time window. A window
+	//ending before it starts crosses midnight
+	Days []string `json:"days,omitempty"`
+	From string   `json:"from,omitempty"`
+	To   string   `json:"to,omitempty"`
+	//Interval is the check interval in milliseconds while the rule is active
+	Interval int `json:"interval,omitempty"`
+	//Paused stops checks while the rule is active
+	Paused bool `json:"paused,omitempty"`
+}
+
+//stock check modes
+const (
+	//CHECK_MODE_SELENIUM loads the offers in a browser per thread
+	CHECK_MODE_SELENIUM = "selenium"
+	//CHECK_MODE_HTTP fetches the offers (or the product page if there is no ASIN) over plain HTTP, no browser needed
+	CHECK_MODE_HTTP = "http"
+)
+
+//product states
+const (
+	//PRODUCT_STATE_RUNNING checks the product's stock
+	PRODUCT_STATE_RUNNING = "running"
+	//PRODUCT_STATE_PAUSED keeps the product's tasks and proxies but skips their checks
+	PRODUCT_STATE_PAUSED = "paused"
+	//PRODUCT_STATE_STOPPED runs no tasks for the product and frees their proxies
+	PRODUCT_STATE_STOPPED = "stopped"
+)
+
 type CaptchaWrapper struct {
 	SessionID    string
 	CaptchaURL   string
 	Solved       bool
 	CaptchaChars string
+	//CaptchaSubmitURL is the URL the solved characters are appended to when the captcha was found without a browser
+	CaptchaSubmitURL string
 }
 
 type GlobalConfig struct {
@@ -29,6 +77,18 @@ type GlobalConfig struct {
 	CheckoutInstancesPerWebshop      int    `json:"checkout_instances_per_webshop"`
 	DebugScreenshots                 bool   `json:"debug_screenshots"`
 	CheckoutSessionKeepAliveInterval int    `json:"checkout_session_keepalive_interval"`
+	//CheckoutSessionHealthCheckInterval is how often (in seconds) each checkout session's browser is checked for crashes
+	CheckoutSessionHealthCheckInterval int `json:"checkout_session_healthcheck_interval"`
+	//CheckoutPrewarm keeps idle checkout sessions parked on the watched products' offers with an empty cart
+	CheckoutPrewarm bool `json:"checkout_prewarm"`
+	//CheckoutOverHTTP replays checkouts as plain HTTP requests with a checkout session's cookies, falling back to the browser on surprises
+	CheckoutOverHTTP bool `json:"checkout_over_http"`
+
+	//HTTPTimeout bounds (in seconds) every outbound HTTP request, HTTPHostTimeouts overrides it per host
+	HTTPTimeout      int            `json:"http_timeout"`
+	HTTPHostTimeouts map[string]int `json:"http_host_timeouts"`
+	//HTTPMaxBodySize caps (in bytes) how much of a response is read
+	HTTPMaxBodySize int64 `json:"http_max_body_size"`
 
 	AmazonStockCheckInterval          int    `json:"amazon_stock_check_interval"`
 	AmazonStockCheckIntervalDeviation int    `json:"amazon_stock_check_interval_deviation"`
@@ -36,6 +96,134 @@ type GlobalConfig struct {
 	AmazonProxyLifetime               int    `json:"amazon_proxy_lifetime"`
 	AmazonUsername                    string `json:"amazon_username"`
 	AmazonPassword                    string `json:"amazon_password"`
+
+	//StockCheckBackoffMax is the ceiling (in seconds) of the exponential backoff after failed or throttled stock checks
+	StockCheckBackoffMax int `json:"stock_check_backoff_max"`
+	//RateLimits caps the requests per minute to a webshop host (e.g. "amazon.de") across all tasks, RateLimitDefault applies to
+	//all other hosts. 0 means unlimited
+	RateLimits       map[string]int `json:"rate_limits"`
+	RateLimitDefault int            `json:"rate_limit_default"`
+	//StockCheckWorkers is how many stock checks run at once, StockCheckBrowsers how many browsers the browser checks share
+	StockCheckWorkers  int `json:"stock_check_workers"`
+	StockCheckBrowsers int `json:"stock_check_browsers"`
+	//TaskMaxRestarts is how often a crashed stock check task is restarted in a row before it is marked degraded,
+	//TaskRestartBackoffMax the ceiling (in seconds) of the wait between restarts
+	TaskMaxRestarts       int `json:"task_max_restarts"`
+	TaskRestartBackoffMax int `json:"task_restart_backoff_max"`
+	//ShutdownTimeouts overrides the deadline (in seconds) of shutdown phases by name: stock_checks, checkouts, state, browsers and services
+	ShutdownTimeouts map[string]int `json:"shutdown_timeouts"`
+
+	//APIListen is the address the API listens on (127.0.0.1:3077 if empty). It is served over TLS if APITLSCert and APITLSKey are set
+	APIListen  string `json:"api_listen"`
+	APITLSCert string `json:"api_tls_cert"`
+	APITLSKey  string `json:"api_tls_key"`
+	//APITokens are the bearer tokens the API accepts. Changes always need an admin token, reads need a token once any is configured
+	APITokens []APIToken `json:"api_tokens"`
+	//APICORSOrigins are the origins (e.g. "https://dashboard.example.com") of browser apps allowed to use the API
+	APICORSOrigins []string `json:"api_cors_origins"`
+	//APIHosts are the host names (e.g. "dolos.example.com") the API is reached by besides api_listen's address
+	APIHosts []string `json:"api_hosts"`
+
+	//CheckoutApprovalTimeout is how many seconds a checkout of a product that requires approval waits for it before it is dropped
+	CheckoutApprovalTimeout int `json:"checkout_approval_timeout"`
+
+	//Notifiers send events to places outside the bot. NotifyDeadLetterFile is where notifications that could not be delivered are appended
+	Notifiers            []NotifierConfig `json:"notifiers"`
+	NotifyDeadLetterFile string           `json:"notify_dead_letter_file"`
+	//NotifyRules decide which events reach the notifiers
+	NotifyRules NotifyRulesConfig `json:"notify_rules"`
+}
+
+//NotifyRulesConfig throttles what the notifiers get. Products are only announced in stock when they come back, not on
+//every check that finds them
+type NotifyRulesConfig struct {
+	//RepeatWindow is how many seconds repeats of an event are collapsed into the first one, 60 if not set and -1 for never
+	RepeatWindow int `json:"repeat_window,omitempty"`
+	//EscalateAfter announces a product again once it is still in stock after this many minutes, 0 for never
+	EscalateAfter int `json:"escalate_after,omitempty"`
+	//QuietHoursStart and QuietHoursEnd are the local times ("22:00", "07:00") between which events that aren't critical
+	//are held back until the quiet hours end
+	QuietHoursStart string `json:"quiet_hours_start,omitempty"`
+	QuietHoursEnd   string `json:"quiet_hours_end,omitempty"`
+}
+
+//NotifierConfig configures a single notifier
+type NotifierConfig struct {
+	//Name is how products refer to the notifier, Type is one of the NOTIFIER constants of the notify package
+	Name string `json:"name"`
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	//Secret signs webhook requests, no signature is sent if it is empty
+	Secret string `json:"secret,omitempty"`
+	//Events are the event types sent, in stock, out of stock, price changes and placed orders if empty
+	Events []string `json:"events,omitempty"`
+	//PerProduct only sends events of products that list the notifier, the others get events of every product
+	PerProduct bool `json:"per_product,omitempty"`
+	//Timeout is the timeout of a single attempt in seconds, MaxRetries how often a failed one is retried (-1 for never)
+	Timeout    int `json:"timeout,omitempty"`
+	MaxRetries int `json:"max_retries,omitempty"`
+	//ScreenshotURL is where the notification screenshot directory is served publicly, Slack messages only show screenshots if it is set
+	ScreenshotURL string `json:"screenshot_url,omitempty"`
+	//BatchWindow is how many seconds notifiers that send batches collect events before sending them, 10 if not set and -1 for never
+	BatchWindow int `json:"batch_window,omitempty"`
+	//MinSeverity is the least severe events the notifier gets (info, warning or critical), info if not set
+	MinSeverity string `json:"min_severity,omitempty"`
+	//IgnoreQuietHours sends the notifier's events during quiet hours too
+	IgnoreQuietHours bool `json:"ignore_quiet_hours,omitempty"`
+	//SMTP configures the email notifier
+	SMTP *SMTPConfig `json:"smtp,omitempty"`
+	//Telegram configures the telegram notifier
+	Telegram *TelegramConfig `json:"telegram,omitempty"`
+	//MQTT configures the broker the mqtt notifier publishes to
+	MQTT *MQTTConfig `json:"mqtt,omitempty"`
+}
+
+//MQTTConfig configures the MQTT broker connection and topics
+type MQTTConfig struct {
+	//Broker is the broker's URL, tcp://host:1883 or ssl://host:8883
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	//TopicPrefix is the root of all topics, dolos if not set
+	TopicPrefix string `json:"topic_prefix,omitempty"`
+	//DiscoveryPrefix is where Home Assistant looks for discovery configs, homeassistant if not set
+	DiscoveryPrefix  string `json:"discovery_prefix,omitempty"`
+	DisableDiscovery bool   `json:"disable_discovery,omitempty"`
+	//KeepAlive is the keep alive interval in seconds, 60 if not set
+	KeepAlive int `json:"keep_alive,omitempty"`
+}
+
+//TelegramConfig configures the telegram bot
+type TelegramConfig struct {
+	Token string `json:"token"`
+	//ChatID is the chat alerts are sent to, commands are only taken from it
+	ChatID int64 `json:"chat_id"`
+	//APIURL is the Bot API's base URL, https://api.telegram.org if not set
+	APIURL string `json:"api_url,omitempty"`
+}
+
+//SMTPConfig configures how the email notifier sends its mails
+type SMTPConfig struct {
+	Host string `json:"host"`
+	//Port defaults to 465 for implicit TLS, 587 for STARTTLS and 25 without TLS
+	Port int `json:"port,omitempty"`
+	//TLS is "starttls" (the default), "tls" for implicit TLS or "none", which only local relays should be used with
+	TLS      string   `json:"tls,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	//Templates is a directory with subject.tmpl, email.txt.tmpl and email.html.tmpl, each overrides the built in one
+	Templates string `json:"templates,omitempty"`
+}
+
+//APIToken is a bearer token for the API
+type APIToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	//Scope is "read" or "admin"
+	Scope string `json:"scope"`
 }
 
 type Proxy struct {
@@ -57,3 +245,20 @@ const (
 	WEBSHOP_AMAZONIT Webshop = 4
 	WEBSHOP_AMAZONFR Webshop = 5
 )
+
+//Name returns the webshop's domain, e.g. amazon.de
+func (webshop Webshop) Name() string {
+	switch webshop {
+	case WEBSHOP_AMAZON:
+		return "amazon.com"
+	case WEBSHOP_AMAZONNL:
+		return "amazon.nl"
+	case WEBSHOP_AMAZONDE:
+		return "amazon.de"
+	case WEBSHOP_AMAZONIT:
+		return "amazon.it"
+	case WEBSHOP_AMAZONFR:
+		return "amazon.fr"
+	}
+	return "none"
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/metrics"
+	"dolos-dev/pkg/notify"
+	"dolos-dev/pkg/structs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+//maxProductBodySize caps the size of a product's json in requests
+const maxProductBodySize = 1 << 20
+
+//ProductView is a product with the live status of its tasks as served by the products API
+type ProductView struct {
+	structs.ProductURL
+	Status ProductStatus `json:"status"`
+}
+
+//ProductStatus sums up the state of a product's tasks
+type ProductStatus struct {
+	//LastCheck is the most recent check of any of the product's tasks, InStock its result
+	LastCheck *time.Time `json:"last_check,omitempty"`
+	InStock   bool       `json:"in_stock"`
+	//LastPrice is the lowest offer price the product's last successful check that saw one found
+	LastPrice float64 `json:"last_price,omitempty"`
+	//History holds the product's most recent checks of all tasks, oldest first
+	History []CheckRecord `json:"history"`
+	//Errors holds the last error or crash of every task that has one
+	Errors []string     `json:"errors"`
+	Tasks  []TaskStatus `json:"tasks"`
+}
+
+//apiError is the body of every error response of the products API
+type apiError struct {
+	Error string `json:"error"`
+}
+
+//newRouter registers all API endpoints. Endpoints that change something need an admin token
+func (handler *StockAlertHandler) newRouter(auth *apiAuth) *httprouter.Router {
+	router := httprouter.New()
+
+	router.GET("/api/products", auth.require(API_SCOPE_READ, handler.listProducts))
+	router.POST("/api/products", auth.require(API_SCOPE_ADMIN, handler.createProduct))
+	router.GET("/api/products/:id", auth.require(API_SCOPE_READ, handler.getProduct))
+	router.PUT("/api/products/:id", auth.require(API_SCOPE_ADMIN, handler.updateProduct))
+	router.DELETE("/api/products/:id", auth.require(API_SCOPE_ADMIN, handler.deleteProduct))
+	router.POST("/api/products/:id/pause", auth.require(API_SCOPE_ADMIN, handler.setProductStateAction(structs.PRODUCT_STATE_PAUSED)))
+	router.POST("/api/products/:id/resume", auth.require(API_SCOPE_ADMIN, handler.setProductStateAction(structs.PRODUCT_STATE_RUNNING)))
+	router.POST("/api/products/:id/stop", auth.require(API_SCOPE_ADMIN, handler.setProductStateAction(structs.PRODUCT_STATE_STOPPED)))
+	router.POST("/api/products/:id/check", auth.require(API_SCOPE_ADMIN, handler.checkProductNow))
+
+	router.GET("/api/checkouts", auth.require(API_SCOPE_READ, handler.listPendingCheckouts))
+	router.POST("/api/checkouts/:id/approve", auth.require(API_SCOPE_ADMIN, handler.decideCheckoutAction(true)))
+	router.POST("/api/checkouts/:id/reject", auth.require(API_SCOPE_ADMIN, handler.decideCheckoutAction(false)))
+
+	router.POST("/api/notifiers/:name/test", auth.require(API_SCOPE_ADMIN, handler.testNotifier))
+
+	router.GET("/api/status", auth.requireFunc(API_SCOPE_READ, handler.StatusHandler))
+	router.GET("/api/pool", auth.requireFunc(API_SCOPE_READ, handler.PoolHandler))
+	router.POST("/api/pool", auth.requireFunc(API_SCOPE_ADMIN, handler.PoolHandler))
+	router.POST("/api/captchasolver", auth.requireFunc(API_SCOPE_ADMIN, handler.CaptchaSolverHandler))
+	router.GET("/api/test", auth.requireFunc(API_SCOPE_READ, handler.Test))
+	router.GET("/api/events", auth.requireStream(API_SCOPE_READ, handler.EventsHandler))
+	router.POST("/api/events/token", auth.require(API_SCOPE_READ, auth.issueStreamToken))
+	router.GET("/api/events/recent", auth.requireFunc(API_SCOPE_READ, handler.RecentEventsHandler))
+	router.GET("/metrics", auth.requireFunc(API_SCOPE_READ, metrics.Handler().ServeHTTP))
+
+	//the dashboard's files hold nothing secret, it asks for a token to use the API with
+	router.GET("/", redirectToDashboard)
+	router.GET("/dashboard/*filepath", serveDashboard())
+	//captcha solver pages post their solutions to the API from its own origin
+	router.GET("/captcha/:session", serveCaptchaPage)
+
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "No endpoint %s", r.URL.Path)
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method %s not allowed on %s", r.Method, r.URL.Path)
+	})
+	//answers CORS preflight requests of any endpoint, withCORS decides which origins get the headers
+	router.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return router
+}
+
+func (handler *StockAlertHandler) listProducts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, handler.productViews(0))
+}
+
+func (handler *StockAlertHandler) getProduct(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, ok := productID(w, params)
+	if !ok {
+		return
+	}
+
+	views := handler.productViews(id)
+	if len(views) == 0 {
+		writeAPIError(w, http.StatusNotFound, "Product %v not found", id)
+		return
+	}
+	writeJSON(w, http.StatusOK, views[0])
+}
+
+func (handler *StockAlertHandler) createProduct(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	product, ok := decodeProduct(w, r)
+	if !ok {
+		return
+	}
+	if product.ID != 0 {
+		writeAPIError(w, http.StatusUnprocessableEntity, "The id of a new product is assigned by the server")
+		return
+	}
+
+	product, err := handler.AddProduct(product)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "%v", err)
+		return
+	}
+	handler.writeProduct(w, http.StatusCreated, product.ID)
+}
+
+func (handler *StockAlertHandler) updateProduct(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, ok := productID(w, params)
+	if !ok {
+		return
+	}
+	product, ok := decodeProduct(w, r)
+	if !ok {
+		return
+	}
+	if product.ID != 0 && product.ID != id {
+		writeAPIError(w, http.StatusUnprocessableEntity, "The id %v in the body doesn't match the product %v", product.ID, id)
+		return
+	}
+
+	_, err := handler.UpdateProduct(id, product)
+	if err == errProductNotFound {
+		writeAPIError(w, http.StatusNotFound, "Product %v not found", id)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "%v", err)
+		return
+	}
+	handler.writeProduct(w, http.StatusOK, id)
+}
+
+func (handler *StockAlertHandler) deleteProduct(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, ok := productID(w, params)
+	if !ok {
+		return
+	}
+
+	err := handler.RemoveProduct(id)
+	if err == errProductNotFound {
+		writeAPIError(w, http.StatusNotFound, "Product %v not found", id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//setProductStateAction returns a handler that puts the product into the given state
+func (handler *StockAlertHandler) setProductStateAction(state string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		id, ok := productID(w, params)
+		if !ok {
+			return
+		}
+
+		_, err := handler.SetProductState(id, state)
+		if err == errProductNotFound {
+			writeAPIError(w, http.StatusNotFound, "Product %v not found", id)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, "%v", err)
+			return
+		}
+		handler.writeProduct(w, http.StatusOK, id)
+	}
+}
+
+func (handler *StockAlertHandler) checkProductNow(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, ok := productID(w, params)
+	if !ok {
+		return
+	}
+
+	err := handler.CheckNow(id)
+	if err == errProductNotFound {
+		writeAPIError(w, http.StatusNotFound, "Product %v not found", id)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "%v", err)
+		return
+	}
+	handler.writeProduct(w, http.StatusAccepted, id)
+}
+
+func (handler *StockAlertHandler) listPendingCheckouts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, handler.PendingCheckouts())
+}
+
+//decideCheckoutAction returns a handler that approves or rejects a pending checkout
+func (handler *StockAlertHandler) decideCheckoutAction(approve bool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params.ByName("id"))
+		if err != nil || id < 1 {
+			writeAPIError(w, http.StatusBadRequest, "Invalid checkout ID %s", params.ByName("id"))
+			return
+		}
+
+		err = handler.DecideCheckout(id, approve)
+		if err == errCheckoutNotFound {
+			writeAPIError(w, http.StatusNotFound, "No pending checkout %v, it may have expired", id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (handler *StockAlertHandler) testNotifier(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	name := params.ByName("name")
+	err := handler.TestNotifier(r.Context(), name)
+	switch {
+	case err == errNoNotifiers || err == notify.ErrUnknownNotifier:
+		writeAPIError(w, http.StatusNotFound, "No notifier %s is running", name)
+	case err != nil:
+		writeAPIError(w, http.StatusBadGateway, "Failed to send test notification (%v)", err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//productViews returns the products with their live status, or only the product with the given ID if it isn't 0
+func (handler *StockAlertHandler) productViews(id int) []ProductView {
+	handler.productsMutex.Lock()
+	views := make([]ProductView, 0, len(handler.products))
+	taskIDs := make([][]int, 0, len(handler.products))
+	schedules := make([]*productSchedule, 0, len(handler.products))
+	handler.mutex.RLock()
+	for productID, managed := range handler.products {
+		if id != 0 && productID != id {
+			continue
+		}
+		views = append(views, ProductView{
+			ProductURL: helperfuncs.ProductDefaults(*managed.product),
+		})
+		taskIDs = append(taskIDs, append([]int(nil), managed.taskIDs...))
+		schedules = append(schedules, managed.schedule)
+	}
+	handler.mutex.RUnlock()
+	handler.productsMutex.Unlock()
+
+	handler.mutex.RLock()
+	for i := range views {
+		status := ProductStatus{
+			Errors:  make([]string, 0),
+			Tasks:   make([]TaskStatus, 0, len(taskIDs[i])),
+			History: make([]CheckRecord, 0),
+		}
+		for _, taskID := range taskIDs[i] {
+			taskStatus, ok := handler.taskStatuses[taskID]
+			if !ok {
+				continue
+			}
+			status.Tasks = append(status.Tasks, *taskStatus)
+			if !taskStatus.LastCheck.IsZero() && (status.LastCheck == nil || taskStatus.LastCheck.After(*status.LastCheck)) {
+				lastCheck := taskStatus.LastCheck
+				status.LastCheck = &lastCheck
+				status.InStock = taskStatus.InStock
+			}
+			if taskStatus.LastError != "" {
+				status.Errors = append(status.Errors, fmt.Sprintf("task #%v: %s", taskID, taskStatus.LastError))
+			} else if taskStatus.State == TASK_STATE_RESTARTING || taskStatus.State == TASK_STATE_DEGRADED {
+				status.Errors = append(status.Errors, fmt.Sprintf("task #%v: %s", taskID, taskStatus.LastCrash))
+			}
+		}
+		views[i].Status = status
+	}
+	handler.mutex.RUnlock()
+
+	for i := range views {
+		if schedules[i] != nil {
+			views[i].Status.History, views[i].Status.LastPrice = schedules[i].checks()
+		}
+	}
+
+	if handler.scheduler != nil {
+		for i := range views {
+			for j := range views[i].Status.Tasks {
+				if due, ok := handler.scheduler.Due(views[i].Status.Tasks[j].TaskID); ok {
+					views[i].Status.Tasks[j].NextCheck = &due
+				}
+			}
+		}
+	}
+
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].ID < views[j].ID
+	})
+	return views
+}
+
+//writeProduct answers with the product's current view
+func (handler *StockAlertHandler) writeProduct(w http.ResponseWriter, statusCode int, id int) {
+	views := handler.productViews(id)
+	if len(views) == 0 {
+		writeAPIError(w, http.StatusNotFound, "Product %v not found", id)
+		return
+	}
+	writeJSON(w, statusCode, views[0])
+}
+
+//productID parses the product ID of the request's path, answering with an error if it isn't one
+func productID(w http.ResponseWriter, params httprouter.Params) (int, bool) {
+	id, err := strconv.Atoi(params.ByName("id"))
+	if err != nil || id < 1 {
+		writeAPIError(w, http.StatusBadRequest, "Invalid product ID %s", params.ByName("id"))
+		return 0, false
+	}
+	return id, true
+}
+
+//productBody is a product as sent by a client. The status of a product view is read-only, it is accepted so a
+//product fetched from the API can be sent back as is, but ignored
+type productBody struct {
+	structs.ProductURL
+	Status json.RawMessage `json:"status"`
+}
+
+//decodeProduct decodes the product in the request body, answering with an error that names the offending field if it doesn't fit the product's schema
+func decodeProduct(w http.ResponseWriter, r *http.Request) (structs.ProductURL, bool) {
+	body := productBody{}
+
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxProductBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&body)
+	product := body.ProductURL
+	if err == nil && decoder.More() {
+		err = errors.New("Body holds more than one product")
+	}
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &typeErr):
+			writeAPIError(w, http.StatusBadRequest, "Field %s must be of type %s", typeErr.Field, typeErr.Type)
+		case errors.As(err, &syntaxErr):
+			writeAPIError(w, http.StatusBadRequest, "Malformed json at offset %v (%v)", syntaxErr.Offset, err)
+		case err == io.EOF:
+			writeAPIError(w, http.StatusBadRequest, "Missing product in request body")
+		default:
+			//unknown fields end up here
+			writeAPIError(w, http.StatusBadRequest, "Invalid product (%v)", err)
+		}
+		return product, false
+	}
+
+	return product, true
+}
+
+//EventsHandler streams events as server-sent events, or over a websocket if the request asks for one
+func (handler *StockAlertHandler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := events.ParseFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if events.IsWebSocket(r) {
+		err = events.Default().ServeWebSocket(w, r, filter, handler.GlobalConfig.APICORSOrigins)
+	} else {
+		err = events.Default().ServeSSE(w, r, filter)
+	}
+	if err != nil {
+		log.Println(fmt.Errorf("Event stream to %s ended (%v)", r.RemoteAddr, err))
+	}
+}
+
+//RecentEventsHandler answers with the most recent events, filtered like the event stream. limit caps how many (50 by default)
+func (handler *StockAlertHandler) RecentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := events.ParseFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			writeAPIError(w, http.StatusBadRequest, "Invalid limit %s", value)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, events.Default().Recent(filter, limit))
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Println(fmt.Errorf("Failed to encode response (%v)", err))
+	}
+}
+
+//writeAPIError logs the error and answers with it as json
+func writeAPIError(w http.ResponseWriter, statusCode int, format string, params ...interface{}) {
+	message := fmt.Sprintf(format, params...)
+	log.Println(message)
+	writeJSON(w, statusCode, apiError{Error: message})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"dolos-dev/pkg/helperfuncs"
+	"errors"
+	"sort"
+	"time"
+)
+
+//defaultCheckoutApprovalTimeout is used when checkout_approval_timeout is not configured
+const defaultCheckoutApprovalTimeout = 2 * time.Minute
+
+//errCheckoutNotFound is returned for pending checkouts that don't exist or were already decided or dropped
+var errCheckoutNotFound = errors.New("Pending checkout not found")
+
+//PendingCheckout is a checkout of a product that requires approval, waiting for someone to approve or reject it
+type PendingCheckout struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	Product   string    `json:"product"`
+	URL       string    `json:"url"`
+	TaskID    int       `json:"task_id"`
+	Price     float64   `json:"price,omitempty"`
+	Detected  time.Time `json:"detected"`
+	Expires   time.Time `json:"expires"`
+
+	//decision receives whether the checkout was approved
+	decision chan bool
+}
+
+//awaitApproval holds the task's checkout until it is approved, rejected or expires. It returns whether to check out
+func (handler *StockAlertHandler) awaitApproval(task *stockTask, detected time.Time, price float64) bool {
+	timeout := defaultCheckoutApprovalTimeout
+	if task.globalConfig.CheckoutApprovalTimeout > 0 {
+		timeout = time.Duration(task.globalConfig.CheckoutApprovalTimeout) * time.Second
+	}
+
+	handler.mutex.Lock()
+	handler.lastCheckoutID++
+	pending := &PendingCheckout{
+		ID:        handler.lastCheckoutID,
+		ProductID: task.product.ID,
+		Product:   task.product.Name,
+		URL:       task.product.URL,
+		TaskID:    task.id,
+		Price:     price,
+		Detected:  detected,
+		Expires:   time.Now().Add(timeout),
+		decision:  make(chan bool, 1),
+	}
+	handler.pendingCheckouts[pending.ID] = pending
+	handler.mutex.Unlock()
+
+	defer func() {
+		handler.mutex.Lock()
+		delete(handler.pendingCheckouts, pending.ID)
+		handler.mutex.Unlock()
+	}()
+
+	helperfuncs.Log(handler.addMetrics("Checkout #%v of %s is waiting %v for approval", task.id), pending.ID, task.product.Name, timeout)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case approved := <-pending.decision:
+		if !approved {
+			helperfuncs.Log(handler.addMetrics("Checkout #%v of %s was rejected", task.id), pending.ID, task.product.Name)
+		}
+		return approved
+	case <-timer.C:
+		helperfuncs.Log(handler.addMetrics("Checkout #%v of %s was not approved in time", task.id), pending.ID, task.product.Name)
+		return false
+	case <-handler.stockCheckCtx.Done():
+		return false
+	}
+}
+
+//DecideCheckout approves or rejects a pending checkout
+func (handler *StockAlertHandler) DecideCheckout(id int, approve bool) error {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	pending, ok := handler.pendingCheckouts[id]
+	if !ok {
+		return errCheckoutNotFound
+	}
+	//the checkout stops waiting right away, so it can't be decided twice
+	delete(handler.pendingCheckouts, id)
+	pending.decision <- approve
+	return nil
+}
+
+//PendingCheckouts returns the checkouts waiting for approval, oldest first
+func (handler *StockAlertHandler) PendingCheckouts() []PendingCheckout {
+	handler.mutex.RLock()
+	pending := make([]PendingCheckout, 0, len(handler.pendingCheckouts))
+	for _, checkout := range handler.pendingCheckouts {
+		pending = append(pending, *checkout)
+	}
+	handler.mutex.RUnlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ID < pending[j].ID
+	})
+	return pending
+}
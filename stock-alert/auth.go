@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"dolos-dev/pkg/structs"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+//scopes of API tokens. An admin token can do everything a read token can
+const (
+	API_SCOPE_READ  = "read"
+	API_SCOPE_ADMIN = "admin"
+)
+
+//defaultAPIListen only accepts connections from this machine if api_listen is not set
+const defaultAPIListen = "127.0.0.1:3077"
+
+//streamTokenTTL is how long a stream token can be used to open an event stream
+const streamTokenTTL = time.Minute
+
+//apiAuth checks the bearer tokens of API requests against the configured ones
+type apiAuth struct {
+	tokens []structs.APIToken
+	//hosts are the host names requests may be addressed to, anyIP also allows every IP address
+	hosts map[string]bool
+	anyIP bool
+
+	//streamTokens are the unused stream tokens and when they expire
+	streamTokens map[string]time.Time
+	streamMutex  sync.Mutex
+}
+
+//newAPIAuth validates the configured API tokens and works out the host names the API listening on listen is reached
+//by: the listen address, localhost if it is a loopback address, and the extra hosts
+func newAPIAuth(tokens []structs.APIToken, listen string, extraHosts []string) (*apiAuth, error) {
+	for i, token := range tokens {
+		if len(token.Token) < 16 {
+			return nil, fmt.Errorf("API token %v (%s) must be at least 16 characters long", i+1, token.Name)
+		}
+		if token.Scope != API_SCOPE_READ && token.Scope != API_SCOPE_ADMIN {
+			return nil, fmt.Errorf("API token %v (%s) has unknown scope %s, expected %s or %s", i+1, token.Name, token.Scope, API_SCOPE_READ, API_SCOPE_ADMIN)
+		}
+	}
+
+	listenHost, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid api_listen %s (%v)", listen, err)
+	}
+	auth := &apiAuth{
+		tokens:       tokens,
+		hosts:        make(map[string]bool),
+		streamTokens: make(map[string]time.Time),
+	}
+	listenIP := net.ParseIP(listenHost)
+	switch {
+	case listenHost == "" || (listenIP != nil && listenIP.IsUnspecified()):
+		auth.anyIP = true
+	case listenIP != nil:
+		auth.hosts[listenIP.String()] = true
+	default:
+		auth.hosts[strings.ToLower(listenHost)] = true
+	}
+	if auth.anyIP || (listenIP != nil && listenIP.IsLoopback()) || strings.EqualFold(listenHost, "localhost") {
+		auth.hosts["localhost"] = true
+		auth.hosts["127.0.0.1"] = true
+		auth.hosts["::1"] = true
+	}
+	for _, host := range extraHosts {
+		auth.hosts[strings.ToLower(host)] = true
+	}
+	return auth, nil
+}
+
+//hostAllowed tells if the request is addressed to a host name of the API. A website can point its own domain at this
+//machine (DNS rebinding) to get around the same origin policy, but the browser still sends that domain as the Host
+func (auth *apiAuth) hostAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if ip := net.ParseIP(host); ip != nil {
+		return auth.anyIP || auth.hosts[ip.String()]
+	}
+	return auth.hosts[host]
+}
+
+//token returns the configured token the request carries, or nil if it carries none or an unknown one
+func (auth *apiAuth) token(r *http.Request) *structs.APIToken {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	presented := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	for i := range auth.tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(auth.tokens[i].Token)) == 1 {
+			return &auth.tokens[i]
+		}
+	}
+	return nil
+}
+
+//checkHost rejects requests that aren't addressed to a host name of the API and reports whether the request may go on
+func (auth *apiAuth) checkHost(w http.ResponseWriter, r *http.Request) bool {
+	if auth.hostAllowed(r) {
+		return true
+	}
+	log.Println(fmt.Sprintf("Rejected %s %s from %s addressed to unknown host %s", r.Method, r.URL.Path, r.RemoteAddr, r.Host))
+	writeAPIError(w, http.StatusMisdirectedRequest, "Unknown host %s, add it to api_hosts if the API is reached by that name", r.Host)
+	return false
+}
+
+//require wraps an endpoint so it only runs for requests with a token of the given scope. As long as no tokens are
+//configured read endpoints are open and endpoints that change something are turned off, they always need an admin token
+func (auth *apiAuth) require(scope string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if !auth.checkHost(w, r) {
+			return
+		}
+		if len(auth.tokens) == 0 && scope == API_SCOPE_READ {
+			next(w, r, params)
+			return
+		}
+		if len(auth.tokens) == 0 {
+			log.Println(fmt.Sprintf("Rejected %s %s from %s, no API tokens are configured", r.Method, r.URL.Path, r.RemoteAddr))
+			writeAPIError(w, http.StatusForbidden, "Changes are turned off until an admin API token is configured in api_tokens")
+			return
+		}
+
+		token := auth.token(r)
+		if token == nil {
+			log.Println(fmt.Sprintf("Rejected %s %s from %s without a valid API token", r.Method, r.URL.Path, r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dolos"`)
+			writeAPIError(w, http.StatusUnauthorized, "A valid API token is required")
+			return
+		}
+		if scope == API_SCOPE_ADMIN && token.Scope != API_SCOPE_ADMIN {
+			writeAPIError(w, http.StatusForbidden, "API token %s is not allowed to change anything", token.Name)
+			return
+		}
+
+		next(w, r, params)
+	}
+}
+
+//requireFunc is require for plain http handlers
+func (auth *apiAuth) requireFunc(scope string, next http.HandlerFunc) httprouter.Handle {
+	return auth.require(scope, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		next(w, r)
+	})
+}
+
+//requireStream is requireFunc for event streams. Browsers can't set headers on websockets and EventSource, so a read
+//stream may also be opened with a stream token from issueStreamToken as the token query parameter. API tokens are
+//never taken from the URL, where they would end up in logs and the browser history
+func (auth *apiAuth) requireStream(scope string, next http.HandlerFunc) httprouter.Handle {
+	handle := auth.requireFunc(scope, next)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		streamToken := r.URL.Query().Get("token")
+		if streamToken == "" || r.Header.Get("Authorization") != "" || len(auth.tokens) == 0 || scope != API_SCOPE_READ {
+			handle(w, r, params)
+			return
+		}
+
+		if !auth.checkHost(w, r) {
+			return
+		}
+		if !auth.useStreamToken(streamToken) {
+			log.Println(fmt.Sprintf("Rejected %s %s from %s with an invalid stream token", r.Method, r.URL.Path, r.RemoteAddr))
+			writeAPIError(w, http.StatusUnauthorized, "Invalid or expired stream token, get a new one from POST /api/events/token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+//issueStreamToken answers with a stream token that opens a single event stream within streamTokenTTL. It is served to
+//read tokens, so a browser can open the stream without putting its API token in the URL
+func (auth *apiAuth) issueStreamToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	random := make([]byte, 24)
+	_, err := rand.Read(random)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to create a stream token (%v)", err)
+		return
+	}
+	streamToken := hex.EncodeToString(random)
+	expires := time.Now().Add(streamTokenTTL)
+
+	auth.streamMutex.Lock()
+	for unused, unusedExpires := range auth.streamTokens {
+		if time.Now().After(unusedExpires) {
+			delete(auth.streamTokens, unused)
+		}
+	}
+	auth.streamTokens[streamToken] = expires
+	auth.streamMutex.Unlock()
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":   streamToken,
+		"expires": expires,
+	})
+}
+
+//useStreamToken reports whether the stream token was issued and hasn't expired yet. Every stream token works only once
+func (auth *apiAuth) useStreamToken(streamToken string) bool {
+	auth.streamMutex.Lock()
+	defer auth.streamMutex.Unlock()
+
+	expires, ok := auth.streamTokens[streamToken]
+	if !ok {
+		return false
+	}
+	delete(auth.streamTokens, streamToken)
+	return time.Now().Before(expires)
+}
+
+//withCORS allows browser apps on the allowed origins to use the API. Requests from other origins get no CORS headers,
+//so browsers don't let those pages read the answers or send credentials
+func withCORS(allowedOrigins []string, next http.Handler) http.Handler {
+	allowed := originSet(allowedOrigins)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && allowed[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//originSet returns the origins as a set, without trailing slashes
+func originSet(origins []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, origin := range origins {
+		set[strings.TrimSuffix(origin, "/")] = true
+	}
+	return set
+}
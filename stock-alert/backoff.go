@@ -0,0 +1,84 @@
+package main
+
+import (
+	"dolos-dev/pkg/httpclient"
+	"fmt"
+	"time"
+)
+
+const (
+	//backoffMin is the wait after the first failed check, doubled with every further failure
+	backoffMin = 5 * time.Second
+	//defaultBackoffMax is the ceiling of the wait if stock_check_backoff_max is not set
+	defaultBackoffMax = 10 * time.Minute
+)
+
+//checkBackoff tracks how long a stock checker waits after failed or throttled checks
+type checkBackoff struct {
+	max      time.Duration
+	failures int
+	until    time.Time
+	reason   string
+}
+
+func newCheckBackoff(maxSeconds int) *checkBackoff {
+	max := time.Duration(maxSeconds) * time.Second
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+	return &checkBackoff{
+		max: max,
+	}
+}
+
+//failed records a failed check and returns how long to wait before the next one. A Retry-After sent with
+//a throttled response is honoured even if it is longer than the exponential wait, up to the backoff's maximum
+func (backoff *checkBackoff) failed(err error) time.Duration {
+	backoff.failures++
+
+	wait := backoff.max
+	if backoff.failures <= 16 {
+		wait = backoffMin << (backoff.failures - 1)
+	}
+	if wait > backoff.max {
+		wait = backoff.max
+	}
+
+	backoff.reason = "failed check"
+	if statusErr := httpclient.AsStatusError(err); statusErr != nil {
+		backoff.reason = statusErr.Status
+		if statusErr.Throttled() {
+			if retryAfter, ok := statusErr.RetryAfter(); ok {
+				backoff.reason = fmt.Sprint(statusErr.Status, ", Retry-After ", retryAfter.Round(time.Second))
+				if retryAfter > backoff.max {
+					retryAfter = backoff.max
+				}
+				if retryAfter > wait {
+					wait = retryAfter
+				}
+			}
+		}
+	}
+
+	backoff.until = time.Now().Add(wait)
+	return wait
+}
+
+//succeeded resets the backoff after a successful check
+func (backoff *checkBackoff) succeeded() {
+	backoff.failures = 0
+	backoff.until = time.Time{}
+	backoff.reason = ""
+}
+
+//active reports whether the next check has to wait for the backoff
+func (backoff *checkBackoff) active() bool {
+	return time.Now().Before(backoff.until)
+}
+
+func (backoff *checkBackoff) String() string {
+	if backoff.failures == 0 {
+		return "no backoff"
+	}
+	return fmt.Sprintf("backing off until %s after %v failed check(s) (%s)", backoff.until.Format("15:04:05"), backoff.failures, backoff.reason)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"dolos-dev/pkg/helperfuncs"
+	"embed"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+//dashboardFiles is the single page dashboard, built on the JSON API only
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+//serveDashboard serves the dashboard's files under /dashboard/
+func serveDashboard() httprouter.Handle {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		helperfuncs.Log("Failed to load the dashboard (%v)", err)
+		return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			writeAPIError(w, http.StatusInternalServerError, "Dashboard not available")
+		}
+	}
+	fileServer := http.StripPrefix("/dashboard", http.FileServer(http.FS(files)))
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; connect-src 'self'; img-src 'self' data:")
+		fileServer.ServeHTTP(w, r)
+	}
+}
+
+func redirectToDashboard(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	http.Redirect(w, r, "/dashboard/", http.StatusFound)
+}
+
+//serveCaptchaPage serves the captcha solver page created for a session in captchatemplates/
+func serveCaptchaPage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	session := params.ByName("session")
+	if session == "" || strings.ContainsAny(session, `/\.`) {
+		writeAPIError(w, http.StatusBadRequest, "Invalid captcha session %s", session)
+		return
+	}
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, filepath.Join("captchatemplates", session+".html"))
+}
@@ -0,0 +1,313 @@
+"use strict";
+
+// The dashboard only uses the JSON API. Reads work without a token as long as none are configured,
+// pausing, checking and approving need an admin token.
+const TOKEN_KEY = "dolos-api-token";
+const REFRESH_INTERVAL = 5000;
+const MAX_EVENTS = 100;
+
+let lastEventID = 0;
+let refreshTimer = null;
+
+function token() {
+    return localStorage.getItem(TOKEN_KEY) || "";
+}
+
+function headers(extra) {
+    const result = Object.assign({}, extra);
+    if (token() !== "") {
+        result["Authorization"] = "Bearer " + token();
+    }
+    return result;
+}
+
+async function api(method, path) {
+    const response = await fetch(path, { method: method, headers: headers() });
+    if (response.status === 204) {
+        return null;
+    }
+    const body = await response.json();
+    if (!response.ok) {
+        throw new Error(body.error || response.statusText);
+    }
+    return body;
+}
+
+function showError(err) {
+    const element = document.getElementById("error");
+    element.textContent = err ? err.message : "";
+    element.hidden = !err;
+}
+
+function el(tag, attributes, ...children) {
+    const element = document.createElement(tag);
+    for (const [key, value] of Object.entries(attributes || {})) {
+        if (key.startsWith("on")) {
+            element.addEventListener(key.slice(2), value);
+        } else {
+            element.setAttribute(key, value);
+        }
+    }
+    for (const child of children) {
+        if (child !== null && child !== undefined) {
+            element.append(child instanceof Node ? child : String(child));
+        }
+    }
+    return element;
+}
+
+function badge(text, kind) {
+    return el("span", { class: "badge " + (kind || "") }, text);
+}
+
+function formatTime(value) {
+    if (!value || value.startsWith("0001-")) {
+        return "-";
+    }
+    return new Date(value).toLocaleTimeString();
+}
+
+function formatPrice(price) {
+    return price ? price.toFixed(2) : "-";
+}
+
+function action(label, method, path) {
+    return el("button", {
+        onclick: async () => {
+            try {
+                await api(method, path);
+                showError(null);
+                refresh();
+            } catch (err) {
+                showError(err);
+            }
+        },
+    }, label);
+}
+
+// sparkline draws the prices of the product's recent checks, marking checks that found stock or failed
+function sparkline(history) {
+    const width = 160, height = 28, pad = 3;
+    const svgNS = "http://www.w3.org/2000/svg";
+    const svg = document.createElementNS(svgNS, "svg");
+    svg.setAttribute("class", "sparkline");
+    svg.setAttribute("width", width);
+    svg.setAttribute("height", height);
+    if (history.length === 0) {
+        return svg;
+    }
+
+    const prices = history.map((check) => check.price).filter((price) => price > 0);
+    const min = Math.min(...prices), max = Math.max(...prices);
+    const x = (i) => pad + (history.length === 1 ? 0 : i * (width - 2 * pad) / (history.length - 1));
+    const y = (price) => prices.length === 0 || max === min ? height / 2 : height - pad - (price - min) * (height - 2 * pad) / (max - min);
+
+    const points = [];
+    history.forEach((check, i) => {
+        if (check.price > 0) {
+            points.push(x(i) + "," + y(check.price));
+        }
+    });
+    const line = document.createElementNS(svgNS, "polyline");
+    line.setAttribute("points", points.join(" "));
+    svg.append(line);
+
+    history.forEach((check, i) => {
+        if (!check.in_stock && !check.error) {
+            return;
+        }
+        const dot = document.createElementNS(svgNS, "circle");
+        dot.setAttribute("cx", x(i));
+        dot.setAttribute("cy", check.price > 0 ? y(check.price) : height / 2);
+        dot.setAttribute("r", 2.5);
+        dot.setAttribute("class", check.in_stock ? "in-stock" : "failed");
+        const title = document.createElementNS(svgNS, "title");
+        title.textContent = formatTime(check.time) + (check.error ? " " + check.error : " in stock");
+        dot.append(title);
+        svg.append(dot);
+    });
+    return svg;
+}
+
+function renderProducts(products) {
+    const rows = products.map((product) => {
+        const status = product.status;
+        const stateKind = { running: "good", paused: "warn", stopped: "" }[product.state];
+        const stock = status.last_check ? (status.in_stock ? badge("in stock", "good") : badge("sold out")) : badge("unchecked");
+        const buttons = el("td", {},
+            product.state === "running"
+                ? action("Pause", "POST", "/api/products/" + product.id + "/pause")
+                : action("Resume", "POST", "/api/products/" + product.id + "/resume"),
+            product.state === "running" ? action("Check now", "POST", "/api/products/" + product.id + "/check") : null);
+
+        return el("tr", {},
+            el("td", {}, product.id),
+            el("td", {}, el("a", { href: product.URL, target: "_blank", rel: "noopener noreferrer" }, product.Name)),
+            el("td", {}, badge(product.state, stateKind)),
+            el("td", {}, stock),
+            el("td", {}, formatPrice(status.last_price)),
+            el("td", {}, formatTime(status.last_check)),
+            el("td", {}, sparkline(status.history)),
+            el("td", { class: "muted" }, status.errors.join("; ")),
+            buttons);
+    });
+    document.getElementById("products").replaceChildren(...rows);
+}
+
+function renderCheckouts(checkouts) {
+    const rows = checkouts.map((checkout) => el("tr", {},
+        el("td", {}, checkout.id),
+        el("td", {}, el("a", { href: checkout.url, target: "_blank", rel: "noopener noreferrer" }, checkout.product)),
+        el("td", {}, formatPrice(checkout.price)),
+        el("td", {}, formatTime(checkout.detected)),
+        el("td", {}, formatTime(checkout.expires)),
+        el("td", {},
+            action("Approve", "POST", "/api/checkouts/" + checkout.id + "/approve"),
+            action("Reject", "POST", "/api/checkouts/" + checkout.id + "/reject"))));
+    if (rows.length === 0) {
+        rows.push(el("tr", {}, el("td", { colspan: 6, class: "muted" }, "No checkouts waiting for approval")));
+    }
+    document.getElementById("checkouts").replaceChildren(...rows);
+}
+
+function renderStatus(status) {
+    const scheduler = status.pool.scheduler, browsers = status.pool.browsers;
+    const pool = [
+        ["Workers", scheduler.busy + " busy of " + scheduler.workers],
+        ["Queued checks", scheduler.queued],
+        ["Browsers", browsers.busy + " busy, " + browsers.browsers + " running of " + browsers.size],
+    ];
+    document.getElementById("pool").replaceChildren(...pool.flatMap(([term, value]) => [el("dt", {}, term), el("dd", {}, value)]));
+
+    const sessions = (status.checkout_sessions || []).map((session) => {
+        const kind = session.state === "ready" ? "good" : (session.state === "dead" || session.state === "credentials rejected" ? "bad" : "warn");
+        return el("tr", {},
+            el("td", {}, session.id),
+            el("td", {}, session.webshop),
+            el("td", {}, badge(session.state + (session.busy ? " (busy)" : ""), kind)),
+            el("td", {}, session.warm_for ? session.warm_for + (session.warm ? "" : " (cold)") : "-"),
+            el("td", {}, formatTime(session.last_health_check)),
+            el("td", { class: "muted" }, session.last_error || ""));
+    });
+    document.getElementById("sessions").replaceChildren(...sessions);
+}
+
+function describeEvent(event) {
+    const data = event.data || {};
+    switch (event.type) {
+    case "check_finished":
+        return data.error ? "check failed: " + data.error : "checked in " + data.duration_ms + "ms" + (data.price ? ", " + formatPrice(data.price) : "");
+    case "price_changed":
+        return "price " + formatPrice(data.old_price) + " → " + formatPrice(data.price);
+    case "checkout_step":
+        return "checkout (" + data.strategy + "): " + data.step + " after " + data.since_detected_ms + "ms";
+    case "session_unhealthy":
+        return "session " + data.session_id + " " + data.state + (data.error ? ": " + data.error : "");
+    case "task_restarted":
+        return "task restarted (" + data.restarts + "): " + data.last_crash;
+    default:
+        return event.type.replace(/_/g, " ") + (data.price ? ", " + formatPrice(data.price) : "");
+    }
+}
+
+function addEvent(event) {
+    lastEventID = Math.max(lastEventID, event.id);
+    // check_started is too chatty to list, the finished check says the same
+    if (event.type === "check_started") {
+        return;
+    }
+    const list = document.getElementById("events");
+    list.prepend(el("li", {},
+        el("time", {}, formatTime(event.time)),
+        event.product ? el("strong", {}, event.product + " ") : null,
+        describeEvent(event)));
+    while (list.children.length > MAX_EVENTS) {
+        list.lastChild.remove();
+    }
+    if (["in_stock", "out_of_stock", "price_changed", "check_finished", "session_unhealthy", "task_restarted"].includes(event.type)) {
+        scheduleRefresh(500);
+    }
+}
+
+// streamEvents follows the server-sent event stream. It uses fetch instead of EventSource so the token can be sent
+// in a header, and resumes after the last event it saw when the connection drops
+async function streamEvents() {
+    const connection = document.getElementById("connection");
+    for (;;) {
+        try {
+            const response = await fetch("/api/events", {
+                headers: headers({ "Accept": "text/event-stream", "Last-Event-ID": String(lastEventID) }),
+            });
+            if (!response.ok) {
+                throw new Error("event stream answered " + response.status);
+            }
+            connection.textContent = "live";
+            connection.className = "badge good";
+
+            const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+            let buffer = "";
+            for (;;) {
+                const { value, done } = await reader.read();
+                if (done) {
+                    break;
+                }
+                buffer += value;
+                let end;
+                while ((end = buffer.indexOf("\n\n")) >= 0) {
+                    const message = buffer.slice(0, end);
+                    buffer = buffer.slice(end + 2);
+                    const data = message.split("\n").filter((line) => line.startsWith("data: ")).map((line) => line.slice(6)).join("\n");
+                    if (data !== "") {
+                        addEvent(JSON.parse(data));
+                    }
+                }
+            }
+        } catch (err) {
+            console.warn(err);
+        }
+        connection.textContent = "reconnecting";
+        connection.className = "badge warn";
+        await new Promise((resolve) => setTimeout(resolve, 3000));
+    }
+}
+
+async function refresh() {
+    try {
+        const [products, checkouts, status] = await Promise.all([
+            api("GET", "/api/products"),
+            api("GET", "/api/checkouts"),
+            api("GET", "/api/status"),
+        ]);
+        renderProducts(products);
+        renderCheckouts(checkouts);
+        renderStatus(status);
+        showError(null);
+    } catch (err) {
+        showError(err);
+    }
+    scheduleRefresh(REFRESH_INTERVAL);
+}
+
+function scheduleRefresh(delay) {
+    clearTimeout(refreshTimer);
+    refreshTimer = setTimeout(refresh, delay);
+}
+
+async function start() {
+    document.getElementById("token").value = token();
+    document.getElementById("tokenform").addEventListener("submit", (event) => {
+        event.preventDefault();
+        localStorage.setItem(TOKEN_KEY, document.getElementById("token").value.trim());
+        location.reload();
+    });
+
+    await refresh();
+    try {
+        (await api("GET", "/api/events/recent?limit=" + MAX_EVENTS)).forEach(addEvent);
+    } catch (err) {
+        showError(err);
+    }
+    streamEvents();
+}
+
+start();
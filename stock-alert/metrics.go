@@ -0,0 +1,52 @@
+package main
+
+import (
+	"dolos-dev/pkg/metrics"
+)
+
+//setMetricGauges reads the gauges of the metrics endpoint from the running scheduler, browser pool, checkout sessions and tasks
+func (handler *StockAlertHandler) setMetricGauges() {
+	metrics.StockCheckWorkers.SetFunc(func() []metrics.Sample {
+		stats := handler.scheduler.Stats()
+		return []metrics.Sample{
+			{LabelValues: []string{"busy"}, Value: float64(stats.Busy)},
+			{LabelValues: []string{"idle"}, Value: float64(stats.Workers - stats.Busy)},
+		}
+	})
+	metrics.StockCheckQueue.SetFunc(func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(handler.scheduler.Stats().Queued)}}
+	})
+	metrics.CheckerBrowsers.SetFunc(func() []metrics.Sample {
+		stats := handler.checkerPool.Stats()
+		return []metrics.Sample{
+			{LabelValues: []string{"busy"}, Value: float64(stats.Busy)},
+			{LabelValues: []string{"idle"}, Value: float64(stats.Browsers - stats.Busy)},
+			{LabelValues: []string{"max"}, Value: float64(stats.Size)},
+		}
+	})
+	metrics.CheckoutSessions.SetFunc(func() []metrics.Sample {
+		if handler.seleniumHandler == nil {
+			return nil
+		}
+		samples := make([]metrics.Sample, 0)
+		for _, session := range handler.seleniumHandler.SessionStates() {
+			samples = append(samples, metrics.Sample{LabelValues: []string{session.Webshop.Name(), session.State}, Value: 1})
+		}
+		return samples
+	})
+	metrics.Tasks.SetFunc(func() []metrics.Sample {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+
+		samples := make([]metrics.Sample, 0, len(handler.taskStatuses))
+		for _, status := range handler.taskStatuses {
+			samples = append(samples, metrics.Sample{LabelValues: []string{status.displayState()}, Value: 1})
+		}
+		return samples
+	})
+	metrics.PendingCheckouts.SetFunc(func() []metrics.Sample {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+		return []metrics.Sample{{Value: float64(len(handler.pendingCheckouts))}}
+	})
+}
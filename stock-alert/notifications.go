@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/notify"
+	"dolos-dev/pkg/structs"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//testNotificationTimeout caps how long a test notification may take to get through
+const testNotificationTimeout = 30 * time.Second
+
+//screenshotPruneInterval is how often old notification screenshots are deleted
+const screenshotPruneInterval = time.Hour
+
+var errNoNotifiers = errors.New("No notifiers are running")
+
+//startNotifier creates the configured notifiers and starts feeding them the bot's events
+func (handler *StockAlertHandler) startNotifier() {
+	dispatcher, err := notify.NewDispatcher(events.Default(), handler.GlobalConfig.Notifiers, handler.GlobalConfig.NotifyRules, handler.productNotifiers, handler.GlobalConfig.NotifyDeadLetterFile)
+	if err != nil {
+		helperfuncs.Log("Not sending notifications (%v)", err)
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, name := range dispatcher.Names() {
+		names[name] = true
+	}
+	handler.mutex.RLock()
+	for _, product := range handler.ProductURLs {
+		for _, name := range product.Notifiers {
+			if !names[name] {
+				helperfuncs.Log("Product %v routes to unknown notifier %s", product.ID, name)
+			}
+		}
+	}
+	handler.mutex.RUnlock()
+
+	dispatcher.SetController(notifyController{handler: handler})
+	dispatcher.Start()
+	handler.mutex.Lock()
+	handler.notifier = dispatcher
+	handler.mutex.Unlock()
+}
+
+//pruneNotificationScreenshots deletes old notification screenshots every screenshotPruneInterval until ctx is cancelled
+func pruneNotificationScreenshots(ctx context.Context) {
+	ticker := time.NewTicker(screenshotPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		helperfuncs.PruneNotificationScreenshots()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//productNotifiers returns the per product notifiers of the product
+func (handler *StockAlertHandler) productNotifiers(productID int) []string {
+	handler.mutex.RLock()
+	defer handler.mutex.RUnlock()
+
+	for _, product := range handler.ProductURLs {
+		if product.ID == productID {
+			return product.Notifiers
+		}
+	}
+	return nil
+}
+
+//TestNotifier sends a test notification to the named notifier right away and returns why it failed, if it did
+func (handler *StockAlertHandler) TestNotifier(ctx context.Context, name string) error {
+	handler.mutex.RLock()
+	dispatcher := handler.notifier
+	handler.mutex.RUnlock()
+	if dispatcher == nil {
+		return errNoNotifiers
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, testNotificationTimeout)
+	defer cancel()
+	return dispatcher.Test(ctx, name)
+}
+
+//notifyController lets notifiers that take commands, like the telegram bot, act on the running bot
+type notifyController struct {
+	handler *StockAlertHandler
+}
+
+//Status sums up the tasks by state, the stock check pool, the checkout sessions and the pending checkouts
+func (controller notifyController) Status() string {
+	handler := controller.handler
+	handler.mutex.RLock()
+	states := make(map[string]int)
+	for _, status := range handler.taskStatuses {
+		states[status.displayState()]++
+	}
+	pending := len(handler.pendingCheckouts)
+	seleniumHandler := handler.seleniumHandler
+	handler.mutex.RUnlock()
+
+	lines := make([]string, 0)
+	stateCounts := make([]string, 0, len(states))
+	for state, count := range states {
+		stateCounts = append(stateCounts, fmt.Sprintf("%v %s", count, state))
+	}
+	sort.Strings(stateCounts)
+	if len(stateCounts) == 0 {
+		stateCounts = append(stateCounts, "none")
+	}
+	lines = append(lines, "Tasks: "+strings.Join(stateCounts, ", "))
+
+	if handler.scheduler != nil {
+		pool := handler.poolStatus()
+		lines = append(lines, fmt.Sprintf("Stock checks: %v/%v workers busy, %v queued, %v/%v browsers busy",
+			pool.Scheduler.Busy, pool.Scheduler.Workers, pool.Scheduler.Queued, pool.Browsers.Busy, pool.Browsers.Size))
+	}
+
+	if seleniumHandler != nil {
+		sessions := seleniumHandler.SessionStates()
+		lines = append(lines, fmt.Sprintf("Checkout sessions: %v", len(sessions)))
+		for _, session := range sessions {
+			line := fmt.Sprintf("  #%v %s %s", session.ID, session.Webshop.Name(), session.State)
+			if session.Busy {
+				line += ", checking out"
+			}
+			if session.LastError != "" {
+				line += ", last error: " + session.LastError
+			}
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, fmt.Sprintf("Pending checkouts: %v", pending))
+	return strings.Join(lines, "\n")
+}
+
+//Products lists every product with its state and what its last check found
+func (controller notifyController) Products() string {
+	views := controller.handler.productViews(0)
+	if len(views) == 0 {
+		return "No products"
+	}
+
+	lines := make([]string, 0, len(views))
+	for _, view := range views {
+		stock := "not checked yet"
+		if view.Status.LastCheck != nil {
+			stock = "sold out"
+			if view.Status.InStock {
+				stock = "in stock"
+			}
+			stock += fmt.Sprintf(" %v ago", time.Since(*view.Status.LastCheck).Round(time.Second))
+		}
+		line := fmt.Sprintf("#%v %s: %s, %s", view.ID, view.Name, view.State, stock)
+		if view.Status.LastPrice > 0 {
+			line += fmt.Sprintf(", %.2f", view.Status.LastPrice)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (controller notifyController) PauseProduct(id int) error {
+	_, err := controller.handler.SetProductState(id, structs.PRODUCT_STATE_PAUSED)
+	return err
+}
+
+func (controller notifyController) ResumeProduct(id int) error {
+	_, err := controller.handler.SetProductState(id, structs.PRODUCT_STATE_RUNNING)
+	return err
+}
+
+func (controller notifyController) CheckProduct(id int) error {
+	return controller.handler.CheckNow(id)
+}
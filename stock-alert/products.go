@@ -0,0 +1,282 @@
+package main
+
+import (
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/structs"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//errProductNotFound is returned by the product manager for IDs it doesn't know
+var errProductNotFound = errors.New("Product not found")
+
+//managedProduct is a product the product manager runs stock check tasks for
+type managedProduct struct {
+	//product is the same pointer as in ProductURLs, so changes are saved with the state. It holds the fields as the user
+	//set them, helperfuncs.ProductDefaults fills in the rest
+	product  *structs.ProductURL
+	schedule *productSchedule
+	//taskIDs are the IDs of the product's running tasks, empty while it is stopped
+	taskIDs []int
+}
+
+//startProducts gives the loaded products without one an ID and starts the tasks of all products that aren't stopped
+func (handler *StockAlertHandler) startProducts() {
+	handler.productsMutex.Lock()
+	defer handler.productsMutex.Unlock()
+
+	handler.mutex.Lock()
+	assigned := assignProductIDs(handler.ProductURLs)
+	products := handler.ProductURLs
+	handler.mutex.Unlock()
+
+	for _, product := range products {
+		managed := &managedProduct{
+			product: product,
+		}
+		handler.products[product.ID] = managed
+		if product.State != structs.PRODUCT_STATE_STOPPED {
+			handler.startProductTasks(managed)
+		}
+	}
+
+	if assigned {
+		//keep the IDs stable across restarts
+		handler.saveProducts()
+	}
+}
+
+//assignProductIDs gives every product without a unique ID the next free one and reports whether it changed any
+func assignProductIDs(products []*structs.ProductURL) bool {
+	maxID := 0
+	for _, product := range products {
+		if product.ID > maxID {
+			maxID = product.ID
+		}
+	}
+
+	assigned := false
+	seen := make(map[int]bool)
+	for _, product := range products {
+		if product.ID <= 0 || seen[product.ID] {
+			maxID++
+			product.ID = maxID
+			assigned = true
+		}
+		seen[product.ID] = true
+	}
+	return assigned
+}
+
+//AddProduct validates a new product, gives it an ID, saves it and starts checking it
+func (handler *StockAlertHandler) AddProduct(product structs.ProductURL) (structs.ProductURL, error) {
+	err := helperfuncs.NormalizeProduct(&product)
+	if err != nil {
+		return product, err
+	}
+	product.CurrentPurchases = 0
+
+	handler.productsMutex.Lock()
+	defer handler.productsMutex.Unlock()
+
+	handler.mutex.Lock()
+	product.ID = 0
+	for _, existing := range handler.ProductURLs {
+		if existing.ID >= product.ID {
+			product.ID = existing.ID + 1
+		}
+	}
+	if product.ID == 0 {
+		product.ID = 1
+	}
+	added := &product
+	handler.ProductURLs = append(handler.ProductURLs, added)
+	handler.mutex.Unlock()
+
+	managed := &managedProduct{
+		product: added,
+	}
+	handler.products[added.ID] = managed
+	if added.State != structs.PRODUCT_STATE_STOPPED {
+		handler.startProductTasks(managed)
+	}
+	helperfuncs.Log("Added product %s (ID %v) with %v thread(s)", added.Name, added.ID, len(managed.taskIDs))
+
+	handler.saveProducts()
+	return helperfuncs.ProductDefaults(product), nil
+}
+
+//UpdateProduct replaces the settings of a product and restarts its tasks with them. The product keeps its ID and purchase
+//count, and its state unless the update sets one
+func (handler *StockAlertHandler) UpdateProduct(id int, product structs.ProductURL) (structs.ProductURL, error) {
+	handler.productsMutex.Lock()
+	defer handler.productsMutex.Unlock()
+
+	managed, ok := handler.products[id]
+	if !ok {
+		return product, errProductNotFound
+	}
+
+	handler.mutex.RLock()
+	product.ID = id
+	product.CurrentPurchases = managed.product.CurrentPurchases
+	if product.State == "" {
+		product.State = managed.product.State
+	}
+	handler.mutex.RUnlock()
+	err := helperfuncs.NormalizeProduct(&product)
+	if err != nil {
+		return product, err
+	}
+
+	handler.stopProductTasks(managed)
+	handler.mutex.Lock()
+	*managed.product = product
+	handler.mutex.Unlock()
+	if product.State != structs.PRODUCT_STATE_STOPPED {
+		handler.startProductTasks(managed)
+	}
+	helperfuncs.Log("Updated product %s (ID %v)", product.Name, id)
+
+	handler.saveProducts()
+	return helperfuncs.ProductDefaults(product), nil
+}
+
+//SetProductState starts, pauses or stops a product. Paused products keep their tasks and proxies, stopped ones don't
+func (handler *StockAlertHandler) SetProductState(id int, state string) (structs.ProductURL, error) {
+	handler.productsMutex.Lock()
+	defer handler.productsMutex.Unlock()
+
+	managed, ok := handler.products[id]
+	if !ok {
+		return structs.ProductURL{}, errProductNotFound
+	}
+
+	switch state {
+	case structs.PRODUCT_STATE_RUNNING, structs.PRODUCT_STATE_PAUSED:
+		handler.mutex.Lock()
+		managed.product.State = state
+		handler.mutex.Unlock()
+		if len(managed.taskIDs) == 0 {
+			handler.startProductTasks(managed)
+		} else {
+			managed.schedule.setPaused(state == structs.PRODUCT_STATE_PAUSED)
+		}
+	case structs.PRODUCT_STATE_STOPPED:
+		handler.stopProductTasks(managed)
+		handler.mutex.Lock()
+		managed.product.State = state
+		handler.mutex.Unlock()
+	default:
+		return *managed.product, fmt.Errorf("Unknown product state %s", state)
+	}
+
+	handler.mutex.RLock()
+	product := *managed.product
+	handler.mutex.RUnlock()
+	helperfuncs.Log("Product %s (ID %v) is %s", product.Name, id, state)
+
+	handler.saveProducts()
+	return helperfuncs.ProductDefaults(product), nil
+}
+
+//RemoveProduct stops a product's tasks and deletes it from the product config
+func (handler *StockAlertHandler) RemoveProduct(id int) error {
+	handler.productsMutex.Lock()
+	defer handler.productsMutex.Unlock()
+
+	managed, ok := handler.products[id]
+	if !ok {
+		return errProductNotFound
+	}
+
+	handler.stopProductTasks(managed)
+	delete(handler.products, id)
+	handler.mutex.Lock()
+	for i, product := range handler.ProductURLs {
+		if product == managed.product {
+			handler.ProductURLs = append(handler.ProductURLs[:i], handler.ProductURLs[i+1:]...)
+			break
+		}
+	}
+	handler.mutex.Unlock()
+	helperfuncs.Log("Removed product %s (ID %v)", managed.product.Name, id)
+
+	handler.saveProducts()
+	return nil
+}
+
+//CheckNow moves the next check of every thread of a running product to now
+func (handler *StockAlertHandler) CheckNow(id int) error {
+	handler.productsMutex.Lock()
+	defer handler.productsMutex.Unlock()
+
+	managed, ok := handler.products[id]
+	if !ok {
+		return errProductNotFound
+	}
+	handler.mutex.RLock()
+	product := helperfuncs.ProductDefaults(*managed.product)
+	handler.mutex.RUnlock()
+	state, name := product.State, product.Name
+	if state != structs.PRODUCT_STATE_RUNNING {
+		return fmt.Errorf("Product %v is %s", id, state)
+	}
+
+	now := time.Now()
+	for _, taskID := range managed.taskIDs {
+		handler.scheduler.Schedule(taskID, now)
+	}
+	helperfuncs.Log("Checking product %s (ID %v) now", name, id)
+	return nil
+}
+
+//startProductTasks starts a task for every thread of the product. The caller holds productsMutex
+func (handler *StockAlertHandler) startProductTasks(managed *managedProduct) {
+	handler.mutex.RLock()
+	product := helperfuncs.ProductDefaults(*managed.product)
+	globalConfig := *handler.GlobalConfig
+	handler.mutex.RUnlock()
+
+	//the schedule staggers the product's threads over its check interval
+	schedule := newProductSchedule(product.Threads)
+	schedule.carryOver(managed.schedule)
+	managed.schedule = schedule
+	managed.schedule.setPaused(product.State == structs.PRODUCT_STATE_PAUSED)
+	managed.taskIDs = make([]int, 0, product.Threads)
+	for i := 0; i < product.Threads; i++ {
+		handler.mutex.Lock()
+		handler.lastTaskID++
+		taskID := handler.lastTaskID
+		handler.mutex.Unlock()
+
+		managed.taskIDs = append(managed.taskIDs, taskID)
+		handler.superviseTask(taskID, product, globalConfig, managed.schedule, i)
+	}
+}
+
+//stopProductTasks stops the product's tasks, frees their proxies and forgets their status. The caller holds productsMutex
+func (handler *StockAlertHandler) stopProductTasks(managed *managedProduct) {
+	for _, taskID := range managed.taskIDs {
+		handler.scheduler.Remove(taskID)
+
+		handler.mutex.Lock()
+		handler.releaseTask(taskID)
+		delete(handler.supervised, taskID)
+		delete(handler.taskStatuses, taskID)
+		handler.mutex.Unlock()
+	}
+	managed.taskIDs = nil
+}
+
+//saveProducts writes the products to the product config. The running products are changed either way, so a failure is only logged
+func (handler *StockAlertHandler) saveProducts() {
+	handler.mutex.RLock()
+	defer handler.mutex.RUnlock()
+
+	err := helperfuncs.SaveState(handler.ProductURLs)
+	if err != nil {
+		helperfuncs.Log("Failed to save products (%v)", err)
+	}
+}
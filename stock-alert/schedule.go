@@ -0,0 +1,182 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+//productSchedule spreads the checks of a product's threads evenly over the check interval and shares their findings.
+//Thread i of N checks at start + i*interval/N + k*interval, so the threads stay phase locked instead of drifting together
+type productSchedule struct {
+	mutex   sync.Mutex
+	threads int
+	start   time.Time
+
+	//stockFoundBy is the task that last found the product in stock, 0 if none
+	stockFoundBy int
+	stockFoundAt time.Time
+	//checkingOut is set while stockFoundBy is checking the product out
+	checkingOut bool
+	//paused makes the product's threads skip their checks
+	paused bool
+	//inStock and price are the findings of the product's last successful check, price is 0 if it saw no offer
+	inStock bool
+	price   float64
+	//history holds the product's most recent checks, oldest first
+	history []CheckRecord
+}
+
+//maxCheckHistory is how many checks of a product are kept for its history
+const maxCheckHistory = 60
+
+//defaultCheckInterval is used instead of an interval of 0 (e.g. a webshop without a configured interval), which would
+//run the checks back to back
+const defaultCheckInterval = time.Second
+
+//CheckRecord is the outcome of a single check of a product
+type CheckRecord struct {
+	Time     time.Time     `json:"time"`
+	TaskID   int           `json:"task_id"`
+	InStock  bool          `json:"in_stock"`
+	Price    float64       `json:"price,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func newProductSchedule(threads int) *productSchedule {
+	if threads < 1 {
+		threads = 1
+	}
+	return &productSchedule{
+		threads: threads,
+		start:   time.Now(),
+	}
+}
+
+//offset returns the first slot of the given (0 based) thread
+func (schedule *productSchedule) offset(thread int, interval time.Duration) time.Time {
+	return schedule.start.Add(time.Duration(thread%schedule.threads) * interval / time.Duration(schedule.threads))
+}
+
+//firstSlot returns when the given thread should check for the first time
+func (schedule *productSchedule) firstSlot(thread int, interval time.Duration) time.Time {
+	return schedule.offset(thread, interval)
+}
+
+//nextSlot returns the thread's first slot after now
+func (schedule *productSchedule) nextSlot(thread int, interval time.Duration, now time.Time) time.Time {
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	offset := schedule.offset(thread, interval)
+	if now.Before(offset) {
+		return offset
+	}
+	periods := now.Sub(offset)/interval + 1
+	return offset.Add(periods * interval)
+}
+
+//claimStock records that the task found the product in stock and starts checking it out. It returns false if another task
+//already did and is still checking it out
+func (schedule *productSchedule) claimStock(taskID int) bool {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	if schedule.checkingOut && schedule.stockFoundBy != taskID {
+		return false
+	}
+	schedule.stockFoundBy = taskID
+	schedule.stockFoundAt = time.Now()
+	schedule.checkingOut = true
+	return true
+}
+
+//releaseStock records that the task finished checking out
+func (schedule *productSchedule) releaseStock(taskID int) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	if schedule.stockFoundBy == taskID {
+		schedule.checkingOut = false
+	}
+}
+
+//skipCheck reports whether the task can skip its check because another task is checking the product out or found it in stock
+//less than an interval ago. It returns that task and when it found the stock
+func (schedule *productSchedule) skipCheck(taskID int, interval time.Duration) (bool, int, time.Time) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	if schedule.stockFoundBy == 0 || schedule.stockFoundBy == taskID {
+		return false, 0, time.Time{}
+	}
+	skip := schedule.checkingOut || time.Since(schedule.stockFoundAt) < interval
+	return skip, schedule.stockFoundBy, schedule.stockFoundAt
+}
+
+//setPaused pauses or resumes the checks of all of the product's threads
+func (schedule *productSchedule) setPaused(paused bool) {
+	schedule.mutex.Lock()
+	schedule.paused = paused
+	schedule.mutex.Unlock()
+}
+
+//isPaused reports whether the product's checks are paused
+func (schedule *productSchedule) isPaused() bool {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	return schedule.paused
+}
+
+//wasInStock reports whether the product's last successful check found it in stock
+func (schedule *productSchedule) wasInStock() bool {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	return schedule.inStock
+}
+
+//observeCheck records the findings of a successful check of any of the product's threads. It returns whether the product was
+//in stock before and its previous price, 0 if none was seen yet
+func (schedule *productSchedule) observeCheck(inStock bool, price float64) (wasInStock bool, oldPrice float64) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	wasInStock, oldPrice = schedule.inStock, schedule.price
+	schedule.inStock = inStock
+	if price > 0 {
+		schedule.price = price
+	}
+	return wasInStock, oldPrice
+}
+
+//recordCheck adds a check of any of the product's threads to its history
+func (schedule *productSchedule) recordCheck(record CheckRecord) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	schedule.history = append(schedule.history, record)
+	if len(schedule.history) > maxCheckHistory {
+		schedule.history = schedule.history[len(schedule.history)-maxCheckHistory:]
+	}
+}
+
+//checks returns a copy of the product's check history and its last known price
+func (schedule *productSchedule) checks() ([]CheckRecord, float64) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+
+	return append(make([]CheckRecord, 0, len(schedule.history)), schedule.history...), schedule.price
+}
+
+//carryOver keeps what the previous schedule of the product found, so the history survives restarting the product's tasks
+func (schedule *productSchedule) carryOver(previous *productSchedule) {
+	if previous == nil {
+		return
+	}
+	history, price := previous.checks()
+
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	schedule.history = history
+	schedule.price = price
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"dolos-dev/pkg/helperfuncs"
+	"net/http"
+	"time"
+)
+
+//phases of the shutdown, in the order they run. shutdown_timeouts overrides their deadlines (in seconds) by name
+const (
+	SHUTDOWN_PHASE_STOCK_CHECKS = "stock_checks"
+	SHUTDOWN_PHASE_CHECKOUTS    = "checkouts"
+	SHUTDOWN_PHASE_STATE        = "state"
+	SHUTDOWN_PHASE_BROWSERS     = "browsers"
+	SHUTDOWN_PHASE_SERVICES     = "services"
+)
+
+//defaultShutdownTimeouts are the deadlines of the shutdown phases if shutdown_timeouts doesn't set them
+var defaultShutdownTimeouts = map[string]time.Duration{
+	SHUTDOWN_PHASE_STOCK_CHECKS: 30 * time.Second,
+	SHUTDOWN_PHASE_CHECKOUTS:    2 * time.Minute,
+	SHUTDOWN_PHASE_STATE:        10 * time.Second,
+	SHUTDOWN_PHASE_BROWSERS:     30 * time.Second,
+	SHUTDOWN_PHASE_SERVICES:     10 * time.Second,
+}
+
+//shutdownControl holds what the shutdown has to stop. It is filled in by main as the services start
+type shutdownControl struct {
+	stopStockChecks context.CancelFunc
+	stopCheckouts   context.CancelFunc
+	apiServer       *http.Server
+}
+
+//shutdownTimeout returns the deadline of the given shutdown phase
+func (handler *StockAlertHandler) shutdownTimeout(phase string) time.Duration {
+	if handler.GlobalConfig != nil {
+		if seconds, ok := handler.GlobalConfig.ShutdownTimeouts[phase]; ok && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultShutdownTimeouts[phase]
+}
+
+//runShutdownPhase runs a phase of the shutdown and gives up waiting for it once its deadline passed. The phase gets a
+//context that is cancelled at the deadline. It returns false if the phase did not finish in time
+func (handler *StockAlertHandler) runShutdownPhase(phase string, run func(ctx context.Context)) bool {
+	timeout := handler.shutdownTimeout(phase)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	helperfuncs.Log("Shutdown: %s (deadline %v)", phase, timeout)
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+
+	select {
+	case <-done:
+		helperfuncs.Log("Shutdown: %s done after %v", phase, time.Since(start).Round(time.Millisecond))
+		return true
+	case <-ctx.Done():
+		helperfuncs.Log("Shutdown: %s did not finish within %v, moving on", phase, timeout)
+		return false
+	}
+}
+
+//shutdown stops everything in order: no new stock checks, finish (or abort) running checkouts, save the state and
+//cookies, quit the browsers and stop the services. Every phase has its own deadline
+func (handler *StockAlertHandler) shutdown(control *shutdownControl) {
+	handler.mutex.RLock()
+	stopStockChecks := control.stopStockChecks
+	stopCheckouts := control.stopCheckouts
+	apiServer := control.apiServer
+	notifier := handler.notifier
+	seleniumHandler := handler.seleniumHandler
+	stockScheduler := handler.scheduler
+	handler.mutex.RUnlock()
+
+	handler.runShutdownPhase(SHUTDOWN_PHASE_STOCK_CHECKS, func(ctx context.Context) {
+		//cancelling the stock checks also stops the checkout bursts from starting new checkouts
+		stopStockChecks()
+		if stockScheduler != nil {
+			stockScheduler.Wait()
+		}
+	})
+
+	finished := handler.runShutdownPhase(SHUTDOWN_PHASE_CHECKOUTS, func(ctx context.Context) {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			running := handler.runningCheckouts()
+			if running == 0 {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	if !finished {
+		helperfuncs.Log("Shutdown: aborting %v running checkout(s)", handler.runningCheckouts())
+	}
+	//stops the checkout sessions' supervisors, checkouts still running fail once their browsers quit
+	stopCheckouts()
+
+	handler.runShutdownPhase(SHUTDOWN_PHASE_STATE, func(ctx context.Context) {
+		handler.mutex.RLock()
+		err := helperfuncs.SaveState(handler.ProductURLs)
+		handler.mutex.RUnlock()
+		if err != nil {
+			helperfuncs.Log("Shutdown: failed to save product state (%v)", err)
+		}
+
+		if seleniumHandler != nil {
+			err = seleniumHandler.SaveCookies()
+			if err != nil {
+				helperfuncs.Log("Shutdown: %v", err)
+			}
+		}
+	})
+
+	finished = handler.runShutdownPhase(SHUTDOWN_PHASE_BROWSERS, func(ctx context.Context) {
+		if handler.checkerPool != nil {
+			handler.checkerPool.CloseAll()
+		}
+		if seleniumHandler != nil {
+			seleniumHandler.QuitSessions()
+		}
+	})
+	if !finished {
+		//browsers that didn't quit in time would outlive us. Only ours, other chromedrivers on the machine are left alone
+		helperfuncs.KillChildProcesses("chromedriver.exe")
+	}
+
+	handler.runShutdownPhase(SHUTDOWN_PHASE_SERVICES, func(ctx context.Context) {
+		if notifier != nil {
+			//delivers what is still queued, the rest ends up in the dead letter log
+			notifier.Stop(ctx)
+		}
+		if apiServer != nil {
+			err := apiServer.Shutdown(ctx)
+			if err != nil {
+				helperfuncs.Log("Shutdown: failed to stop the API server (%v)", err)
+			}
+		}
+		if seleniumHandler != nil {
+			seleniumHandler.StopService()
+		}
+	})
+}
+
+//runningCheckouts returns how many checkouts are in flight
+func (handler *StockAlertHandler) runningCheckouts() int {
+	handler.mutex.RLock()
+	defer handler.mutex.RUnlock()
+	return handler.checkoutsRunning
+}
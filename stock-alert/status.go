@@ -0,0 +1,179 @@
+package main
+
+import (
+	seleniumdriver "dolos-dev/pkg/driver/selenium"
+	"dolos-dev/pkg/ratelimit"
+	"dolos-dev/pkg/scheduler"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//TaskStatus is the last known state of a single stock checker task
+type TaskStatus struct {
+	TaskID    int       `json:"task_id"`
+	ProductID int       `json:"product_id"`
+	Product   string    `json:"product"`
+	CheckMode string    `json:"check_mode"`
+	LastCheck time.Time `json:"last_check"`
+	InStock   bool      `json:"in_stock"`
+	LastError string    `json:"last_error,omitempty"`
+	//Failures is the number of failed checks in a row
+	Failures      int        `json:"failures"`
+	BackoffUntil  *time.Time `json:"backoff_until,omitempty"`
+	BackoffReason string     `json:"backoff_reason,omitempty"`
+	//Interval is the check interval the product's schedule applies right now, Paused is set while the schedule or the product's state pauses checks
+	Interval time.Duration `json:"interval"`
+	Paused   bool          `json:"paused"`
+	//NextCheck is when the scheduler runs the task next, nil if it is running or stopped
+	NextCheck *time.Time `json:"next_check,omitempty"`
+	//State is one of the TASK_STATE_ constants. Restarts counts the restarts since the task last checked successfully,
+	//Crashes all crashes of the task with the reason of the last one
+	State       string     `json:"state"`
+	Restarts    int        `json:"restarts"`
+	Crashes     int        `json:"crashes"`
+	LastCrash   string     `json:"last_crash,omitempty"`
+	LastCrashAt *time.Time `json:"last_crash_at,omitempty"`
+	RestartAt   *time.Time `json:"restart_at,omitempty"`
+}
+
+//Status is the response of the status endpoint
+type Status struct {
+	Tasks            []TaskStatus                 `json:"tasks"`
+	CheckoutSessions []seleniumdriver.SessionInfo `json:"checkout_sessions"`
+	RateLimits       []ratelimit.HostState        `json:"rate_limits"`
+	Pool             PoolStatus                   `json:"pool"`
+}
+
+//PoolStatus is the state of the stock check workers and the browsers they share
+type PoolStatus struct {
+	Scheduler scheduler.Stats                 `json:"scheduler"`
+	Browsers  seleniumdriver.CheckerPoolStats `json:"browsers"`
+}
+
+//updateTaskStatus records the result of a check of the given task. Tasks that were stopped meanwhile are ignored
+func (handler *StockAlertHandler) updateTaskStatus(taskID int, update func(*TaskStatus)) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	if _, ok := handler.supervised[taskID]; !ok {
+		return
+	}
+
+	status, ok := handler.taskStatuses[taskID]
+	if !ok {
+		status = &TaskStatus{TaskID: taskID}
+		handler.taskStatuses[taskID] = status
+	}
+	update(status)
+}
+
+//displayState returns the task's state, telling starting and paused tasks apart from running ones
+func (status *TaskStatus) displayState() string {
+	if status.State == "" {
+		return "starting"
+	}
+	if status.State == TASK_STATE_RUNNING && status.Paused {
+		return "paused"
+	}
+	return status.State
+}
+
+//setBackoffStatus copies the backoff state of a task into its status
+func setBackoffStatus(status *TaskStatus, backoff *checkBackoff) {
+	status.Failures = backoff.failures
+	status.BackoffReason = backoff.reason
+	status.BackoffUntil = nil
+	if backoff.active() {
+		until := backoff.until
+		status.BackoffUntil = &until
+	}
+}
+
+//StatusHandler handles http requests for the state of all stock checker tasks and checkout sessions
+func (handler *StockAlertHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		logAndWriteResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := Status{
+		Tasks:      make([]TaskStatus, 0),
+		RateLimits: ratelimit.States(),
+	}
+
+	handler.mutex.RLock()
+	for _, taskStatus := range handler.taskStatuses {
+		status.Tasks = append(status.Tasks, *taskStatus)
+	}
+	seleniumHandler := handler.seleniumHandler
+	handler.mutex.RUnlock()
+
+	sort.Slice(status.Tasks, func(i, j int) bool {
+		return status.Tasks[i].TaskID < status.Tasks[j].TaskID
+	})
+	if handler.scheduler != nil {
+		for i := range status.Tasks {
+			if due, ok := handler.scheduler.Due(status.Tasks[i].TaskID); ok {
+				status.Tasks[i].NextCheck = &due
+			}
+		}
+		status.Pool = handler.poolStatus()
+	}
+	if seleniumHandler != nil {
+		status.CheckoutSessions = seleniumHandler.SessionStates()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		logAndWriteResponse(w, "Failed to encode status (%v)", http.StatusInternalServerError, err)
+	}
+}
+
+func (handler *StockAlertHandler) poolStatus() PoolStatus {
+	return PoolStatus{
+		Scheduler: handler.scheduler.Stats(),
+		Browsers:  handler.checkerPool.Stats(),
+	}
+}
+
+//PoolHandler handles http requests for the size of the stock check pool. A POST with "workers" and/or "browsers" resizes it at runtime
+func (handler *StockAlertHandler) PoolHandler(w http.ResponseWriter, r *http.Request) {
+	if handler.scheduler == nil {
+		logAndWriteResponse(w, "Stock checks are not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if workers := r.FormValue("workers"); workers != "" {
+			size, err := strconv.Atoi(workers)
+			if err != nil || size < 1 {
+				logAndWriteResponse(w, "Invalid worker count %s", http.StatusBadRequest, workers)
+				return
+			}
+			handler.scheduler.Resize(size)
+		}
+		if browsers := r.FormValue("browsers"); browsers != "" {
+			size, err := strconv.Atoi(browsers)
+			if err != nil || size < 1 {
+				logAndWriteResponse(w, "Invalid browser count %s", http.StatusBadRequest, browsers)
+				return
+			}
+			handler.checkerPool.Resize(size)
+		}
+	default:
+		logAndWriteResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(handler.poolStatus())
+	if err != nil {
+		logAndWriteResponse(w, "Failed to encode pool status (%v)", http.StatusInternalServerError, err)
+	}
+}
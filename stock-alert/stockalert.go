@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +13,10 @@ import (
 
 	seleniumdriver "dolos-dev/pkg/driver/selenium"
 	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/notify"
+	"dolos-dev/pkg/ratelimit"
+	"dolos-dev/pkg/scheduler"
 	"dolos-dev/pkg/structs"
 )
 
@@ -26,44 +29,62 @@ type StockAlertHandler struct {
 	GlobalConfig *structs.GlobalConfig
 	Proxies      []*structs.Proxy
 
-	seleniumHandler *seleniumdriver.SeleniumHandler
-
-	metrics metrics
-}
+	//products holds the product manager's products by ID. productsMutex serializes starting, stopping and updating them
+	products      map[int]*managedProduct
+	productsMutex sync.Mutex
 
-type metrics struct {
-	inStockSeen int
-	heBorght    int
-	captchaSeen int
+	seleniumHandler *seleniumdriver.SeleniumHandler
+	taskStatuses    map[int]*TaskStatus
+
+	//tasks holds every stock check task by ID, the scheduler runs them on its workers with browsers from checkerPool.
+	//supervised holds what is needed to restart them, a crashed task is in supervised but not in tasks
+	tasks       map[int]*stockTask
+	supervised  map[int]*supervisedTask
+	lastTaskID  int
+	scheduler   *scheduler.Scheduler
+	checkerPool *seleniumdriver.CheckerPool
+	//stockCheckCtx is cancelled once the shutdown starts, checkout bursts stop starting new checkouts then
+	stockCheckCtx context.Context
+	//checkoutsRunning counts the checkouts in flight, the shutdown waits for them
+	checkoutsRunning int
+	//pendingCheckouts holds the checkouts waiting for approval by ID
+	pendingCheckouts map[int]*PendingCheckout
+	lastCheckoutID   int
+	//notifier sends the bot's events to the configured notifiers, nil if none could be started
+	notifier *notify.Dispatcher
 }
 
 func main() {
 	sigStopServerSignal := make(chan os.Signal, 1)
 	chanReadyForExit := make(chan bool, 1)
-	var wgSeleniumExit sync.WaitGroup
 	signal.Notify(sigStopServerSignal, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT)
 
 	handler := StockAlertHandler{
 		CaptchaSolver: make(map[string]*structs.CaptchaWrapper),
+		taskStatuses:  make(map[int]*TaskStatus),
+		tasks:         make(map[int]*stockTask),
+		supervised:    make(map[int]*supervisedTask),
+		products:      make(map[int]*managedProduct),
+
+		pendingCheckouts: make(map[int]*PendingCheckout),
 	}
 
 	ctxStockChecker, stockCheckerCancel := context.WithCancel(context.Background())
 	ctxCheckout, checkoutCancel := context.WithCancel(context.Background())
+	handler.stockCheckCtx = ctxStockChecker
+	control := &shutdownControl{
+		stopStockChecks: stockCheckerCancel,
+		stopCheckouts:   checkoutCancel,
+	}
 	go func() {
 		<-sigStopServerSignal
-		log.Println("Stopping server...")
-		time.Sleep(10 * time.Second)
-		stockCheckerCancel()
-		//wait for all selenium stock checker processes to be terminated
-		wgSeleniumExit.Wait()
-		fmt.Println("Exiting all checkout processes")
-		checkoutCancel()
-		handler.mutex.Lock()
-		handler.seleniumHandler.CloseAll()
-		fmt.Println("Closed all selenium checkout related processes")
-		handler.exitHandler()
-		handler.mutex.Unlock()
-		helperfuncs.KillProcesses("chromedriver.exe", "OpenJDK Platform binary", "Runtime Broker")
+		log.Println("Stopping server... (send the signal again to exit right away)")
+		go func() {
+			<-sigStopServerSignal
+			log.Println("Forcing exit")
+			os.Exit(1)
+		}()
+		handler.shutdown(control)
 		chanReadyForExit <- true
 	}()
 
@@ -74,6 +95,17 @@ func main() {
 	}
 	helperfuncs.Log("Configuration files loaded: \n\t%v product config(s) found \n\t%v proxies found", len(handler.ProductURLs), len(handler.Proxies))
 
+	hostTimeouts := make(map[string]time.Duration)
+	for host, timeout := range handler.GlobalConfig.HTTPHostTimeouts {
+		hostTimeouts[host] = time.Duration(timeout) * time.Second
+	}
+	httpclient.Configure(httpclient.Settings{
+		Timeout:      time.Duration(handler.GlobalConfig.HTTPTimeout) * time.Second,
+		HostTimeouts: hostTimeouts,
+		MaxBodySize:  handler.GlobalConfig.HTTPMaxBodySize,
+	})
+	ratelimit.Configure(handler.GlobalConfig.RateLimitDefault, handler.GlobalConfig.RateLimits)
+
 	seleniumHandler, err := seleniumdriver.Init()
 	if err != nil {
 		helperfuncs.Log("Failed to init selenium service (%v)", err)
@@ -86,40 +118,75 @@ func main() {
 		helperfuncs.Log("Failed to start selenium browser instances (%v)", err)
 	}
 
-	ij := 0
-	for _, product := range handler.ProductURLs {
-		for i := 0; i < product.Threads; i++ {
-			ij++
-			handler.mutex.Lock()
-			go handler.stockChecker(&wgSeleniumExit, ctxStockChecker, *product, *handler.GlobalConfig, ij)
-			handler.mutex.Unlock()
-			wgSeleniumExit.Add(1)
-			time.Sleep(5000 * time.Millisecond)
-		}
+	//stock checks are run by a bounded number of workers, browser checks share a bounded number of browsers which are
+	//replaced with browsers using the tasks' current proxies as often as the tasks change them
+	browserMaxAge := time.Duration(0)
+	if handler.GlobalConfig.AmazonUseProxies && handler.GlobalConfig.AmazonProxyLifetime > 0 {
+		browserMaxAge = time.Duration(handler.GlobalConfig.AmazonProxyLifetime) * time.Minute
 	}
+	handler.checkerPool = seleniumHandler.NewCheckerPool(handler.GlobalConfig.StockCheckBrowsers, browserMaxAge)
+	handler.scheduler = scheduler.New(handler.GlobalConfig.StockCheckWorkers, handler.runStockCheck)
+	handler.scheduler.Start(ctxStockChecker)
+	handler.setMetricGauges()
 
-	//Initialize our REST API router & endpoints
-	mux := http.NewServeMux()
+	//starts the tasks of every product that isn't stopped, products added through the API start right away
+	handler.startProducts()
 
-	//game related routes
-	mux.HandleFunc("/api/addproducturl", corsHandler(handler.CreateProductURLHandler))
-	mux.HandleFunc("/api/captchasolver", corsHandler(handler.CaptchaSolverHandler))
-	mux.HandleFunc("/api/test", corsHandler(handler.Test))
+	//notifiers get the events of the products from here on
+	handler.startNotifier()
+	go pruneNotificationScreenshots(ctxStockChecker)
 
-	//serve the API on port 3077
-	go http.ListenAndServe(":3077", mux)
+	//Initialize our REST API router & endpoints
+	auth, err := newAPIAuth(handler.GlobalConfig.APITokens, handler.apiListen(), handler.GlobalConfig.APIHosts)
+	if err != nil {
+		helperfuncs.Log("Not serving the API (%v)", err)
+	} else {
+		handler.serveAPI(control, handler.newRouter(auth))
+	}
 
 	<-chanReadyForExit
 
 	log.Println("Server stopped")
 }
 
-func (handler *StockAlertHandler) hekill() {
-
+//apiListen returns the address the API listens on
+func (handler *StockAlertHandler) apiListen() string {
+	if handler.GlobalConfig.APIListen == "" {
+		return defaultAPIListen
+	}
+	return handler.GlobalConfig.APIListen
 }
 
-func (handler *StockAlertHandler) exitHandler() {
+//serveAPI serves the API on the configured address, over TLS if a certificate and key are configured
+func (handler *StockAlertHandler) serveAPI(control *shutdownControl, router http.Handler) {
+	listen := handler.apiListen()
+	certFile, keyFile := handler.GlobalConfig.APITLSCert, handler.GlobalConfig.APITLSKey
+	if (certFile == "") != (keyFile == "") {
+		helperfuncs.Log("Not serving the API, api_tls_cert and api_tls_key have to be set together")
+		return
+	}
 
+	apiServer := &http.Server{
+		Addr:    listen,
+		Handler: withCORS(handler.GlobalConfig.APICORSOrigins, router),
+	}
+	handler.mutex.Lock()
+	control.apiServer = apiServer
+	handler.mutex.Unlock()
+
+	go func() {
+		var err error
+		if certFile != "" {
+			helperfuncs.Log("Serving the API on https://%s", listen)
+			err = apiServer.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			helperfuncs.Log("Serving the API on http://%s", listen)
+			err = apiServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			helperfuncs.Log("API server stopped (%v)", err)
+		}
+	}()
 }
 
 //CaptchaSolverHandler handles http requests for solving captcha
@@ -163,43 +230,6 @@ func (handler *StockAlertHandler) Test(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "hello "+IPAddress)
 }
 
-//CreateProductURLHandler handles the creation of a new team
-func (handler *StockAlertHandler) CreateProductURLHandler(w http.ResponseWriter, r *http.Request) {
-	//decode the request body into a struct representing this product
-	productURL := structs.ProductURL{}
-	err := json.NewDecoder(r.Body).Decode(&productURL)
-	if err != nil {
-		logAndWriteResponse(w, "Failed to decode product data from json body %v", http.StatusBadRequest, err.Error())
-		return
-	}
-
-	handler.ProductURLs = append(handler.ProductURLs, &productURL)
-	err = helperfuncs.SaveState(handler.ProductURLs)
-	if err != nil {
-		logAndWriteResponse(w, "Failed to save product data to file %v", http.StatusBadRequest, err.Error())
-		return
-	}
-
-	logAndWriteResponse(w, "%s", http.StatusOK)
-}
-
-//this gets rid of the hecking cors error 😡 it's used like a bootleg middleware
-func corsHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Access-Control-Allow-Credentials", "true")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-
-		if r.Method == "OPTIONS" {
-			http.Error(w, "No Content", http.StatusNoContent)
-			return
-		}
-
-		next(w, r)
-	}
-}
-
 //logAndWriteResponse is wrapper for logging that logs to console and also writes to the http writer - just for convenience
 func logAndWriteResponse(w http.ResponseWriter, format string, statusCode int, params ...interface{}) {
 	if statusCode != http.StatusOK {
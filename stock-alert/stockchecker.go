@@ -3,233 +3,534 @@ package main
 import (
 	"context"
 	captchasolver "dolos-dev/pkg/driver/captcha/pysolver"
+	seleniumdriver "dolos-dev/pkg/driver/selenium"
+	"dolos-dev/pkg/driver/webshop"
+	"dolos-dev/pkg/events"
 	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/httpclient"
+	"dolos-dev/pkg/metrics"
+	"dolos-dev/pkg/ratelimit"
+	"dolos-dev/pkg/scheduler"
 	"dolos-dev/pkg/structs"
 	"dolos-dev/pkg/switcher"
 	"fmt"
 	"math/rand"
-	"sync"
+	"net/url"
+	"path/filepath"
 	"time"
 
 	cmdcolor "github.com/TwinProduction/go-color"
 )
 
+//stockTask is a single thread of a product's stock checks. The scheduler runs one check of a task at a time
+type stockTask struct {
+	id           int
+	product      structs.ProductURL
+	globalConfig structs.GlobalConfig
+	//schedule is shared by all threads of the product, thread is this task's (0 based) slot in it
+	schedule *productSchedule
+	thread   int
+
+	webshop     webshop.Webshop
+	webshopKind structs.Webshop
+	productHost string
+	//plan decides the check interval from the product's schedule, the webshop's interval is its default
+	plan *scheduler.Plan
+
+	proxyLifetime  int
+	useProxies     bool
+	proxyLifecycle bool
+	proxies        []*structs.Proxy
+	proxyCopies    []structs.Proxy
+	lastProxySet   time.Time
+
+	//httpMode checks stock over plain HTTP, rotating through the proxies, so the task needs no browser
+	httpMode   bool
+	checkCount int
+	backoff    *checkBackoff
+}
+
 func (handler *StockAlertHandler) addMetrics(str string, taskID int) string {
 	taskIDPrefix := ""
 	if taskID > 0 {
 		taskIDPrefix = fmt.Sprint(cmdcolor.Bold, cmdcolor.Red, "#", taskID, "://")
 	}
-	handler.mutex.RLock()
-	str = fmt.Sprint(cmdcolor.Bold, cmdcolor.Gray, " [", cmdcolor.Blue, " B: ", handler.metrics.inStockSeen, cmdcolor.Green, " | S: ", handler.metrics.heBorght, cmdcolor.Yellow, " | C: ", handler.metrics.captchaSeen, cmdcolor.Gray, " ] ", cmdcolor.Reset, str)
-	handler.mutex.RUnlock()
+	//B: checks that found stock, S: checkouts that placed an order, C: captchas found
+	inStockSeen := metrics.StockChecks.SumBy("outcome", metrics.CHECK_OUTCOME_IN_STOCK)
+	ordersPlaced := metrics.CheckoutResults.SumBy("result", metrics.CHECKOUT_RESULT_SUCCESS)
+	captchaSeen := metrics.Captchas.Sum()
+	str = fmt.Sprint(cmdcolor.Bold, cmdcolor.Gray, " [", cmdcolor.Blue, " B: ", inStockSeen, cmdcolor.Green, " | S: ", ordersPlaced, cmdcolor.Yellow, " | C: ", captchaSeen, cmdcolor.Gray, " ] ", cmdcolor.Reset, str)
 
 	str = fmt.Sprint(taskIDPrefix, str)
 
 	return str
 }
 
-func (handler *StockAlertHandler) stockChecker(wgSeleniumExit *sync.WaitGroup, ctx context.Context, productURL structs.ProductURL, globalConfig structs.GlobalConfig, taskID int) {
-
-	webshop, webshopKind, err := switcher.GetWebshop(productURL.URL)
+//newStockTask prepares the given (0 based) thread of a product's stock checks and picks its proxies
+func (handler *StockAlertHandler) newStockTask(taskID int, productURL structs.ProductURL, globalConfig structs.GlobalConfig, schedule *productSchedule, thread int) (*stockTask, error) {
+	shop, webshopKind, err := switcher.GetWebshop(productURL.URL)
 	if err != nil {
-		helperfuncs.Log(handler.addMetrics("Failed to init webshop interface (%v)", taskID), err)
-		wgSeleniumExit.Done()
-		return
+		return nil, fmt.Errorf("Failed to init webshop interface (%v)", err)
 	}
 
-	var (
-		stockCheckInterval  int
-		globalProxyLifetime int
-		useProxies          bool
-		proxyCopies         []structs.Proxy //= structs.Proxy{}
-		lastProxySet        time.Time
-		proxies             []*structs.Proxy
-		proxyLifecycle      bool = false
-	)
+	task := &stockTask{
+		id:           taskID,
+		product:      productURL,
+		globalConfig: globalConfig,
+		schedule:     schedule,
+		thread:       thread,
+		webshop:      shop,
+		webshopKind:  webshopKind,
+		httpMode:     productURL.CheckMode == structs.CHECK_MODE_HTTP,
+		backoff:      newCheckBackoff(globalConfig.StockCheckBackoffMax),
+	}
+	if parsedURL, parseErr := url.Parse(productURL.URL); parseErr == nil {
+		task.productHost = parsedURL.Hostname()
+	}
 
+	stockCheckInterval := 0
 	switch webshopKind {
 	case structs.WEBSHOP_AMAZON, structs.WEBSHOP_AMAZONNL, structs.WEBSHOP_AMAZONIT, structs.WEBSHOP_AMAZONFR, structs.WEBSHOP_AMAZONDE:
 		stockCheckInterval = globalConfig.AmazonStockCheckInterval
-		globalProxyLifetime = globalConfig.AmazonProxyLifetime
-		useProxies = globalConfig.AmazonUseProxies
+		task.proxyLifetime = globalConfig.AmazonProxyLifetime
+		task.useProxies = globalConfig.AmazonUseProxies
+	}
+	task.plan, err = scheduler.NewPlan(productURL.Schedule, productURL.Timezone, time.Duration(stockCheckInterval)*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schedule of product %s (%v)", productURL.Name, err)
 	}
 
-	if useProxies {
-		if globalProxyLifetime > -1 {
-			proxyLifecycle = true
+	if task.useProxies {
+		if task.proxyLifetime > -1 {
+			task.proxyLifecycle = true
 		}
-		handler.mutex.RLock()
-		//find suitable proxies
-		proxies, err = helperfuncs.FindNextProxy(productURL.ProxiesCount, nil, handler.Proxies, webshopKind, globalProxyLifetime)
-		handler.mutex.RUnlock()
+		err = handler.setNextProxies(task)
 		if err != nil {
-			helperfuncs.Log(handler.addMetrics("Failed to get next proxies for %s [URL: %s] (%v)", taskID), productURL.Name, productURL.URL, err)
-			wgSeleniumExit.Done()
-			return
-		}
-		handler.mutex.RLock()
-		for _, proxy := range proxies {
-			proxyCopies = append(proxyCopies, *proxy)
+			return nil, err
 		}
-		handler.mutex.RUnlock()
-
-		lastProxySet = time.Now()
 	}
 
+	handler.updateTaskStatus(taskID, func(status *TaskStatus) {
+		status.ProductID = productURL.ID
+		status.Product = productURL.Name
+		status.CheckMode = productURL.CheckMode
+	})
+
+	return task, nil
+}
+
+//setNextProxies replaces the task's proxies with the next suitable ones
+func (handler *StockAlertHandler) setNextProxies(task *stockTask) error {
 	handler.mutex.Lock()
-	seleniumSession, err := handler.seleniumHandler.NewSession(&proxyCopies)
-	handler.mutex.Unlock()
+	defer handler.mutex.Unlock()
+
+	proxies, err := helperfuncs.FindNextProxy(task.product.ProxiesCount, task.proxies, handler.Proxies, task.webshopKind, task.proxyLifetime)
 	if err != nil {
-		helperfuncs.Log(handler.addMetrics("Failed to init selenium instance for this task (%v)", taskID), err)
-		wgSeleniumExit.Done()
-		return
+		return fmt.Errorf("Failed to get next proxies for %s [URL: %s] (%v)", task.product.Name, task.product.URL, err)
+	}
+	task.proxies = proxies
+	task.proxyCopies = task.proxyCopies[:0]
+	for _, proxy := range proxies {
+		task.proxyCopies = append(task.proxyCopies, *proxy)
 	}
+	task.lastProxySet = time.Now()
 
-	_ = seleniumSession
+	return nil
+}
+
+//runStockCheck is run by the scheduler whenever a task is due. It returns when the task is due next, or a zero time to stop it.
+//A task that crashed is recreated first, and a panicking check crashes the task instead of the whole process
+func (handler *StockAlertHandler) runStockCheck(ctx context.Context, taskID int) (next time.Time) {
+	handler.mutex.RLock()
+	supervised := handler.supervised[taskID]
+	task := handler.tasks[taskID]
+	handler.mutex.RUnlock()
+	if supervised == nil {
+		return time.Time{}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			next = handler.taskCrashed(taskID, fmt.Errorf("Stock checker panicked (%v)", r))
+		}
+	}()
+
+	if task == nil {
+		var err error
+		task, err = handler.startTask(supervised)
+		if err != nil {
+			return handler.taskCrashed(taskID, err)
+		}
+	}
+
+	return handler.checkStock(ctx, task)
+}
+
+//checkStock runs a single stock check of the task
+func (handler *StockAlertHandler) checkStock(ctx context.Context, task *stockTask) time.Time {
+	taskID := task.id
+	productURL := task.product
+	globalConfig := task.globalConfig
+
+	interval, paused := task.plan.IntervalAt(time.Now())
+	if paused {
+		resume := task.plan.NextActive(time.Now())
+		helperfuncs.Log(handler.addMetrics("Checks of %s are paused until %s", taskID), productURL.Name, resume.Format("Mon 15:04"))
+		handler.updateTaskStatus(taskID, func(status *TaskStatus) {
+			status.Paused = true
+			status.Interval = 0
+		})
+		return task.nextCheck(resume)
+	}
+
+	if task.schedule.isPaused() {
+		handler.updateTaskStatus(taskID, func(status *TaskStatus) {
+			status.Paused = true
+		})
+		return task.nextCheck(time.Now())
+	}
+
+	if skip, foundBy, foundAt := task.schedule.skipCheck(taskID, interval); skip {
+		helperfuncs.Log(handler.addMetrics("Skipping check, task #%v found %s in stock %v ago", taskID), foundBy, productURL.Name, time.Since(foundAt).Round(time.Second))
+		return task.nextCheck(time.Now())
+	}
+
+	checkStartTime := time.Now()
+	publishTaskEvent(taskID, productURL, events.EVENT_CHECK_STARTED, map[string]interface{}{
+		"thread":    task.thread,
+		"http_mode": task.httpMode,
+	})
+	var (
+		inStock, useAddToCartButton, captcha bool
+		captchaData                          *structs.CaptchaWrapper
+		proxy                                structs.Proxy
+		seleniumSession                      *seleniumdriver.SingleSession
+		err                                  error
+	)
+	if task.httpMode {
+		if len(task.proxyCopies) > 0 {
+			proxy = task.proxyCopies[task.checkCount%len(task.proxyCopies)]
+		}
+		task.checkCount++
+		inStock, useAddToCartButton, captcha, captchaData, err = task.webshop.CheckStockStatus(ctx, productURL, proxy)
+	} else {
+		//checks over HTTP wait for the rate limit in the HTTP client, browser checks have to wait here
+		err = ratelimit.Wait(ctx, task.productHost)
+		if err == nil {
+			seleniumSession, err = handler.checkerPool.Acquire(ctx, task.proxyCopies)
+		}
+		if err == nil {
+			inStock, useAddToCartButton, captcha, captchaData, err = seleniumSession.CheckStockStatus(productURL, task.webshop, globalConfig.DebugScreenshots)
+		}
+	}
+	releaseSession := func(checkErr error) {
+		if seleniumSession != nil {
+			handler.checkerPool.Release(seleniumSession, checkErr)
+			seleniumSession = nil
+		}
+	}
+	defer releaseSession(nil)
+
+	//the task was stopped while waiting or checking
+	if ctx.Err() != nil {
+		helperfuncs.Log(handler.addMetrics("Exiting stockChecker task", taskID))
+		handler.updateTaskStatus(taskID, func(status *TaskStatus) {
+			status.State = TASK_STATE_STOPPED
+		})
+		return time.Time{}
+	}
+
+	checkErr := err
+	if err != nil {
+		releaseSession(err)
+		wait := task.backoff.failed(err)
+		helperfuncs.Log(handler.addMetrics("Failed to check stock for %s [URL: %s] (%v)", taskID), productURL.Name, productURL.URL, err)
+		helperfuncs.Log(handler.addMetrics("Waiting %v before checking %s again: %s", taskID), wait.Round(time.Second), productURL.Name, task.backoff)
+	} else {
+		task.backoff.succeeded()
+		if captcha {
+			helperfuncs.Log(handler.addMetrics("Captcha found", taskID))
+
+			if captchaData.CaptchaURL == "" {
+				helperfuncs.Log(handler.addMetrics("Captcha does not have a URL", taskID))
 
-	for {
-		select {
-		case <-ctx.Done():
-			//if the sigStopChan channel is signalled then we return from the function to kill the thread
-			helperfuncs.Log(handler.addMetrics("Exiting stockChecker thread", taskID))
-			/*
-				err = seleniumSession.Webdriver.Close()
-				if err != nil {
-					fmt.Println("failed to close selenium session ", err)
-				}
-			*/
-			err = seleniumSession.Webdriver.Quit()
-			if err != nil {
-				fmt.Println("failed to quit selenium session ", err)
-			}
-			wgSeleniumExit.Done()
-			return
-		default:
-			checkStartTime := time.Now()
-			inStock, useAddToCartButton, captcha, captchaData, err := seleniumSession.CheckStockStatus(productURL, webshop, globalConfig.DebugScreenshots)
-			if err != nil {
-				helperfuncs.Log(handler.addMetrics("Failed to check stock for %s [URL: %s] (%v)", taskID), productURL.Name, productURL.URL, err)
 			} else {
-				if captcha {
-					helperfuncs.Log(handler.addMetrics("Captcha found", taskID))
-
-					if captchaData.CaptchaURL == "" {
-						helperfuncs.Log(handler.addMetrics("Captcha does not have a URL", taskID))
-
-					} else {
-						//put session key and captcha data into CaptchaSolverMap
-						handler.mutex.Lock()
-						handler.CaptchaSolver[captchaData.SessionID] = captchaData
-						handler.metrics.captchaSeen++
-						handler.mutex.Unlock()
-
-						captchaToken, err := captchasolver.SolveCaptcha(captchaData.CaptchaURL, globalConfig.CaptchaSolverEndpoint)
-						if err != nil {
-							helperfuncs.Log(handler.addMetrics("Failed to solve captcha (%v)", taskID), err)
-							wgSeleniumExit.Done()
-							return
-						} else {
-							helperfuncs.Log(handler.addMetrics("Captcha solved: %s", taskID), captchaToken)
-						}
+				//put session key and captcha data into CaptchaSolverMap
+				handler.mutex.Lock()
+				handler.CaptchaSolver[captchaData.SessionID] = captchaData
+				handler.mutex.Unlock()
+				metrics.Captchas.Inc(productURL.Name, task.webshopKind.Name())
 
-						err = seleniumSession.SolveCaptcha(captchaToken, webshop)
-						if err != nil {
-							helperfuncs.Log(handler.addMetrics("Failed to complete captcha (%v)", taskID), err)
-							wgSeleniumExit.Done()
-							return
-						}
-					}
+				captchaToken, err := captchasolver.SolveCaptcha(ctx, captchaData.CaptchaURL, globalConfig.CaptchaSolverEndpoint)
+				if err != nil {
+					metrics.Errors.Inc(metrics.ERROR_CAPTCHA_FAILED)
+					return handler.taskCrashed(taskID, fmt.Errorf("Failed to solve captcha (%v)", err))
+				} else {
+					helperfuncs.Log(handler.addMetrics("Captcha solved: %s", taskID), captchaToken)
 				}
 
-				if inStock {
-					helperfuncs.Log(handler.addMetrics(fmt.Sprint("Product ", productURL.Name, " is in stock!!!!!"), taskID))
-
-					if !productURL.OnlyCheckStock {
-						for i := 0; i < 12; i++ {
-							for j := 0; j < 10; j++ {
-								handler.mutex.RLock()
-								go handler.seleniumHandler.Checkout(useAddToCartButton, webshop, productURL)
-								handler.mutex.RUnlock()
-							}
-							time.Sleep(25 * time.Second)
-						}
-						/*
-							err = nil
-							if err != nil {
-								helperfuncs.Log(handler.addMetrics("Failed to buy %s (%v)", taskID), productURL.Name, err)
-							} else {
-								handler.mutex.Lock()
-								handler.metrics.heBorght++
-
-								if productURL.MaxPurchases > 0 {
-									//find current product in list
-									for _, product := range handler.ProductURLs {
-										if product.ID == productURL.ID {
-											product.CurrentPurchases++
-											if product.CurrentPurchases >= product.MaxPurchases {
-												handler.mutex.Unlock()
-												helperfuncs.Log(handler.addMetrics("Completed purchase quota for product %s. Stopping task", taskID), productURL.Name)
-												seleniumSession.Webdriver.Quit()
-												wgSeleniumExit.Done()
-												return
-											}
-											break
-										}
-									}
-								}
-								handler.mutex.Unlock()
-
-								helperfuncs.Log(handler.addMetrics("============", taskID))
-								helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
-								helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
-								helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
-								helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
-								helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
-								helperfuncs.Log(handler.addMetrics("============", taskID))
-							}
-						*/
-					}
-
-					handler.mutex.Lock()
-					handler.metrics.inStockSeen++
-					handler.mutex.Unlock()
+				if task.httpMode {
+					err = task.webshop.SolveCaptchaHTTP(ctx, captchaData, captchaToken, proxy)
 				} else {
-					helperfuncs.Log(handler.addMetrics(fmt.Sprint("Product ", productURL.Name, " sold out"), taskID))
+					err = seleniumSession.SolveCaptcha(captchaToken, task.webshop)
+				}
+				if err != nil {
+					metrics.Errors.Inc(metrics.ERROR_CAPTCHA_FAILED)
+					return handler.taskCrashed(taskID, fmt.Errorf("Failed to complete captcha (%v)", err))
 				}
 			}
+		} else {
+			//only a check that got past the captcha and parsed the stock resets the restart backoff, a task that keeps
+			//failing captchas has to reach degraded
+			handler.taskRecovered(taskID)
+		}
+		if inStock && !task.schedule.claimStock(taskID) {
+			helperfuncs.Log(handler.addMetrics("Product %s is in stock and already being checked out by another task", taskID), productURL.Name)
+		} else if inStock {
+			detected := time.Now()
+			helperfuncs.Log(handler.addMetrics(fmt.Sprint("Product ", productURL.Name, " is in stock!!!!!"), taskID))
 
-			if useProxies {
-				//check if proxies needs to be updated
-				if lastProxySet.Add(time.Duration(globalProxyLifetime)*time.Minute).Before(time.Now()) && proxyLifecycle {
-					helperfuncs.Log(handler.addMetrics("\n==================================================\nchanging proxies\n", taskID))
-					handler.mutex.Lock()
-					proxies, err = helperfuncs.FindNextProxy(productURL.ProxiesCount, proxies, handler.Proxies, webshopKind, globalProxyLifetime)
-					for _, proxy := range proxies {
-						proxyCopies = append(proxyCopies, *proxy)
-					}
-					handler.mutex.Unlock()
-					if err != nil {
-						helperfuncs.Log(handler.addMetrics("Failed to get next proxies for %s [URL: %s] (%v)", taskID), productURL.Name, productURL.URL, err)
-						wgSeleniumExit.Done()
-						return
-					}
-					helperfuncs.Log(handler.addMetrics("proxies changed\n==================================================\n", taskID))
+			//the checkouts run outside of the scheduler so they don't hold a worker
+			go handler.checkoutBurst(task, useAddToCartButton, detected, task.webshop.LowestPrice())
+		} else {
+			helperfuncs.Log(handler.addMetrics(fmt.Sprint("Product ", productURL.Name, " sold out"), taskID))
+		}
 
-					handler.mutex.Lock()
-					seleniumSession.Webdriver.Quit()
-					seleniumSession, err = handler.seleniumHandler.NewSession(&proxyCopies)
-					handler.mutex.Unlock()
+		//the check returned on the first offer in stock, the other offers' prices are read once the checkout is on its way
+		if inStock && seleniumSession != nil {
+			task.webshop.CollectOfferPrices(seleniumSession.Webdriver)
+		}
 
-					lastProxySet = time.Now()
-				}
+		//a product back in stock is screenshotted for the notifications before the checker browser goes back to the pool
+		var screenshot []byte
+		if inStock && seleniumSession != nil && !task.schedule.wasInStock() {
+			var screenshotErr error
+			screenshot, screenshotErr = seleniumSession.Screenshot()
+			if screenshotErr != nil {
+				helperfuncs.Log(handler.addMetrics("Failed to take screenshot for notifications (%v)", taskID), screenshotErr)
 			}
+		}
+		releaseSession(nil)
+		handler.publishCheckResult(task, inStock, useAddToCartButton, screenshot)
+	}
 
-			timeElapsed := time.Now().Sub(checkStartTime)
-			if timeElapsed.Milliseconds() < int64(stockCheckInterval) {
-				sleepTime := (stockCheckInterval + rand.Intn(globalConfig.AmazonStockCheckIntervalDeviation)) - int(timeElapsed.Milliseconds())
-				time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+	record := CheckRecord{
+		Time:     checkStartTime,
+		TaskID:   taskID,
+		InStock:  inStock,
+		Duration: time.Since(checkStartTime),
+	}
+	checkFinished := map[string]interface{}{
+		"in_stock":    inStock,
+		"duration_ms": record.Duration.Milliseconds(),
+	}
+	if checkErr != nil {
+		record.Error = checkErr.Error()
+		checkFinished["error"] = record.Error
+	} else if price := task.webshop.LowestPrice(); price > 0 {
+		record.Price = price
+		checkFinished["price"] = price
+	}
+	task.schedule.recordCheck(record)
+	observeCheck(task, record, captcha, checkErr)
+	publishTaskEvent(taskID, productURL, events.EVENT_CHECK_FINISHED, checkFinished)
+
+	handler.updateTaskStatus(taskID, func(status *TaskStatus) {
+		status.Paused = false
+		status.Interval = interval
+		status.LastCheck = checkStartTime
+		status.InStock = inStock
+		status.LastError = ""
+		if checkErr != nil {
+			status.LastError = checkErr.Error()
+		}
+		setBackoffStatus(status, task.backoff)
+	})
+
+	if task.useProxies {
+		//check if proxies needs to be updated
+		if task.lastProxySet.Add(time.Duration(task.proxyLifetime)*time.Minute).Before(time.Now()) && task.proxyLifecycle {
+			helperfuncs.Log(handler.addMetrics("\n==================================================\nchanging proxies\n", taskID))
+			err = handler.setNextProxies(task)
+			if err != nil {
+				return handler.taskCrashed(taskID, err)
 			}
+			//the pool's browsers keep their proxies, they are replaced with browsers using the new ones once they are as old as the proxy lifetime
+			helperfuncs.Log(handler.addMetrics("proxies changed\n==================================================\n", taskID))
+		}
+	}
 
+	//the next check is on our next slot, or the first one after the backoff
+	if task.backoff.active() {
+		return task.nextCheck(task.backoff.until)
+	}
+	return task.nextCheck(time.Now())
+}
+
+//publishCheckResult publishes what a successful check found. in_stock is published on every check that finds the product,
+//out_of_stock and price_changed only when that differs from the product's previous check. If the check ran in a browser,
+//in_stock carries the file name of its screenshot in helperfuncs.NOTIFICATION_SCREENSHOT_DIR when the product just came back in stock
+func (handler *StockAlertHandler) publishCheckResult(task *stockTask, inStock bool, useAddToCartButton bool, screenshot []byte) {
+	price := task.webshop.LowestPrice()
+	wasInStock, oldPrice := task.schedule.observeCheck(inStock, price)
+
+	data := map[string]interface{}{
+		"webshop": task.webshopKind,
+		"url":     task.product.URL,
+	}
+	if price > 0 {
+		data["price"] = price
+	}
+	switch {
+	case inStock:
+		data["add_to_cart"] = useAddToCartButton
+		if seller := task.webshop.Seller(); seller != "" {
+			data["seller"] = seller
+		}
+		if len(screenshot) > 0 && !wasInStock {
+			imagePath, err := helperfuncs.SaveNotificationScreenshot(fmt.Sprintf("product%v", task.product.ID), screenshot)
+			if err != nil {
+				helperfuncs.Log(handler.addMetrics("Failed to save screenshot for notifications (%v)", task.id), err)
+			} else {
+				data["screenshot"] = filepath.Base(imagePath)
+			}
 		}
+		publishTaskEvent(task.id, task.product, events.EVENT_IN_STOCK, data)
+	case wasInStock:
+		publishTaskEvent(task.id, task.product, events.EVENT_OUT_OF_STOCK, data)
 	}
+
+	if price > 0 && oldPrice > 0 && price != oldPrice {
+		publishTaskEvent(task.id, task.product, events.EVENT_PRICE_CHANGED, map[string]interface{}{
+			"webshop":   task.webshopKind,
+			"url":       task.product.URL,
+			"price":     price,
+			"old_price": oldPrice,
+			"in_stock":  inStock,
+		})
+	}
+}
+
+//observeCheck adds a finished check to the metrics
+func observeCheck(task *stockTask, record CheckRecord, captcha bool, checkErr error) {
+	mode := structs.CHECK_MODE_SELENIUM
+	if task.httpMode {
+		mode = structs.CHECK_MODE_HTTP
+	}
+
+	outcome := metrics.CHECK_OUTCOME_SOLD_OUT
+	switch {
+	case checkErr != nil:
+		outcome = metrics.CHECK_OUTCOME_ERROR
+		statusErr := httpclient.AsStatusError(checkErr)
+		if statusErr != nil && statusErr.Throttled() {
+			metrics.Errors.Inc(metrics.ERROR_CHECK_THROTTLED)
+		} else {
+			metrics.Errors.Inc(metrics.ERROR_CHECK_FAILED)
+		}
+	case record.InStock:
+		outcome = metrics.CHECK_OUTCOME_IN_STOCK
+	case captcha:
+		outcome = metrics.CHECK_OUTCOME_CAPTCHA
+	}
+
+	webshopName := task.webshopKind.Name()
+	metrics.StockChecks.Inc(task.product.Name, webshopName, mode, outcome)
+	metrics.StockCheckDuration.Observe(record.Duration.Seconds(), task.product.Name, webshopName, mode)
+}
+
+//publishTaskEvent publishes an event of the given task
+func publishTaskEvent(taskID int, product structs.ProductURL, eventType string, data map[string]interface{}) {
+	events.Publish(events.Event{
+		Type:      eventType,
+		ProductID: product.ID,
+		Product:   product.Name,
+		TaskID:    taskID,
+		Data:      data,
+	})
+}
+
+//nextCheck returns the task's first slot after t at the interval that applies then. The jitter is added per check so it doesn't add up
+func (task *stockTask) nextCheck(t time.Time) time.Time {
+	interval, _ := task.plan.IntervalAt(t)
+	next := task.schedule.nextSlot(task.thread, interval, t)
+	if task.globalConfig.AmazonStockCheckIntervalDeviation > 0 {
+		next = next.Add(time.Duration(rand.Intn(task.globalConfig.AmazonStockCheckIntervalDeviation)) * time.Millisecond)
+	}
+	return next
+}
+
+//firstCheck returns when the task checks for the first time
+func (task *stockTask) firstCheck() time.Time {
+	interval, _ := task.plan.IntervalAt(time.Now())
+	return task.schedule.firstSlot(task.thread, interval)
+}
+
+//checkoutBurst keeps starting checkouts of an in stock product for a few minutes, then lets the product's other threads check again.
+//Checkouts of products that require approval only start once they are approved
+func (handler *StockAlertHandler) checkoutBurst(task *stockTask, useAddToCartButton bool, detected time.Time, price float64) {
+	defer task.schedule.releaseStock(task.id)
+
+	productURL := task.product
+	if productURL.OnlyCheckStock {
+		return
+	}
+	if productURL.RequireApproval && !handler.awaitApproval(task, detected, price) {
+		return
+	}
+
+	for i := 0; i < 12; i++ {
+		for j := 0; j < 10; j++ {
+			handler.mutex.Lock()
+			handler.checkoutsRunning++
+			handler.mutex.Unlock()
+			go func() {
+				handler.seleniumHandler.Checkout(useAddToCartButton, task.webshop, productURL, detected)
+				handler.mutex.Lock()
+				handler.checkoutsRunning--
+				handler.mutex.Unlock()
+			}()
+		}
+
+		select {
+		case <-handler.stockCheckCtx.Done():
+			return
+		case <-time.After(25 * time.Second):
+		}
+	}
+	/*
+		err = nil
+		if err != nil {
+			helperfuncs.Log(handler.addMetrics("Failed to buy %s (%v)", taskID), productURL.Name, err)
+		} else {
+			handler.mutex.Lock()
+			handler.metrics.heBorght++
+
+			if productURL.MaxPurchases > 0 {
+				//find current product in list
+				for _, product := range handler.ProductURLs {
+					if product.ID == productURL.ID {
+						product.CurrentPurchases++
+						if product.CurrentPurchases >= product.MaxPurchases {
+							handler.mutex.Unlock()
+							helperfuncs.Log(handler.addMetrics("Completed purchase quota for product %s. Stopping task", taskID), productURL.Name)
+							seleniumSession.Webdriver.Quit()
+							wgSeleniumExit.Done()
+							return
+						}
+						break
+					}
+				}
+			}
+			handler.mutex.Unlock()
+
+			helperfuncs.Log(handler.addMetrics("============", taskID))
+			helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
+			helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
+			helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
+			helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
+			helperfuncs.Log(handler.addMetrics("HE BORGHT", taskID))
+			helperfuncs.Log(handler.addMetrics("============", taskID))
+		}
+	*/
 }
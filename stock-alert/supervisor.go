@@ -0,0 +1,204 @@
+package main
+
+import (
+	"dolos-dev/pkg/events"
+	"dolos-dev/pkg/helperfuncs"
+	"dolos-dev/pkg/metrics"
+	"dolos-dev/pkg/structs"
+	"fmt"
+	"time"
+)
+
+//states of a supervised stock check task as shown by the status endpoint
+const (
+	TASK_STATE_RUNNING    = "running"
+	TASK_STATE_RESTARTING = "restarting"
+	TASK_STATE_DEGRADED   = "degraded"
+	TASK_STATE_STOPPED    = "stopped"
+)
+
+const (
+	//restartBackoffMin is the wait before the first restart of a crashed task, doubled with every further restart
+	restartBackoffMin = 10 * time.Second
+	//defaultRestartBackoffMax is the ceiling of the wait if task_restart_backoff_max is not set
+	defaultRestartBackoffMax = 15 * time.Minute
+	//defaultMaxRestarts is how often a task is restarted before it is marked degraded if task_max_restarts is not set
+	defaultMaxRestarts = 5
+)
+
+//supervisedTask holds everything needed to recreate a stock check task after it crashed. A task crashes when
+//it can't go on with its current state, e.g. it failed to solve a captcha or to get new proxies
+type supervisedTask struct {
+	id           int
+	product      structs.ProductURL
+	globalConfig structs.GlobalConfig
+	schedule     *productSchedule
+	thread       int
+
+	//restarts counts the restarts since the task last checked successfully, crashes all crashes since it was added
+	restarts    int
+	crashes     int
+	lastCrash   string
+	lastCrashAt time.Time
+	degraded    bool
+}
+
+//superviseTask adds a stock check task to the supervisor and schedules it. If the task can't be created it is
+//restarted with backoff like a crashed task
+func (handler *StockAlertHandler) superviseTask(taskID int, productURL structs.ProductURL, globalConfig structs.GlobalConfig, schedule *productSchedule, thread int) {
+	supervised := &supervisedTask{
+		id:           taskID,
+		product:      productURL,
+		globalConfig: globalConfig,
+		schedule:     schedule,
+		thread:       thread,
+	}
+	handler.mutex.Lock()
+	handler.supervised[taskID] = supervised
+	handler.mutex.Unlock()
+
+	var due time.Time
+	task, err := handler.startTask(supervised)
+	if err != nil {
+		due = handler.taskCrashed(taskID, err)
+	} else {
+		due = task.firstCheck()
+	}
+	handler.scheduler.Schedule(taskID, due)
+}
+
+//startTask (re)creates the stock check task of a supervised task
+func (handler *StockAlertHandler) startTask(supervised *supervisedTask) (*stockTask, error) {
+	task, err := handler.newStockTask(supervised.id, supervised.product, supervised.globalConfig, supervised.schedule, supervised.thread)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create stock check task (%v)", err)
+	}
+
+	handler.mutex.Lock()
+	if handler.supervised[supervised.id] != supervised {
+		//the task was stopped while it was being created
+		handler.tasks[supervised.id] = task
+		handler.releaseTask(supervised.id)
+		handler.mutex.Unlock()
+		return nil, fmt.Errorf("Stock check task was stopped")
+	}
+	handler.tasks[supervised.id] = task
+	restarts, crashes, lastCrash, degraded := supervised.restarts, supervised.crashes, supervised.lastCrash, supervised.degraded
+	handler.mutex.Unlock()
+
+	if restarts > 0 {
+		helperfuncs.Log(handler.addMetrics("Restarted stock check task of %s (restart %v)", supervised.id), supervised.product.Name, restarts)
+		publishTaskEvent(supervised.id, supervised.product, events.EVENT_TASK_RESTARTED, map[string]interface{}{
+			"restarts":   restarts,
+			"crashes":    crashes,
+			"last_crash": lastCrash,
+			"degraded":   degraded,
+		})
+	}
+	handler.updateTaskStatus(supervised.id, func(status *TaskStatus) {
+		status.State = TASK_STATE_RUNNING
+		if degraded {
+			status.State = TASK_STATE_DEGRADED
+		}
+		status.RestartAt = nil
+	})
+
+	return task, nil
+}
+
+//taskCrashed records why the task crashed and drops it, so the scheduler recreates it on its next run. It returns
+//when to restart the task, backing off exponentially with every restart until the task checks successfully again
+func (handler *StockAlertHandler) taskCrashed(taskID int, reason error) time.Time {
+	metrics.Errors.Inc(metrics.ERROR_TASK_CRASHED)
+	handler.mutex.Lock()
+	supervised := handler.supervised[taskID]
+	//the restarted task picks new proxies
+	handler.releaseTask(taskID)
+	handler.mutex.Unlock()
+	if supervised == nil {
+		return time.Time{}
+	}
+
+	maxRestarts := supervised.globalConfig.TaskMaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = defaultMaxRestarts
+	}
+	maxWait := time.Duration(supervised.globalConfig.TaskRestartBackoffMax) * time.Second
+	if maxWait <= 0 {
+		maxWait = defaultRestartBackoffMax
+	}
+
+	handler.mutex.Lock()
+	supervised.restarts++
+	supervised.crashes++
+	supervised.lastCrash = reason.Error()
+	supervised.lastCrashAt = time.Now()
+	restarts, crashes, lastCrash, lastCrashAt := supervised.restarts, supervised.crashes, supervised.lastCrash, supervised.lastCrashAt
+	nowDegraded := restarts > maxRestarts && !supervised.degraded
+	if nowDegraded {
+		supervised.degraded = true
+	}
+	degraded := supervised.degraded
+	handler.mutex.Unlock()
+
+	wait := maxWait
+	if restarts <= 16 {
+		wait = restartBackoffMin << (restarts - 1)
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	restartAt := time.Now().Add(wait)
+
+	helperfuncs.Log(handler.addMetrics("Stock check task of %s crashed (%v)", taskID), supervised.product.Name, reason)
+	if nowDegraded {
+		helperfuncs.Log(handler.addMetrics("Stock check task of %s crashed %v times in a row and is degraded, it keeps restarting at most every %v", taskID), supervised.product.Name, restarts, maxWait)
+	}
+	helperfuncs.Log(handler.addMetrics("Restarting stock check task of %s in %v", taskID), supervised.product.Name, wait.Round(time.Second))
+
+	handler.updateTaskStatus(taskID, func(status *TaskStatus) {
+		status.State = TASK_STATE_RESTARTING
+		if degraded {
+			status.State = TASK_STATE_DEGRADED
+		}
+		status.Restarts = restarts
+		status.Crashes = crashes
+		status.LastCrash = lastCrash
+		status.LastCrashAt = &lastCrashAt
+		status.RestartAt = &restartAt
+	})
+
+	return restartAt
+}
+
+//releaseTask frees the task's proxies and drops it. The caller holds the mutex
+func (handler *StockAlertHandler) releaseTask(taskID int) {
+	if task, ok := handler.tasks[taskID]; ok {
+		for _, proxy := range task.proxies {
+			proxy.InUse = false
+		}
+	}
+	delete(handler.tasks, taskID)
+}
+
+//taskRecovered resets the restart backoff once a restarted task checked successfully
+func (handler *StockAlertHandler) taskRecovered(taskID int) {
+	handler.mutex.Lock()
+	supervised := handler.supervised[taskID]
+	if supervised == nil || supervised.restarts == 0 {
+		handler.mutex.Unlock()
+		return
+	}
+	wasDegraded := supervised.degraded
+	supervised.restarts = 0
+	supervised.degraded = false
+	handler.mutex.Unlock()
+
+	if wasDegraded {
+		helperfuncs.Log(handler.addMetrics("Stock check task of %s recovered", taskID), supervised.product.Name)
+	}
+	handler.updateTaskStatus(taskID, func(status *TaskStatus) {
+		status.State = TASK_STATE_RUNNING
+		status.Restarts = 0
+	})
+}